@@ -0,0 +1,177 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AggFunc is an aggregate function applied to numeric payloads.
+type AggFunc uint8
+
+// Various aggregate functions.
+const (
+	AggCount AggFunc = iota
+	AggSum
+	AggMin
+	AggMax
+	AggAvg
+)
+
+type (
+	// AggSpec specifies the aggregate function, the time bucket and the payload field to aggregate.
+	AggSpec struct {
+		Func AggFunc
+		// Bucket is the width of the time bucket, zero aggregates all messages into a single bucket.
+		Bucket time.Duration
+		// Field is a dot separated path of the numeric field in a JSON payload,
+		// if it is empty the payload is decoded as a little endian float64.
+		Field string
+	}
+
+	// AggResult is the aggregated value of a time bucket.
+	AggResult struct {
+		Time  time.Time // The start time of the bucket.
+		Count int       // The number of messages aggregated into the bucket.
+		Value float64   // The aggregated value.
+	}
+
+	_AggBucket struct {
+		timeID int64
+		count  int
+		sum    float64
+		min    float64
+		max    float64
+	}
+)
+
+// Aggregate applies the aggregate function to the messages matching the query and returns one value per time bucket in time order.
+// Messages are read from the time window blocks as in Items, so aggregation is not limited to maxQueryLimit unless Query.Limit is set.
+// Messages which payload cannot be decoded to a number are skipped.
+func (db *DB) Aggregate(q *Query, spec AggSpec) ([]AggResult, error) {
+	if spec.Func > AggAvg || spec.Bucket < 0 || (spec.Bucket > 0 && spec.Bucket < time.Second) {
+		return nil, errAggregateInvalid
+	}
+	buckets, err := db.aggregate(q, spec.Bucket, spec.Field)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]AggResult, 0, len(buckets))
+	for _, b := range buckets {
+		results = append(results, AggResult{Time: time.Unix(b.timeID, 0), Count: b.count, Value: b.value(spec.Func)})
+	}
+
+	return results, nil
+}
+
+// aggregate reads messages matching the query into time buckets and returns buckets in time order.
+func (db *DB) aggregate(q *Query, bucket time.Duration, field string) ([]*_AggBucket, error) {
+	it, err := db.Items(q)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	bucketSize := int64(bucket / time.Second)
+	buckets := make(map[int64]*_AggBucket)
+	for it.Next() {
+		val, ok := decodeNumber(it.Item(), field)
+		if !ok {
+			continue
+		}
+		timeID := it.id.Time()
+		key := int64(0)
+		if bucketSize > 0 {
+			key = timeID - timeID%bucketSize
+		}
+		b, ok := buckets[key]
+		if !ok {
+			b = &_AggBucket{timeID: key, min: val, max: val}
+			buckets[key] = b
+		}
+		if bucketSize == 0 {
+			// messages are read in reverse time order, so the single bucket starts at the time of the oldest message.
+			b.timeID = timeID
+		}
+		b.add(val)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*_AggBucket, 0, len(buckets))
+	for _, b := range buckets {
+		sorted = append(sorted, b)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].timeID < sorted[j].timeID
+	})
+
+	return sorted, nil
+}
+
+func (b *_AggBucket) add(val float64) {
+	b.count++
+	b.sum += val
+	b.min = math.Min(b.min, val)
+	b.max = math.Max(b.max, val)
+}
+
+func (b *_AggBucket) value(f AggFunc) float64 {
+	switch f {
+	case AggSum:
+		return b.sum
+	case AggMin:
+		return b.min
+	case AggMax:
+		return b.max
+	case AggAvg:
+		return b.sum / float64(b.count)
+	default:
+		return float64(b.count)
+	}
+}
+
+// decodeNumber decodes numeric value from the payload.
+func decodeNumber(payload []byte, field string) (float64, bool) {
+	if field == "" {
+		if len(payload) != 8 {
+			return 0, false
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(payload)), true
+	}
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return 0, false
+	}
+	for _, name := range strings.Split(field, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		if v, ok = obj[name]; !ok {
+			return 0, false
+		}
+	}
+	val, ok := v.(float64)
+	return val, ok
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	backupVersion = 1
+	manifestName  = "unitdb.manifest"
+)
+
+type (
+	// _BackupFile is a file of the backup archive and the checksum of the file.
+	_BackupFile struct {
+		Name     string `json:"name"`
+		Size     int64  `json:"size"`
+		Checksum uint32 `json:"checksum"`
+	}
+
+	// _BackupManifest is written as the last file of the backup archive to verify the archive on restore.
+	_BackupManifest struct {
+		Version int           `json:"version"`
+		Created time.Time     `json:"created"`
+		Files   []_BackupFile `json:"files"`
+	}
+
+	// _SnapshotFile is a file of the DB captured holding the sync lock, it is read up to the size of the file at the snapshot.
+	_SnapshotFile struct {
+		name    string
+		file    *os.File
+		size    int64
+		modTime time.Time
+		temp    bool // file is a temporary copy of the DB file.
+	}
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Backup writes a consistent copy of the DB to the writer as a tar archive.
+// Sync is blocked while a snapshot of the files is taken, the files are then copied without blocking sync.
+// Writes continue to the memdb and the write ahead log.
+// The archive contains the info, window, index, data, lease, filter, tombstone, dedup and last-value files, the write ahead logs
+// of entries not yet synced and a manifest with checksums of the files. Use Restore to restore the archive.
+func (db *DB) Backup(w io.Writer) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	// data files are only appended while free blocks are not reused, so these are copied up to the size at the snapshot.
+	db.internal.freeList.pause()
+	defer db.internal.freeList.resume()
+	files, err := db.snapshot()
+	defer func() {
+		for _, f := range files {
+			f.close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	m := _BackupManifest{Version: backupVersion, Created: time.Now()}
+	for _, sf := range files {
+		f, err := writeBackupFile(tw, sf)
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, f)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: manifestName, Mode: 0666, Size: int64(len(data)), ModTime: m.Created}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// backupFiles returns names of the DB files relative to the DB directory.
+func (db *DB) backupFiles() ([]string, error) {
+	var names []string
+	for _, fd := range []_FileDesc{{fileType: typeInfo}, {fileType: typeLease}, {fileType: typeFilter}, {fileType: typeTombstone}, {fileType: typeDedup}} {
+		names = append(names, path.Base(filePath(db.internal.path, fd)))
+	}
+	// the last-value file exists if the last-value cache is enabled.
+	if db.internal.lastValues != nil {
+		names = append(names, path.Base(filePath(db.internal.path, _FileDesc{fileType: typeLastValue})))
+	}
+	dirs := map[string]string{winDir: ".win", indexDir: ".index", dataDir: ".data", logDir: ".log"}
+	for _, dir := range []string{winDir, indexDir, dataDir, logDir} {
+		entries, err := os.ReadDir(path.Join(db.internal.path, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, e := range entries {
+			// files of an aborted compaction and partially written logs are skipped.
+			if e.Type().IsRegular() && path.Ext(e.Name()) == dirs[dir] {
+				names = append(names, path.Join(dir, e.Name()))
+			}
+		}
+	}
+	return names, nil
+}
+
+// snapshot opens files of the DB holding the sync lock. Data files and write ahead logs are not changed below the size
+// at the snapshot, these are read from the files. Other files are changed in place or rewritten, these are copied to
+// temporary files. The snapshot files are returned along with the error so files opened before the error are closed.
+func (db *DB) snapshot() ([]_SnapshotFile, error) {
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+
+	// write free blocks and dedup records so the lease and dedup files are consistent with the data file.
+	if !db.opts.flags.readOnly {
+		if err := db.internal.freeList.write(); err != nil {
+			return nil, err
+		}
+		if err := db.internal.dedup.write(); err != nil {
+			return nil, err
+		}
+		if err := db.internal.lastValues.write(); err != nil {
+			return nil, err
+		}
+	}
+	names, err := db.backupFiles()
+	if err != nil {
+		return nil, err
+	}
+	var files []_SnapshotFile
+	for _, name := range names {
+		f, err := os.Open(path.Join(db.internal.path, name))
+		if err != nil {
+			return files, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return files, err
+		}
+		sf := _SnapshotFile{name: name, file: f, size: stat.Size(), modTime: stat.ModTime()}
+		if dir := path.Dir(name); dir != dataDir && dir != logDir {
+			sf, err = copySnapshotFile(sf)
+			f.Close()
+			if err != nil {
+				return files, err
+			}
+		}
+		files = append(files, sf)
+	}
+	return files, nil
+}
+
+// copySnapshotFile copies the snapshot file to a temporary file.
+func copySnapshotFile(sf _SnapshotFile) (_SnapshotFile, error) {
+	tmp, err := os.CreateTemp("", "unitdb-backup-*")
+	if err != nil {
+		return sf, err
+	}
+	n, err := io.Copy(tmp, io.NewSectionReader(sf.file, 0, sf.size))
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return sf, err
+	}
+	return _SnapshotFile{name: sf.name, file: tmp, size: n, modTime: sf.modTime, temp: true}, nil
+}
+
+func (sf _SnapshotFile) close() {
+	sf.file.Close()
+	if sf.temp {
+		os.Remove(sf.file.Name())
+	}
+}
+
+func writeBackupFile(tw *tar.Writer, sf _SnapshotFile) (_BackupFile, error) {
+	hdr := &tar.Header{Name: sf.name, Mode: 0666, Size: sf.size, ModTime: sf.modTime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return _BackupFile{}, err
+	}
+	crc := crc32.New(crcTable)
+	if _, err := io.Copy(io.MultiWriter(tw, crc), io.NewSectionReader(sf.file, 0, sf.size)); err != nil {
+		return _BackupFile{}, err
+	}
+	return _BackupFile{Name: sf.name, Size: sf.size, Checksum: crc.Sum32()}, nil
+}
+
+// Restore restores the archive written by DB.Backup to the path. The path must not exist or it must be an empty directory.
+// Files are verified against the checksums of the archive manifest, restored files are removed if the verification fails.
+func Restore(r io.Reader, dirName string) error {
+	if entries, err := os.ReadDir(dirName); err == nil && len(entries) > 0 {
+		return errRestoreNotEmpty
+	}
+	if err := os.MkdirAll(dirName, 0777); err != nil {
+		return err
+	}
+	if err := readBackup(r, dirName); err != nil {
+		os.RemoveAll(dirName)
+		return err
+	}
+	return nil
+}
+
+// VerifyBackup verifies files of the archive written by DB.Backup against the checksums of the archive manifest.
+func VerifyBackup(r io.Reader) error {
+	return readBackup(r, "")
+}
+
+// readBackup reads files of the archive and verifies the files against the manifest.
+// Files are written to the directory if dirName is not empty.
+func readBackup(r io.Reader, dirName string) error {
+	tr := tar.NewReader(r)
+	files := make(map[string]_BackupFile)
+	var m *_BackupManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errBackupCorrupted
+		}
+		if hdr.Name == manifestName {
+			m = &_BackupManifest{}
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return errBackupCorrupted
+			}
+			continue
+		}
+		if path.Clean(hdr.Name) != hdr.Name || path.IsAbs(hdr.Name) || strings.HasPrefix(hdr.Name, "..") {
+			return errBackupCorrupted
+		}
+		f, err := readBackupFile(tr, hdr.Name, dirName)
+		if err != nil {
+			return err
+		}
+		files[hdr.Name] = f
+	}
+	if _, ok := files[prefix+".info"]; !ok || m == nil || m.Version != backupVersion || len(m.Files) != len(files) {
+		return errBackupCorrupted
+	}
+	for _, f := range m.Files {
+		if files[f.Name] != f {
+			return errBackupCorrupted
+		}
+	}
+	return nil
+}
+
+func readBackupFile(r io.Reader, name, dirName string) (_BackupFile, error) {
+	crc := crc32.New(crcTable)
+	w := io.Writer(crc)
+	if dirName != "" {
+		if err := os.MkdirAll(path.Join(dirName, path.Dir(name)), 0777); err != nil {
+			return _BackupFile{}, err
+		}
+		f, err := os.OpenFile(path.Join(dirName, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(0666))
+		if err != nil {
+			return _BackupFile{}, err
+		}
+		defer f.Close()
+		w = io.MultiWriter(f, crc)
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return _BackupFile{}, err
+	}
+	return _BackupFile{Name: name, Size: n, Checksum: crc.Sum32()}, nil
+}
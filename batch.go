@@ -17,6 +17,7 @@
 package unitdb
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 
@@ -43,6 +44,7 @@ type (
 
 	Batch struct {
 		db         *DB
+		ctx        context.Context
 		mem        *memdb.Batch
 		opts       *_Options
 		managed    bool
@@ -54,6 +56,15 @@ type (
 
 		// commitComplete is used to signal if batch commit is complete and batch is fully written to DB.
 		commitComplete chan struct{}
+
+		// watched is entries sent to watchers on commit.
+		watched []Entry
+
+		// dedups is hashes of dedup keys of the entries, the hashes are removed from the dedup index if the batch is aborted.
+		dedups []uint64
+
+		// lastValues is the latest messages of the entries, these are added to the last-value cache on commit.
+		lastValues []_LastValue
 	}
 )
 
@@ -78,11 +89,22 @@ func (b *Batch) PutEntry(e *Entry) error {
 		return errValueEmpty
 	case len(e.Payload) > maxValueLength:
 		return errValueTooLarge
+	case e.Replace:
+		// a message is replaced by DB.PutEntry and not in a batch.
+		return errBadRequest
 	}
 	e.Encryption = e.Encryption || b.opts.batchOptions.encryption
 	if err := b.db.setEntry(e); err != nil {
+		if err == errEntryDuplicate {
+			// a duplicate entry is acknowledged but not stored again.
+			e.reset()
+			return nil
+		}
 		return err
 	}
+	if e.entry.dedup != 0 {
+		b.dedups = append(b.dedups, e.entry.dedup)
+	}
 
 	var scratch [4]byte
 	binary.LittleEndian.PutUint32(scratch[0:4], uint32(len(e.entry.cache)+4))
@@ -96,6 +118,10 @@ func (b *Batch) PutEntry(e *Entry) error {
 	b.index = append(b.index, _BatchIndex{delFlag: false, offset: b.size})
 	b.size += int64(len(e.entry.cache) + 4)
 
+	if b.db.internal.watchers.len() != 0 {
+		b.watched = append(b.watched, b.db.watchEntry(e))
+	}
+
 	// reset message entry
 	e.reset()
 
@@ -201,6 +227,9 @@ func (b *Batch) Write() error {
 	if b.len() == 0 {
 		return nil
 	}
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
 	topics := make(map[uint64]*message.Topic)
 	timeID := b.mem.TimeID()
 	var seqs []uint64
@@ -213,19 +242,25 @@ func (b *Batch) Write() error {
 				t.Unmarshal(rawTopic)
 				topics[e.topicHash] = t
 			}
-			b.db.internal.trie.add(newTopic(e.topicHash, 0), t.Parts, t.Depth)
+			b.db.internal.trie.add(newTopic(e.topicHash, t.Topic, 0), t.Parts, t.Depth)
 		}
 		if err := b.mem.Put(e.seq, data); err != nil {
 			return err
 		}
-		if ok := b.db.internal.timeWindow.add(timeID, e.topicHash, newWinEntry(e.seq, e.expiresAt)); !ok {
+		timestamp := message.ID(data[entrySize:]).Time()
+		if ok := b.db.internal.timeWindow.add(timeID, e.topicHash, newWinEntry(e.seq, e.expiresAt, timestamp)); !ok {
 			return errForbidden
 		}
+		if b.db.internal.lastValues != nil {
+			b.lastValues = append(b.lastValues, _LastValue{topicHash: e.topicHash, seq: e.seq, timestamp: timestamp, expiresAt: e.expiresAt})
+		}
 		seqs = append(seqs, e.seq)
 		return nil
 	})
 
-	b.mem.Write()
+	if err := b.mem.WriteContext(b.ctx); err != nil {
+		return err
+	}
 	b.reset()
 
 	return nil
@@ -249,9 +284,13 @@ func (b *Batch) Commit() error {
 	}
 
 	// Commit batch to database.
-	if err := b.mem.Commit(); err != nil {
+	if err := b.mem.CommitContext(b.ctx); err != nil {
 		return err
 	}
+	b.dedups = nil
+	b.db.internal.lastValues.add(b.lastValues...)
+	b.lastValues = nil
+	b.db.notify(b.watched)
 
 	return nil
 }
@@ -267,6 +306,10 @@ func (b *Batch) Abort() {
 	_assert(!b.managed, "managed batch abort not allowed")
 
 	b.reset()
+	b.watched = nil
+	b.db.internal.dedup.remove(b.dedups...)
+	b.dedups = nil
+	b.lastValues = nil
 	b.mem.Abort()
 	b.db.internal.bufPool.Put(b.buffer)
 	b.db = nil
@@ -59,6 +59,22 @@ func (e _IndexEntry) mSize() uint32 {
 	return idSize + uint32(e.topicSize) + e.valueSize
 }
 
+// isDeleted returns true if entry is deleted. The first entry of a topic keeps message offset
+// on delete so the topic can be loaded into the trie, its value size is set to zero instead.
+func (e _IndexEntry) isDeleted() bool {
+	return e.msgOffset == -1 || e.valueSize == 0
+}
+
+// find returns the index entry of the seq in the block.
+func (b _IndexBlock) find(seq uint64) (_IndexEntry, bool) {
+	for i := 0; i < entriesPerIndexBlock; i++ {
+		if b.entries[i].seq == seq {
+			return b.entries[i], true
+		}
+	}
+	return _IndexEntry{}, false
+}
+
 func (b _IndexBlock) validation(blockIdx int32) error {
 	bIdx := blockIndex(b.entries[0].seq)
 	if bIdx != blockIdx {
@@ -88,6 +104,7 @@ func (b _IndexBlock) marshalBinary() []byte {
 		buf = buf[16:]
 	}
 	binary.LittleEndian.PutUint16(buf[:2], b.entryIdx)
+	putBlockChecksum(data)
 	return data
 }
 
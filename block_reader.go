@@ -46,6 +46,9 @@ func (r *_BlockReader) readIndexBlock() (_IndexBlock, error) {
 	if err != nil {
 		return _IndexBlock{}, err
 	}
+	if !validBlockChecksum(buf) {
+		return _IndexBlock{}, &ErrCorrupted{File: indexDir, Offset: r.offset}
+	}
 	if err := r.indexBlock.unmarshalBinary(buf); err != nil {
 		return _IndexBlock{}, err
 	}
@@ -54,37 +57,50 @@ func (r *_BlockReader) readIndexBlock() (_IndexBlock, error) {
 }
 
 func (r *_BlockReader) readEntry(seq uint64) (_IndexEntry, error) {
+	e, err := r.findEntry(seq)
+	if err != nil {
+		return _IndexEntry{}, err
+	}
+	if e.isDeleted() {
+		return _IndexEntry{}, errMsgIDDeleted
+	}
+
+	return e, nil
+}
+
+// findEntry reads index entry for the seq, it returns the entry even if it is deleted.
+func (r *_BlockReader) findEntry(seq uint64) (_IndexEntry, error) {
 	bIdx := blockIndex(seq)
 	r.offset = blockOffset(bIdx)
 	b, err := r.readIndexBlock()
 	if err != nil {
 		return _IndexEntry{}, err
 	}
-	entryIdx := -1
 	for i := 0; i < entriesPerIndexBlock; i++ {
 		e := b.entries[i]
 		if e.seq == seq { //topic exist in db
-			if e.msgOffset == -1 {
-				return _IndexEntry{}, errMsgIDDeleted
-			}
-			entryIdx = i
-			break
+			return e, nil
 		}
 	}
-	if entryIdx == -1 {
-		return _IndexEntry{}, errEntryInvalid
-	}
 
-	return b.entries[entryIdx], nil
+	return _IndexEntry{}, errEntryInvalid
 }
 
 func (r *_BlockReader) readMessage(e _IndexEntry) ([]byte, []byte, error) {
-	if e.cache != nil {
-		return e.cache[:idSize], e.cache[e.topicSize+idSize:], nil
+	message := e.cache
+	if message == nil {
+		var err error
+		if message, err = r.dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize())); err != nil {
+			return nil, nil, err
+		}
 	}
-	message, err := r.dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
-	if err != nil {
-		return nil, nil, err
+	message = message[:e.mSize()]
+	// value of the deleted entry keeping the topic is freed along with its checksum.
+	if e.valueSize != 0 && message[idSize-1]&flagChecksum != 0 {
+		if !validChecksum(message) {
+			return nil, nil, &ErrCorrupted{File: dataDir, Offset: e.msgOffset}
+		}
+		message = message[:len(message)-checksumSize]
 	}
 	return message[:idSize], message[e.topicSize+idSize:], nil
 }
@@ -76,7 +76,14 @@ func (w *_BlockWriter) extend(upperSeq uint64) (int64, error) {
 	if off <= w.indexFile.currSize() {
 		return w.indexFile.currSize(), nil
 	}
-	return w.indexFile.extend(uint32(off - w.indexFile.currSize()))
+	// empty index blocks are written so blocks not yet written have the checksum.
+	start := w.indexFile.currSize()
+	for size := start; size < off; size += int64(blockSize) {
+		if _, err := w.indexFile.write(_IndexBlock{}.marshalBinary()); err != nil {
+			return 0, err
+		}
+	}
+	return start, nil
 }
 
 func (w *_BlockWriter) del(seq uint64) (_IndexEntry, error) {
@@ -85,10 +92,15 @@ func (w *_BlockWriter) del(seq uint64) (_IndexEntry, error) {
 	if bIdx > w.blockIdx {
 		return delEntry, nil // no entry in db to delete
 	}
-	r := _BlockReader{indexFile: w.indexFile, offset: blockOffset(bIdx)}
-	b, err := r.readIndexBlock()
-	if err != nil {
-		return _IndexEntry{}, err
+	// the index block is read once so entries deleted earlier from the block are kept.
+	b, ok := w.indexBlocks[bIdx]
+	if !ok {
+		var err error
+		r := _BlockReader{indexFile: w.indexFile, offset: blockOffset(bIdx)}
+		b, err = r.readIndexBlock()
+		if err != nil {
+			return _IndexEntry{}, err
+		}
 	}
 	entryIdx := -1
 	for i := 0; i < int(b.entryIdx); i++ {
@@ -102,8 +114,14 @@ func (w *_BlockWriter) del(seq uint64) (_IndexEntry, error) {
 		return delEntry, nil // no entry in db to delete
 	}
 	delEntry = b.entries[entryIdx]
-	delEntry.msgOffset = -1
-	b.entries[entryIdx] = delEntry
+	if delEntry.isDeleted() {
+		return _IndexEntry{}, nil // entry is already deleted
+	}
+	if delEntry.topicSize != 0 {
+		b.entries[entryIdx].valueSize = 0
+	} else {
+		b.entries[entryIdx].msgOffset = -1
+	}
 	b.dirty = true
 	w.indexBlocks[bIdx] = b
 
@@ -139,12 +157,74 @@ func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 		return errEntryExist
 	}
 
+	if err := w.writeData(&e); err != nil {
+		return err
+	}
+
+	if b.leased {
+		w.indexLeases[e.seq] = struct{}{}
+	}
+
+	b.entries[b.entryIdx] = e
+	b.dirty = true
+	b.entryIdx++
+	if err := b.validation(bIdx); err != nil {
+		return err
+	}
+	w.indexBlocks[bIdx] = b
+
+	return nil
+}
+
+// replace replaces the index entry of the seq with the entry e and writes the message of the entry e.
+// It returns the replaced index entry so its data blocks can be freed once the index block is written.
+func (w *_BlockWriter) replace(e _IndexEntry) (_IndexEntry, error) {
+	var err error
+	bIdx := blockIndex(e.seq)
+	b, ok := w.indexBlocks[bIdx]
+	if !ok {
+		if bIdx > w.blockIdx {
+			return _IndexEntry{}, errMsgIDDoesNotExist
+		}
+		r := _BlockReader{indexFile: w.indexFile, offset: blockOffset(bIdx)}
+		b, err = r.readIndexBlock()
+		if err != nil {
+			return _IndexEntry{}, err
+		}
+	}
+	entryIdx := -1
+	for i := 0; i < int(b.entryIdx); i++ {
+		if b.entries[i].seq == e.seq {
+			entryIdx = i
+			break
+		}
+	}
+	if entryIdx == -1 || b.entries[entryIdx].isDeleted() {
+		return _IndexEntry{}, errMsgIDDoesNotExist
+	}
+	if err := w.writeData(&e); err != nil {
+		return _IndexEntry{}, err
+	}
+	prev := b.entries[entryIdx]
+	b.entries[entryIdx] = e
+	b.dirty = true
+	w.indexBlocks[bIdx] = b
+
+	return prev, nil
+}
+
+// writeData writes the message of the entry to a free data block or to the buffer and sets the message offset of the entry.
+func (w *_BlockWriter) writeData(e *_IndexEntry) (err error) {
 	if len(e.cache) == 0 {
 		return errEntryInvalid
 	}
 
 	dataLen := len(e.cache)
-	off := w.lease.allocate(uint32(dataLen))
+	off := int64(-1)
+	// free blocks are not reused in a segmented data file so a segment can be removed once all its messages are freed.
+	if w.dataFile.segments == nil {
+		off = w.lease.allocate(uint32(dataLen))
+	}
 	if off != -1 {
 		buf := make([]byte, dataLen)
 		copy(buf, e.cache)
@@ -153,6 +233,11 @@ func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 		}
 		w.dataLeases[off] = uint32(dataLen)
 	} else {
+		if next := w.dataFile.nextOffset(w.offset, int64(dataLen)); next != w.offset {
+			if err := w.roll(next); err != nil {
+				return err
+			}
+		}
 		off = w.offset
 		offset, err := w.buffer.Extend(int64(dataLen))
 		if err != nil {
@@ -165,18 +250,6 @@ func (w *_BlockWriter) append(e _IndexEntry) (err error) {
 	}
 	e.msgOffset = off
 
-	if b.leased {
-		w.indexLeases[e.seq] = struct{}{}
-	}
-
-	b.entries[b.entryIdx] = e
-	b.dirty = true
-	b.entryIdx++
-	if err := b.validation(bIdx); err != nil {
-		return err
-	}
-	w.indexBlocks[bIdx] = b
-
 	return nil
 }
 
@@ -288,6 +361,19 @@ func blockRange(idx []int32) ([][]int32, error) {
 	return parts, nil
 }
 
+// roll writes buffered messages to the data file and moves the data offset to the start of the next segment.
+func (w *_BlockWriter) roll(off int64) error {
+	if _, err := w.dataFile.write(w.buffer.Bytes()); err != nil {
+		return err
+	}
+	w.buffer.Reset()
+	if err := w.dataFile.truncate(off); err != nil {
+		return err
+	}
+	w.offset = off
+	return nil
+}
+
 func (w *_BlockWriter) rollback() error {
 	// rollback data leases
 	for off, size := range w.dataLeases {
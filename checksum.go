@@ -0,0 +1,217 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// checksumSize is size of CRC32C checksum stored in the last bytes of index and window blocks and messages.
+	// Checksum of a block is zero and the checksum flag is not set if the block was written without a checksum.
+	checksumSize = 4
+
+	// blockFlagChecksum is set in the flags byte before the checksum of a block written with a checksum.
+	blockFlagChecksum = 1 << 0
+)
+
+type (
+	// ErrCorrupted is returned if checksum of a block or a message does not match.
+	ErrCorrupted struct {
+		File   string // The file type, window, index or data.
+		Offset int64  // The offset of the block or the message in the file.
+	}
+
+	// VerifyProgress reports progress of DB.Verify.
+	VerifyProgress struct {
+		File   string // The file type, window, index or data.
+		Offset int64  // The offset of the block or the message verified.
+		Size   int64  // The size of the file.
+		Err    error  // The *ErrCorrupted if the block or the message is corrupted.
+	}
+)
+
+func (e *ErrCorrupted) Error() string {
+	return fmt.Sprintf("%s file is corrupted at offset %d", e.File, e.Offset)
+}
+
+// Unwrap returns the errCorrupted.
+func (e *ErrCorrupted) Unwrap() error {
+	return errCorrupted
+}
+
+// putChecksum sets checksum of the block or the message into its last bytes.
+func putChecksum(buf []byte) {
+	n := len(buf) - checksumSize
+	binary.LittleEndian.PutUint32(buf[n:], crc32.Checksum(buf[:n], crcTable))
+}
+
+// putBlockChecksum sets the checksum flag and checksum of the block.
+func putBlockChecksum(buf []byte) {
+	buf[len(buf)-checksumSize-1] |= blockFlagChecksum
+	putChecksum(buf)
+}
+
+// validBlockChecksum validates checksum of the block. The checksum must match if the block has the checksum flag set,
+// a block without the flag is valid only if it was written without a checksum, an all-zero block is not valid.
+func validBlockChecksum(buf []byte) bool {
+	n := len(buf) - checksumSize
+	sum := binary.LittleEndian.Uint32(buf[n:])
+	if buf[n-1]&blockFlagChecksum != 0 {
+		return sum == crc32.Checksum(buf[:n], crcTable)
+	}
+	if sum != 0 {
+		return false
+	}
+	for _, b := range buf[:n] {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validChecksum validates checksum of the message stored in its last bytes.
+func validChecksum(msg []byte) bool {
+	n := len(msg) - checksumSize
+	return n >= 0 && binary.LittleEndian.Uint32(msg[n:]) == crc32.Checksum(msg[:n], crcTable)
+}
+
+// Verify scrubs window, index and data files and validates checksums of the blocks and the messages.
+// The progress function is called for each block and message verified, corrupted blocks are reported with an *ErrCorrupted and the scrub continues.
+// Reads and writes continue during the scrub, sync is locked while a block is verified.
+// It returns the first *ErrCorrupted if any block or message is corrupted.
+func (db *DB) Verify(ctx context.Context, progress func(p VerifyProgress)) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	var corrupted error
+	report := func(p VerifyProgress) {
+		if p.Err != nil && corrupted == nil {
+			corrupted = p.Err
+		}
+		if progress != nil {
+			progress(p)
+		}
+	}
+	if err := db.verifyWindow(ctx, report); err != nil {
+		return err
+	}
+	if err := db.verifyIndex(ctx, report); err != nil {
+		return err
+	}
+	return corrupted
+}
+
+// verifyBlocks calls the function f for each block of the file under sync lock until f returns false.
+func (db *DB) verifyBlocks(ctx context.Context, f func(off int64) (bool, error)) error {
+	for off := int64(0); ; off += int64(blockSize) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := db.ok(); err != nil {
+			return err
+		}
+		db.internal.syncLockC <- struct{}{}
+		ok, err := f(off)
+		<-db.internal.syncLockC
+		if err != nil || !ok {
+			return err
+		}
+	}
+}
+
+// verifyWindow validates checksums of window blocks.
+func (db *DB) verifyWindow(ctx context.Context, report func(p VerifyProgress)) error {
+	return db.verifyBlocks(ctx, func(off int64) (bool, error) {
+		winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+		if err != nil {
+			return false, err
+		}
+		size := winFile.currSize()
+		if off+int64(blockSize) > size {
+			return false, nil
+		}
+		buf, err := winFile.slice(off, off+int64(blockSize))
+		if err != nil {
+			return false, err
+		}
+		p := VerifyProgress{File: winDir, Offset: off, Size: size}
+		if !validBlockChecksum(buf) {
+			p.Err = &ErrCorrupted{File: winDir, Offset: off}
+		}
+		report(p)
+		return true, nil
+	})
+}
+
+// verifyIndex validates checksums of index blocks and messages of the index entries.
+func (db *DB) verifyIndex(ctx context.Context, report func(p VerifyProgress)) error {
+	return db.verifyBlocks(ctx, func(off int64) (bool, error) {
+		indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+		if err != nil {
+			return false, err
+		}
+		dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+		if err != nil {
+			return false, err
+		}
+		size := indexFile.currSize()
+		if off+int64(blockSize) > size {
+			return false, nil
+		}
+		buf, err := indexFile.slice(off, off+int64(blockSize))
+		if err != nil {
+			return false, err
+		}
+		p := VerifyProgress{File: indexDir, Offset: off, Size: size}
+		if !validBlockChecksum(buf) {
+			p.Err = &ErrCorrupted{File: indexDir, Offset: off}
+			report(p)
+			return true, nil
+		}
+		report(p)
+		var b _IndexBlock
+		if err := b.unmarshalBinary(buf); err != nil {
+			return false, err
+		}
+		dataSize := dataFile.currSize()
+		for i := 0; i < entriesPerIndexBlock; i++ {
+			e := b.entries[i]
+			if e.seq == 0 || e.isDeleted() {
+				continue
+			}
+			p := VerifyProgress{File: dataDir, Offset: e.msgOffset, Size: dataSize}
+			msg, err := dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+			if err == errMsgIDDeleted {
+				continue // message of a removed data segment.
+			}
+			if err != nil && err != io.EOF {
+				return false, err
+			}
+			if err == io.EOF || (msg[idSize-1]&flagChecksum != 0 && !validChecksum(msg)) {
+				p.Err = &ErrCorrupted{File: dataDir, Offset: e.msgOffset}
+			}
+			report(p)
+		}
+		return true, nil
+	})
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command unitdb-export writes entries of a unitdb database as JSON Lines or CSV.
+// The database is opened read-only so it can be exported while it is open for writes,
+// entries not yet synced by the writer are not exported.
+//
+// Usage:
+//
+//	unitdb-export [-format jsonl|csv] [-topic pattern] [-contract id] [-from time] [-to time] [-raw] [-o file] path
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/unit-io/unitdb"
+)
+
+func main() {
+	var format = flag.String("format", "jsonl", "Format of exported entries, jsonl or csv.")
+	var topic = flag.String("topic", "...", "Topic pattern of the topics to export.")
+	var contract = flag.Uint("contract", 0, "Contract of the topics to export, master contract is used if it is not set.")
+	var from = flag.String("from", "", "Export entries stored at or after the time (RFC3339).")
+	var to = flag.String("to", "", "Export entries stored before the time (RFC3339).")
+	var raw = flag.Bool("raw", false, "Export payloads as text instead of base64.")
+	var out = flag.String("o", "", "Write entries to the file, entries are written to stdout if not set.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] path\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	spec := unitdb.ExportSpec{
+		Format:   unitdb.TransferFormat(*format),
+		Topic:    []byte(*topic),
+		Contract: uint32(*contract),
+		Raw:      *raw,
+	}
+	var err error
+	if spec.From, err = parseTime(*from); err != nil {
+		log.Fatal(err)
+	}
+	if spec.To, err = parseTime(*to); err != nil {
+		log.Fatal(err)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatal(err)
+		}
+		defer w.Close()
+	}
+	db, err := unitdb.Open(flag.Arg(0), unitdb.WithReadOnly())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	n, err := db.Export(w, spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("exported %d entries", n)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
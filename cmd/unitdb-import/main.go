@@ -0,0 +1,76 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command unitdb-import writes entries exported by unitdb-export to a unitdb database.
+// Message IDs of the entries are kept so an exported database is imported unchanged.
+//
+// Usage:
+//
+//	unitdb-import [-format jsonl|csv] [-raw] [-batch_size n] [-new_ids] [-i file] path
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/unit-io/unitdb"
+)
+
+func main() {
+	var format = flag.String("format", "jsonl", "Format of imported entries, jsonl or csv.")
+	var raw = flag.Bool("raw", false, "Import payloads as text instead of base64.")
+	var batchSize = flag.Int("batch_size", 1000, "Number of entries written in a batch.")
+	var newIDs = flag.Bool("new_ids", false, "Allocate new message IDs, use it to import entries to a database that already stores entries.")
+	var in = flag.String("i", "", "Read entries from the file, entries are read from stdin if not set.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] path\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	r := os.Stdin
+	if *in != "" {
+		var err error
+		if r, err = os.Open(*in); err != nil {
+			log.Fatal(err)
+		}
+		defer r.Close()
+	}
+	db, err := unitdb.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	spec := unitdb.ImportSpec{
+		Format:    unitdb.TransferFormat(*format),
+		Raw:       *raw,
+		BatchSize: *batchSize,
+		NewIDs:    *newIDs,
+	}
+	n, err := db.Import(r, spec)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	log.Printf("imported %d entries", n)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
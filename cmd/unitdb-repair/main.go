@@ -0,0 +1,68 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command unitdb-repair repairs a closed unitdb database and writes the repair report.
+//
+// Usage:
+//
+//	unitdb-repair [-report file] [-segment_size bytes] path
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/unit-io/unitdb"
+)
+
+func main() {
+	var reportPath = flag.String("report", "", "Write the repair report to the file, the report is written to stdout if not set.")
+	var segmentSize = flag.Int64("segment_size", 0, "Segment size of a segmented DB, it is used if the info file of the DB is corrupted.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] path\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var opts []unitdb.Options
+	if *segmentSize > 0 {
+		opts = append(opts, unitdb.WithSegmentSize(*segmentSize))
+	}
+	report, err := unitdb.Repair(flag.Arg(0), opts...)
+	if report == nil {
+		log.Fatal(err)
+	}
+	data, jsonErr := json.MarshalIndent(report, "", "  ")
+	if jsonErr != nil {
+		log.Fatal(jsonErr)
+	}
+	if *reportPath == "" {
+		fmt.Println(string(data))
+	} else if err := ioutil.WriteFile(*reportPath, data, 0666); err != nil {
+		log.Fatal(err)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
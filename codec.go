@@ -0,0 +1,226 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec IDs of the built-in codecs. The codec ID is stored with each entry so entries are
+// decoded with the codec used to encode them. Custom codecs use IDs from CodecCustom to maxCodecID,
+// the codec ID is stored in five bits of the entry flags.
+const (
+	CodecSnappyID uint8 = iota
+	CodecNoneID
+	CodecZstdID
+	CodecCustom
+
+	maxCodecID = codecMask
+)
+
+var (
+	// CodecSnappy compresses payloads with snappy, it is used if no codec is set.
+	CodecSnappy Codec = _SnappyCodec{}
+	// CodecNone stores payloads uncompressed.
+	CodecNone Codec = _NoneCodec{}
+	// CodecZstd compresses payloads with zstd.
+	CodecZstd Codec = NewZstdCodec(CodecZstdID, nil)
+)
+
+type (
+	// Codec compresses payloads of entries.
+	Codec interface {
+		// ID returns the codec ID stored with the entries.
+		ID() uint8
+		// Encode appends the encoded src to dst and returns the result.
+		Encode(dst, src []byte) []byte
+		// Decode appends the decoded src to dst and returns the result.
+		Decode(dst, src []byte) ([]byte, error)
+	}
+
+	_SnappyCodec struct{}
+	_NoneCodec   struct{}
+
+	_ZstdCodec struct {
+		id   uint8
+		dict []byte
+
+		once sync.Once
+		enc  *zstd.Encoder
+		dec  *zstd.Decoder
+		err  error
+	}
+
+	_TopicCodec struct {
+		prefix string
+		codec  Codec
+	}
+
+	// _Codecs holds codecs of the DB to encode and decode payloads.
+	_Codecs struct {
+		codec  Codec
+		topics []_TopicCodec   // codecs per topic prefix, longest prefix first.
+		codecs map[uint8]Codec // codecs by ID to decode payloads.
+	}
+)
+
+func (_SnappyCodec) ID() uint8 { return CodecSnappyID }
+
+func (_SnappyCodec) Encode(dst, src []byte) []byte {
+	return append(dst, snappy.Encode(nil, src)...)
+}
+
+func (_SnappyCodec) Decode(dst, src []byte) ([]byte, error) {
+	val, err := snappy.Decode(nil, src)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, val...), nil
+}
+
+func (_NoneCodec) ID() uint8 { return CodecNoneID }
+
+func (_NoneCodec) Encode(dst, src []byte) []byte {
+	return append(dst, src...)
+}
+
+func (_NoneCodec) Decode(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+// NewZstdCodec creates a zstd codec with the ID. The dictionary is optional, use a
+// dictionary trained on payloads of a topic to compress small payloads.
+// The encoder and decoder are created when the codec is registered on open of the DB.
+func NewZstdCodec(id uint8, dict []byte) Codec {
+	return &_ZstdCodec{id: id, dict: dict}
+}
+
+// init creates the encoder and decoder once, the error is returned on open of the DB.
+func (c *_ZstdCodec) init() error {
+	c.once.Do(func() {
+		encOpts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		decOpts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if c.dict != nil {
+			encOpts = append(encOpts, zstd.WithEncoderDict(c.dict))
+			decOpts = append(decOpts, zstd.WithDecoderDicts(c.dict))
+		}
+		if c.enc, c.err = zstd.NewWriter(nil, encOpts...); c.err != nil {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil, decOpts...)
+	})
+	return c.err
+}
+
+func (c *_ZstdCodec) ID() uint8 { return c.id }
+
+// Encode encodes with the encoder created when the codec was registered.
+func (c *_ZstdCodec) Encode(dst, src []byte) []byte {
+	return c.enc.EncodeAll(src, dst)
+}
+
+func (c *_ZstdCodec) Decode(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.dec.DecodeAll(src, dst)
+}
+
+func newCodecs(opts *_Options) (*_Codecs, error) {
+	c := &_Codecs{codec: CodecSnappy, codecs: make(map[uint8]Codec)}
+	for _, codec := range []Codec{CodecSnappy, CodecNone, CodecZstd} {
+		c.codecs[codec.ID()] = codec
+	}
+	if opts.codec != nil {
+		c.codec = opts.codec
+	}
+	register := func(codec Codec) error {
+		if codec.ID() > maxCodecID {
+			return errCodecIDRange
+		}
+		if registered, ok := c.codecs[codec.ID()]; ok && !sameCodec(registered, codec) {
+			return errCodecInvalid
+		}
+		c.codecs[codec.ID()] = codec
+		return nil
+	}
+	if err := register(c.codec); err != nil {
+		return nil, err
+	}
+	for _, codec := range opts.codecs {
+		if err := register(codec); err != nil {
+			return nil, err
+		}
+	}
+	for _, tc := range opts.topicCodecs {
+		if err := register(tc.codec); err != nil {
+			return nil, err
+		}
+		c.topics = append(c.topics, tc)
+	}
+	sort.SliceStable(c.topics, func(i, j int) bool {
+		return len(c.topics[i].prefix) > len(c.topics[j].prefix)
+	})
+	for _, codec := range c.codecs {
+		if zc, ok := codec.(*_ZstdCodec); ok {
+			if err := zc.init(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// sameCodec returns true if the codecs are the same. Codecs of a type that is not comparable are the same if the types are equal.
+func sameCodec(a, b Codec) bool {
+	t := reflect.TypeOf(a)
+	if t != reflect.TypeOf(b) {
+		return false
+	}
+	return !t.Comparable() || a == b
+}
+
+// get returns the codec to encode payload of the entry.
+func (c *_Codecs) get(e *Entry) (Codec, error) {
+	if e.Codec != nil {
+		if codec, ok := c.codecs[e.Codec.ID()]; !ok || !sameCodec(codec, e.Codec) {
+			return nil, errCodecUnknown
+		}
+		return e.Codec, nil
+	}
+	for _, tc := range c.topics {
+		if strings.HasPrefix(unsafeToString(e.Topic), tc.prefix) {
+			return tc.codec, nil
+		}
+	}
+	return c.codec, nil
+}
+
+// decode decodes the payload with the codec of the ID.
+func (c *_Codecs) decode(id uint8, val []byte) ([]byte, error) {
+	codec, ok := c.codecs[id]
+	if !ok {
+		return nil, errCodecUnknown
+	}
+	return codec.Decode(nil, val)
+}
@@ -0,0 +1,746 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// compactSuffix is the suffix of new files written by the compaction.
+	compactSuffix = ".compact"
+	// compactManifest is the file listing new files of a compaction, the compaction is committed once it is written.
+	compactManifest = "unitdb.compact"
+)
+
+type (
+	// _Compaction rewrites live entries of the db into new index, data and window files.
+	_Compaction struct {
+		db *DB
+
+		indexFile, dataFile, winFile *_File
+		newIndex, newData, newWin    *_File
+		newLease                     *_File
+
+		// expired is set of seqs of expired window entries.
+		expired map[uint64]struct{}
+		// offsets is map of topic hash to the offset of the most recent window block of the topic in new window file.
+		offsets map[uint64]int64
+		// reencrypt is set to encrypt entries with the current key of the keyring.
+		reencrypt bool
+		// changes is entries changed while the files are copied, these are copied again before the files are swapped.
+		changes *_CompactChanges
+		// committed is set once the manifest of new files is written, new files are then kept to be swapped on open.
+		committed bool
+	}
+
+	// _CompactChanges tracks entries synced, deleted, replaced or expired while the files are compacted without the sync lock.
+	_CompactChanges struct {
+		sync.Mutex
+		synced  map[uint64]uint64   // map[seq]topicHash of synced entries.
+		changed map[uint64]struct{} // seqs of deleted or replaced entries.
+		expired map[uint64]struct{} // seqs of expired entries freed by the expirer.
+	}
+)
+
+func newCompactChanges() *_CompactChanges {
+	return &_CompactChanges{synced: make(map[uint64]uint64), changed: make(map[uint64]struct{}), expired: make(map[uint64]struct{})}
+}
+
+// sync adds the synced entry. It does nothing if compaction is not running.
+func (cc *_CompactChanges) sync(seq, topicHash uint64) {
+	if cc == nil {
+		return
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	cc.synced[seq] = topicHash
+}
+
+// change adds the deleted or replaced entry. It does nothing if compaction is not running.
+func (cc *_CompactChanges) change(seq uint64) {
+	if cc == nil {
+		return
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	cc.changed[seq] = struct{}{}
+}
+
+// expire adds the expired entry. It does nothing if compaction is not running.
+func (cc *_CompactChanges) expire(seq uint64) {
+	if cc == nil {
+		return
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	cc.expired[seq] = struct{}{}
+}
+
+func (cc *_CompactChanges) isSynced(seq uint64) bool {
+	cc.Lock()
+	defer cc.Unlock()
+	_, ok := cc.synced[seq]
+	return ok
+}
+
+// Compact rewrites live messages, index and window blocks into new files and reclaims disk space of deleted and expired messages.
+// Reads and writes continue while new files are written, the sync lock is held only to copy entries changed
+// since the compaction started and to swap the files under a short exclusive lock.
+// Compaction can be run in background, it is aborted if the context is cancelled leaving the db unchanged.
+func (db *DB) Compact(ctx context.Context) error {
+	return db.compact(ctx, false)
+}
+
+// compact rewrites the files, entries encrypted with old keys are encrypted with the current key if reencrypt is set.
+func (db *DB) compact(ctx context.Context, reencrypt bool) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.opts.flags.readOnly {
+		return errImmutable
+	}
+	db.internal.compactMu.Lock()
+	defer db.internal.compactMu.Unlock()
+
+	c, err := newCompaction(db)
+	if err != nil {
+		return err
+	}
+	c.reencrypt = reencrypt
+	defer c.close()
+	if err := c.copy(ctx); err != nil {
+		return err
+	}
+
+	return c.finish(ctx)
+}
+
+// copy copies live entries into the new files, it runs without the sync lock.
+func (c *_Compaction) copy(ctx context.Context) error {
+	if err := c.readExpired(ctx); err != nil {
+		return err
+	}
+	if err := c.compactData(ctx); err != nil {
+		return err
+	}
+	return c.compactWindow(ctx)
+}
+
+// finish copies entries changed since the compaction started and swaps the files holding the sync lock.
+func (c *_Compaction) finish(ctx context.Context) error {
+	select {
+	case c.db.internal.syncLockC <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-c.db.internal.syncLockC
+	}()
+	if err := c.catchUp(); err != nil {
+		return err
+	}
+	return c.swap()
+}
+
+func newCompaction(db *DB) (*_Compaction, error) {
+	c := &_Compaction{db: db, expired: make(map[uint64]struct{}), offsets: make(map[uint64]int64)}
+	var err error
+	if c.indexFile, err = db.fs.getFile(_FileDesc{fileType: typeIndex}); err != nil {
+		return nil, err
+	}
+	if c.dataFile, err = db.fs.getFile(_FileDesc{fileType: typeData}); err != nil {
+		return nil, err
+	}
+	if c.winFile, err = db.fs.getFile(_FileDesc{fileType: typeTimeWindow}); err != nil {
+		return nil, err
+	}
+	if c.newIndex, err = newCompactFile(c.indexFile); err != nil {
+		return nil, err
+	}
+	if c.newData, err = newCompactFile(c.dataFile); err != nil {
+		c.close()
+		return nil, err
+	}
+	if c.newWin, err = newCompactFile(c.winFile); err != nil {
+		c.close()
+		return nil, err
+	}
+	// track entries changed by sync, deletes and the expirer while the files are copied.
+	db.internal.syncLockC <- struct{}{}
+	c.changes = newCompactChanges()
+	db.internal.compactChanges = c.changes
+	<-db.internal.syncLockC
+	return c, nil
+}
+
+// newCompactFile creates a new file next to the file to write compacted blocks.
+func newCompactFile(f *_File) (*_File, error) {
+	if f.segments != nil {
+		s, err := newSegments(f.segments.dir, f.fd, compactSuffix, f.segments.size, 0, false)
+		if err != nil {
+			return nil, err
+		}
+		// remove segments left by an aborted compaction.
+		if err := s.truncate(0); err != nil {
+			return nil, err
+		}
+		return &_File{fd: f.fd, segments: s}, nil
+	}
+	fi, err := os.OpenFile(f.Name()+compactSuffix, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0666))
+	if err != nil {
+		return nil, err
+	}
+	return &_File{File: fi, fd: f.fd}, nil
+}
+
+// close stops tracking changed entries and removes new files if compaction is aborted.
+func (c *_Compaction) close() {
+	if c.changes != nil {
+		c.db.internal.syncLockC <- struct{}{}
+		c.db.internal.compactChanges = nil
+		<-c.db.internal.syncLockC
+	}
+	for _, f := range []*_File{c.newIndex, c.newData, c.newWin, c.newLease} {
+		if f == nil {
+			continue
+		}
+		if c.committed {
+			f.Close()
+			continue
+		}
+		if f.segments != nil {
+			f.segments.removeAll()
+			continue
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// readExpired reads seqs of expired entries from the window blocks.
+func (c *_Compaction) readExpired(ctx context.Context) error {
+	r := _WindowReader{winFile: c.winFile}
+	for size := c.winFile.Size(); r.offset < size; r.offset += int64(blockSize) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < int(b.entryIdx); i++ {
+			if we := b.entries[i]; we.seq() != 0 && we.isExpired() {
+				c.expired[we.seq()] = struct{}{}
+			}
+		}
+	}
+	return nil
+}
+
+// compactData copies messages of live entries into new data file and writes index blocks with new message offsets.
+// Expired entries are marked as deleted. Deleted and expired entries keeping the topic are copied without the value.
+func (c *_Compaction) compactData(ctx context.Context) error {
+	size := c.indexFile.Size()
+	r := _BlockReader{indexFile: c.indexFile}
+	for bIdx := int32(0); blockOffset(bIdx)+int64(blockSize) <= size; bIdx++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r.offset = blockOffset(bIdx)
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return err
+		}
+		var buf []byte
+		for i := 0; i < entriesPerIndexBlock; i++ {
+			if b.entries[i], buf, err = c.copyEntry(b.entries[i], buf); err != nil {
+				return err
+			}
+		}
+		if err := c.writeIndexBlock(b, bIdx, buf); err != nil {
+			return err
+		}
+	}
+	return c.newIndex.truncate(size)
+}
+
+// copyEntry appends the message of the entry to the buffer and returns the entry with the message offset in new data file.
+func (c *_Compaction) copyEntry(e _IndexEntry, buf []byte) (_IndexEntry, []byte, error) {
+	if e.seq == 0 || e.msgOffset == -1 {
+		return e, buf, nil
+	}
+	if _, ok := c.expired[e.seq]; ok {
+		if e.topicSize == 0 {
+			e.msgOffset = -1
+			return e, buf, nil
+		}
+		// the first entry of a topic keeps the topic as a deleted entry so the topic is loaded on open.
+		e.valueSize = 0
+	}
+	msg, err := c.dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+	if err == errMsgIDDeleted {
+		// message of a removed data segment.
+		e.msgOffset = -1
+		return e, buf, nil
+	}
+	if err != nil {
+		return e, buf, err
+	}
+	if c.reencrypt && e.valueSize != 0 {
+		if msg, err = c.db.internal.keyring.reencrypt(msg, e.topicSize); err != nil {
+			return e, buf, err
+		}
+		e.valueSize = uint32(len(msg)) - idSize - uint32(e.topicSize)
+	}
+	e.msgOffset = c.newData.size + int64(len(buf))
+	return e, append(buf, msg...), nil
+}
+
+// writeIndexBlock writes the messages copied for the index block to new data file and the index block to new index file.
+func (c *_Compaction) writeIndexBlock(b _IndexBlock, bIdx int32, buf []byte) error {
+	if _, err := c.newData.write(buf); err != nil {
+		return err
+	}
+	_, err := c.newIndex.WriteAt(b.marshalBinary(), blockOffset(bIdx))
+	return err
+}
+
+// catchUp copies index entries and window entries changed since the compaction started, it is called holding the sync lock.
+func (c *_Compaction) catchUp() error {
+	cc := c.changes
+	cc.Lock()
+	defer cc.Unlock()
+	for seq := range cc.expired {
+		c.expired[seq] = struct{}{}
+	}
+	blocks := make(map[int32]struct{})
+	for seq := range cc.synced {
+		blocks[blockIndex(seq)] = struct{}{}
+	}
+	for seq := range cc.changed {
+		blocks[blockIndex(seq)] = struct{}{}
+	}
+	for seq := range cc.expired {
+		blocks[blockIndex(seq)] = struct{}{}
+	}
+	r := _BlockReader{indexFile: c.indexFile}
+	nr := _BlockReader{indexFile: c.newIndex}
+	newSize := c.newIndex.size
+	// index blocks added since the compaction started are copied so new index file has no unwritten blocks.
+	for off := newSize; off+int64(blockSize) <= c.indexFile.currSize(); off += int64(blockSize) {
+		blocks[int32(off/int64(blockSize))] = struct{}{}
+	}
+	for bIdx := range blocks {
+		r.offset = blockOffset(bIdx)
+		b, err := r.readIndexBlock()
+		if err != nil {
+			return err
+		}
+		// entries not changed since the compaction started are kept from the new index block.
+		var nb _IndexBlock
+		if blockOffset(bIdx)+int64(blockSize) <= newSize {
+			nr.offset = blockOffset(bIdx)
+			if nb, err = nr.readIndexBlock(); err != nil {
+				return err
+			}
+		}
+		var buf []byte
+		for i := 0; i < entriesPerIndexBlock; i++ {
+			e := b.entries[i]
+			if e.seq == 0 {
+				continue
+			}
+			if ne, ok := nb.find(e.seq); ok && !cc.has(e.seq) {
+				b.entries[i] = ne
+				continue
+			}
+			if b.entries[i], buf, err = c.copyEntry(e, buf); err != nil {
+				return err
+			}
+		}
+		if err := c.writeIndexBlock(b, bIdx, buf); err != nil {
+			return err
+		}
+	}
+	if err := c.newIndex.truncate(c.indexFile.currSize()); err != nil {
+		return err
+	}
+
+	// window entries of synced entries are appended to the window blocks of the topic in new window file.
+	topics := make(map[uint64]struct{})
+	for _, h := range cc.synced {
+		topics[h] = struct{}{}
+	}
+	br := _BlockReader{indexFile: c.newIndex, dataFile: c.newData}
+	for h := range topics {
+		off, ok := c.db.internal.trie.getOffset(h)
+		if !ok {
+			continue
+		}
+		entries, err := c.readWindowEntries(_Topic{hash: h, offset: off}, true)
+		if err != nil {
+			return err
+		}
+		if c.offsets[h], err = c.appendWindowEntries(br, h, entries, c.offsets[h]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// has returns true if the entry is synced, deleted, replaced or expired since the compaction started.
+func (cc *_CompactChanges) has(seq uint64) bool {
+	if _, ok := cc.synced[seq]; ok {
+		return true
+	}
+	if _, ok := cc.changed[seq]; ok {
+		return true
+	}
+	_, ok := cc.expired[seq]
+	return ok
+}
+
+// compactWindow writes window entries of live entries of each topic into new window file.
+// Window entries synced since the compaction started are written on catch up.
+func (c *_Compaction) compactWindow(ctx context.Context) error {
+	// The first block is left empty so a window block never links to the offset zero.
+	if _, err := c.newWin.write(_WinBlock{}.marshalBinary()); err != nil {
+		return err
+	}
+	r := _BlockReader{indexFile: c.newIndex, dataFile: c.newData}
+	for _, topic := range c.db.internal.trie.allTopics() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entries, err := c.readWindowEntries(topic, false)
+		if err != nil {
+			return err
+		}
+		if c.offsets[topic.hash], err = c.appendWindowEntries(r, topic.hash, entries, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendWindowEntries writes window blocks of live entries linked to the window block at the offset in new window file.
+// Entries are in reverse time order, it returns the offset of the most recent window block of the topic.
+func (c *_Compaction) appendWindowEntries(r _BlockReader, topicHash uint64, entries _WindowEntries, off int64) (int64, error) {
+	b := _WinBlock{next: off}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e, err := r.findEntry(entries[i].seq())
+		if err != nil && err != errEntryInvalid {
+			return 0, err
+		}
+		if err == errEntryInvalid || (e.isDeleted() && (e.topicSize == 0 || e.msgOffset == -1)) {
+			continue
+		}
+		if b.entryIdx == entriesPerWindowBlock {
+			if off, err = c.writeWindowBlock(b); err != nil {
+				return 0, err
+			}
+			b = _WinBlock{next: off, cutoffTime: b.cutoffTime}
+		}
+		id, _, err := r.readMessage(e)
+		if err != nil {
+			return 0, err
+		}
+		b.topicHash = topicHash
+		b.entries[b.entryIdx] = entries[i]
+		b.entries[b.entryIdx].timestamp = message.ID(id).Time()
+		b.setTime(b.entries[b.entryIdx].timestamp)
+		b.entryIdx++
+	}
+	if b.entryIdx == 0 {
+		return off, nil
+	}
+	return c.writeWindowBlock(b)
+}
+
+func (c *_Compaction) writeWindowBlock(b _WinBlock) (int64, error) {
+	off := c.newWin.size
+	if _, err := c.newWin.write(b.marshalBinary()); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+// readWindowEntries reads persisted window entries of the topic in reverse time order.
+// Entries synced since the compaction started are skipped, or only these entries are read if synced is set,
+// the window blocks are then read until a block without synced entries.
+func (c *_Compaction) readWindowEntries(topic _Topic, synced bool) (_WindowEntries, error) {
+	var entries _WindowEntries
+	r := _WindowReader{winFile: c.winFile, offset: topic.offset}
+	for {
+		b, err := r.readWindowBlock()
+		if err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return nil, err
+		}
+		if b.topicHash != topic.hash {
+			return entries, nil
+		}
+		found := false
+		for i := int(b.entryIdx) - 1; i >= 0; i-- {
+			we := b.entries[i]
+			// expired entries are kept, the first entry of the topic keeps the topic in new files.
+			if we.seq() == 0 {
+				continue
+			}
+			var ok bool
+			if synced {
+				_, ok = c.changes.synced[we.seq()]
+			} else {
+				ok = c.changes.isSynced(we.seq())
+			}
+			found = found || ok
+			if ok == synced {
+				entries = append(entries, we)
+			}
+		}
+		if b.next == 0 || (synced && !found) {
+			return entries, nil
+		}
+		r.offset = b.next
+	}
+}
+
+// swap replaces files with the compacted files and updates topic offsets in the trie.
+// The swap is committed by renaming the manifest of the new files into place, so a crash leaves either the old
+// files or a manifest, files of a committed swap are swapped on open.
+func (c *_Compaction) swap() error {
+	m, err := c.commit()
+	if err != nil {
+		return err
+	}
+
+	c.db.internal.compactLock.Lock()
+	defer c.db.internal.compactLock.Unlock()
+	for _, f := range []**_File{&c.newIndex, &c.newData, &c.newWin, &c.newLease} {
+		if err := c.db.fs.replaceFile(*f); err != nil {
+			return err
+		}
+		*f = nil
+	}
+	for h, off := range c.offsets {
+		c.db.internal.trie.setOffset(_Topic{hash: h, offset: off})
+	}
+	c.db.internal.compactGen++
+	if err := c.db.internal.freeList.reset(); err != nil {
+		return err
+	}
+	return m.remove()
+}
+
+// commit persists new files and writes the manifest of the files to swap.
+func (c *_Compaction) commit() (*_Manifest, error) {
+	// free blocks of the old data file are no longer valid, empty lease is swapped along with the compacted files.
+	leaseFile, err := c.db.fs.getFile(_FileDesc{fileType: typeLease})
+	if err != nil {
+		return nil, err
+	}
+	if c.newLease, err = newCompactFile(leaseFile); err != nil {
+		return nil, err
+	}
+	if _, err := c.newLease.write((&_FreeBlocks{}).MarshalBinary()); err != nil {
+		return nil, err
+	}
+	files := []*_File{c.indexFile, c.dataFile, c.winFile, leaseFile}
+	newFiles := []*_File{c.newIndex, c.newData, c.newWin, c.newLease}
+	for _, f := range newFiles {
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	m := newManifest(c.db.internal.path)
+	for i, f := range files {
+		m.add(f, newFiles[i])
+	}
+	if err := m.commit(); err != nil {
+		return nil, err
+	}
+	c.committed = true
+	return m, nil
+}
+
+// _Manifest lists files to rename and to remove to swap compacted files. Paths are relative to the DB directory.
+type _Manifest struct {
+	dir     string
+	renames []string // files renamed from the path with the compact suffix.
+	removes []string // segment files not replaced by a new segment.
+}
+
+func newManifest(dirName string) *_Manifest {
+	return &_Manifest{dir: dirName}
+}
+
+// add adds the files to swap the file with the new file.
+func (m *_Manifest) add(f, nf *_File) {
+	if f.segments == nil {
+		m.renames = append(m.renames, m.rel(f.Name()))
+		return
+	}
+	nums := nf.segments.nums()
+	for num := range nums {
+		m.renames = append(m.renames, m.rel(f.segments.name(num)))
+	}
+	for num := range f.segments.nums() {
+		if _, ok := nums[num]; !ok {
+			m.removes = append(m.removes, m.rel(f.segments.name(num)))
+		}
+	}
+}
+
+func (m *_Manifest) rel(name string) string {
+	if rel, err := filepath.Rel(m.dir, name); err == nil {
+		return rel
+	}
+	return name
+}
+
+func (m *_Manifest) MarshalBinary() []byte {
+	var buf bytes.Buffer
+	for _, name := range m.renames {
+		fmt.Fprintf(&buf, "rename %s\n", name)
+	}
+	for _, name := range m.removes {
+		fmt.Fprintf(&buf, "remove %s\n", name)
+	}
+	return buf.Bytes()
+}
+
+func (m *_Manifest) UnmarshalBinary(data []byte) error {
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return errCorrupted
+		}
+		switch parts[0] {
+		case "rename":
+			m.renames = append(m.renames, parts[1])
+		case "remove":
+			m.removes = append(m.removes, parts[1])
+		default:
+			return errCorrupted
+		}
+	}
+	return nil
+}
+
+// dirs returns directories of the files of the manifest.
+func (m *_Manifest) dirs() map[string]struct{} {
+	dirs := map[string]struct{}{m.dir: {}}
+	for _, names := range [][]string{m.renames, m.removes} {
+		for _, name := range names {
+			dirs[filepath.Dir(filepath.Join(m.dir, name))] = struct{}{}
+		}
+	}
+	return dirs
+}
+
+// commit persists the directories of new files and renames the manifest into place.
+func (m *_Manifest) commit() error {
+	for dir := range m.dirs() {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	name := path.Join(m.dir, compactManifest)
+	tmp, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(m.MarshalBinary())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(m.dir)
+}
+
+// apply renames and removes files of the manifest. Files renamed or removed before are skipped.
+func (m *_Manifest) apply() error {
+	for _, name := range m.renames {
+		name = filepath.Join(m.dir, name)
+		if err := os.Rename(name+compactSuffix, name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, name := range m.removes {
+		if err := os.Remove(filepath.Join(m.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove persists the swapped files and removes the manifest.
+func (m *_Manifest) remove() error {
+	for dir := range m.dirs() {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(path.Join(m.dir, compactManifest)); err != nil {
+		return err
+	}
+	return syncDir(m.dir)
+}
+
+// completeCompaction swaps the files of a compaction committed before the DB was closed.
+func completeCompaction(dirName string) error {
+	data, err := os.ReadFile(path.Join(dirName, compactManifest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	m := newManifest(dirName)
+	if err := m.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	if err := m.apply(); err != nil {
+		return err
+	}
+	return m.remove()
+}
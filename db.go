@@ -18,18 +18,16 @@ package unitdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"os"
-	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/unit-io/bpool"
-	"github.com/unit-io/unitdb/crypto"
 	fltr "github.com/unit-io/unitdb/filter"
 	"github.com/unit-io/unitdb/memdb"
 	"github.com/unit-io/unitdb/message"
@@ -57,47 +55,71 @@ func Open(path string, opts ...Options) (*DB, error) {
 		}
 	}
 
-	lock, err := createLockFile(path)
+	rollups, err := newRollups(options.rollups)
 	if err != nil {
-		if err == os.ErrExist {
-			err = errLocked
-		}
 		return nil, err
 	}
-
-	infoFile, err := newFile(path, 1, _FileDesc{fileType: typeInfo})
+	topicCompactions, err := newTopicCompactions(options.topicCompactions)
 	if err != nil {
 		return nil, err
 	}
-
-	timeOptions := &_TimeOptions{
-		maxDuration:         options.syncDurationType * time.Duration(options.maxSyncDurations),
-		expDurationType:     time.Minute,
-		maxExpDurations:     maxExpDur,
-		backgroundKeyExpiry: options.flags.backgroundKeyExpiry,
+	codecs, err := newCodecs(options)
+	if err != nil {
+		return nil, err
 	}
-	winFile, err := newFile(path, 1, _FileDesc{fileType: typeTimeWindow})
+	retention, err := newRetentionPolicies(options.retention)
 	if err != nil {
 		return nil, err
 	}
 
-	indexFile, err := newFile(path, 1, _FileDesc{fileType: typeIndex})
+	if options.flags.readOnly {
+		// a read-only DB does not delete entries and requires an existing DB.
+		options.flags.immutable = true
+		if _, err := os.Stat(filePath(path, _FileDesc{fileType: typeInfo})); err != nil {
+			return nil, err
+		}
+	}
+	var lock _LockFile
+	if options.flags.readOnly {
+		lock, err = createReaderLockFile(path, true)
+	} else {
+		lock, err = createLockFile(path)
+	}
 	if err != nil {
+		if err == os.ErrExist {
+			err = errLocked
+		}
 		return nil, err
 	}
 
-	dataFile, err := newFile(path, 1, _FileDesc{fileType: typeData})
+	// files of a compaction committed before the DB was closed are swapped by the writer.
+	if !options.flags.readOnly {
+		if err := completeCompaction(path); err != nil {
+			return nil, err
+		}
+	}
+	infoFile, err := newFile(path, 1, _FileDesc{fileType: typeInfo}, options.flags.readOnly)
 	if err != nil {
 		return nil, err
 	}
 
+	timeOptions := &_TimeOptions{
+		maxDuration:         options.syncDurationType * time.Duration(options.maxSyncDurations),
+		expDurationType:     time.Minute,
+		maxExpDurations:     maxExpDur,
+		backgroundKeyExpiry: options.flags.backgroundKeyExpiry,
+	}
 	dbInfo := _DBInfo{}
-	if infoFile.currSize() == 0 {
+	if infoFile.currSize() == 0 && !options.flags.readOnly {
+		if options.segmentDuration > 0 && options.segmentSize == 0 {
+			options.segmentSize = 1 << 30 // size of segment if data file rolls by time period (1GB).
+		}
 		dbInfo = _DBInfo{
 			header: _Header{
 				signature: signature,
 				version:   version,
 			},
+			segmentSize: uint32(options.segmentSize >> 20),
 		}
 		if _, err = infoFile.extend(fixed); err != nil {
 			return nil, err
@@ -115,20 +137,65 @@ func Open(path string, opts ...Options) (*DB, error) {
 		return nil, errCorrupted
 	}
 
-	leaseFile, err := newFile(path, 1, _FileDesc{fileType: typeLease})
+	segmentSize := int64(dbInfo.segmentSize) << 20
+	openFile := func(fd _FileDesc, dur time.Duration) (_FileSet, error) {
+		if segmentSize == 0 {
+			return newFile(path, 1, fd, options.flags.readOnly)
+		}
+		return newSegmentedFile(path, fd, segmentSize, dur, options.flags.readOnly)
+	}
+	winFile, err := openFile(_FileDesc{fileType: typeTimeWindow}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if dbInfo.header.version < version {
+		// the window file is upgraded by the writer.
+		if options.flags.readOnly {
+			lock.unlock()
+			return nil, errUpgradeRequired
+		}
+		if err := upgradeWindow(winFile._File); err != nil {
+			return nil, err
+		}
+		dbInfo.header.version = version
+		if err := infoFile.writeMarshalableAt(dbInfo, 0); err != nil {
+			return nil, err
+		}
+		if err := infoFile.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	indexFile, err := openFile(_FileDesc{fileType: typeIndex}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	dataFile, err := openFile(_FileDesc{fileType: typeData}, options.segmentDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	leaseFile, err := newFile(path, 1, _FileDesc{fileType: typeLease}, options.flags.readOnly)
 	if err != nil {
 		return nil, err
 	}
 	lease := newLease(leaseFile, options.freeBlockSize)
 
-	filterFile, err := newFile(path, 1, _FileDesc{fileType: typeFilter})
+	filterFile, err := newFile(path, 1, _FileDesc{fileType: typeFilter}, options.flags.readOnly)
 	if err != nil {
 		return nil, err
 	}
 
-	fileset := &_FileSet{mu: new(sync.RWMutex), list: []_FileSet{infoFile, winFile, indexFile, dataFile, leaseFile, filterFile}}
+	tombstoneFile, err := newFile(path, 1, _FileDesc{fileType: typeTombstone}, options.flags.readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	fileset := &_FileSet{mu: new(sync.RWMutex), list: []_FileSet{infoFile, winFile, indexFile, dataFile, leaseFile, filterFile, tombstoneFile}}
 	internal := &_DB{
 		mutex: newMutex(),
+		path:  path,
 		start: time.Now(),
 		meter: NewMeter(),
 
@@ -140,6 +207,8 @@ func Open(path string, opts ...Options) (*DB, error) {
 		filter:   Filter{file: filterFile, filterBlock: fltr.NewFilterGenerator()},
 		freeList: lease,
 
+		tombstones: newTombstones(tombstoneFile),
+
 		timeWindow: newTimeWindowBucket(timeOptions),
 
 		// Trie
@@ -151,12 +220,21 @@ func Open(path string, opts ...Options) (*DB, error) {
 		// Sync Handler
 		syncLockC: make(chan struct{}, 1),
 
+		rollups:   rollups,
+		retention: retention,
+		watchers:  newWatchers(),
+
+		topicCompactions: topicCompactions,
+		topicSeqs:        newTopicSeqs(),
+
 		// Close
 		closeC: make(chan struct{}),
 	}
 
-	// Create a new MAC from the key.
-	if internal.mac, err = crypto.New(options.encryptionKey); err != nil {
+	internal.codecs = codecs
+
+	// Create a keyring from the keys.
+	if internal.keyring, err = newKeyring(options); err != nil {
 		return nil, err
 	}
 
@@ -165,14 +243,24 @@ func Open(path string, opts ...Options) (*DB, error) {
 		internal.dbInfo.encryption = 1
 	}
 
-	// Create a blockcache.
-	memdb, err := memdb.Open(memdb.WithLogFilePath(path), memdb.WithMemdbSize(options.memdbSize), memdb.WithBufferSize(options.bufferSize))
-	if err != nil {
-		return nil, err
+	if options.flags.lastValueCache {
+		lastValueFile, err := newFile(path, 1, _FileDesc{fileType: typeLastValue}, options.flags.readOnly)
+		if err != nil {
+			return nil, err
+		}
+		fileset.list = append(fileset.list, lastValueFile)
+		internal.lastValues = newLastValues(lastValueFile)
 	}
-	internal.mem = memdb
 
-	internal.filter.blockCache = internal.mem
+	// Create a blockcache. A read-only DB does not have a blockcache and the write ahead log of the writer is not opened.
+	if !options.flags.readOnly {
+		memdb, err := memdb.Open(memdb.WithLogFilePath(path), memdb.WithMemdbSize(options.memdbSize), memdb.WithBufferSize(options.bufferSize))
+		if err != nil {
+			return nil, err
+		}
+		internal.mem = memdb
+		internal.filter.blockCache = internal.mem
+	}
 
 	db := &DB{
 		opts: options,
@@ -193,6 +281,33 @@ func Open(path string, opts ...Options) (*DB, error) {
 		return nil, err
 	}
 
+	if err := db.internal.tombstones.read(); err != nil {
+		return nil, err
+	}
+
+	if db.internal.lastValues != nil {
+		if err := db.internal.lastValues.read(); err != nil {
+			return nil, err
+		}
+		if err := db.rebuildLastValues(); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.flags.readOnly {
+		return db, nil
+	}
+
+	// Read dedup keys, keys of entries not yet synced are read on recovery from the write ahead log.
+	dedupFile, err := newFile(path, 1, _FileDesc{fileType: typeDedup}, false)
+	if err != nil {
+		return nil, err
+	}
+	db.internal.dedup = newDedup(dedupFile, options.dedupWindow)
+	if err := db.internal.dedup.read(); err != nil {
+		return nil, err
+	}
+
 	if err := db.recoverLog(); err != nil {
 		// if unable to recover db then close db.
 		panic(fmt.Sprintf("Unable to recover db on sync error %v. Closing db...", err))
@@ -201,9 +316,7 @@ func Open(path string, opts ...Options) (*DB, error) {
 	db.internal.syncHandle = _SyncHandle{DB: db}
 	db.startSyncer(options.syncDurationType * time.Duration(options.maxSyncDurations))
 
-	if db.opts.flags.backgroundKeyExpiry {
-		db.startExpirer(time.Minute, maxExpDur)
-	}
+	db.startExpirer(time.Minute, maxExpDur)
 
 	return db, nil
 }
@@ -219,102 +332,25 @@ func (db *DB) Close() error {
 
 // Get return items matching the query paramater.
 func (db *DB) Get(q *Query) (items [][]byte, err error) {
-	if err := db.ok(); err != nil {
-		return nil, err
-	}
-	switch {
-	case len(q.Topic) == 0:
-		return nil, errTopicEmpty
-	case len(q.Topic) > maxTopicLength:
-		return nil, errTopicTooLarge
-	}
-	// // CPU profiling by default
-	// defer profile.Start().Stop()
-	q.internal.opts = &_QueryOptions{defaultQueryLimit: db.opts.queryOptions.defaultQueryLimit, maxQueryLimit: db.opts.queryOptions.maxQueryLimit}
-	if err := q.parse(); err != nil {
-		return nil, err
-	}
-	mu := db.internal.mutex.getMutex(q.internal.prefix)
-	mu.RLock()
-	defer mu.RUnlock()
-	db.lookup(q)
-	if len(q.internal.winEntries) == 0 {
-		return
-	}
-	sort.Slice(q.internal.winEntries[:], func(i, j int) bool {
-		return q.internal.winEntries[i].seq > q.internal.winEntries[j].seq
-	})
-	start := 0
-	limit := q.Limit
-	if len(q.internal.winEntries) < int(q.Limit) {
-		limit = len(q.internal.winEntries)
-	}
-
-	for {
-		invalidCount := 0
-		for _, query := range q.internal.winEntries[start:limit] {
-			err = func() error {
-				if query.seq == 0 {
-					return nil
-				}
-				s, err := db.readEntry(query)
-				if err != nil {
-					if err == errMsgIDDeleted {
-						invalidCount++
-						return nil
-					}
-					logger.Error().Err(err).Str("context", "db.readEntry")
-					return err
-				}
-				id, val, err := db.internal.reader.readMessage(s)
-				if err != nil {
-					logger.Error().Err(err).Str("context", "data.readMessage")
-					return err
-				}
-				msgID := message.ID(id)
-				if !msgID.EvalPrefix(q.Contract, q.internal.cutoff) {
-					invalidCount++
-					return nil
-				}
-
-				// last bit of ID is an encryption flag.
-				if uint8(id[idSize-1]) == 1 {
-					val, err = db.internal.mac.Decrypt(nil, val)
-					if err != nil {
-						logger.Error().Err(err).Str("context", "mac.decrypt")
-						return err
-					}
-				}
-				var buffer []byte
-				val, err = snappy.Decode(buffer, val)
-				if err != nil {
-					logger.Error().Err(err).Str("context", "snappy.Decode")
-					return err
-				}
-				items = append(items, val)
-				db.internal.meter.OutBytes.Inc(int64(s.valueSize))
-				return nil
-			}()
-			if err != nil {
-				return items, err
-			}
-		}
+	return db.GetContext(context.Background(), q)
+}
 
-		if invalidCount == 0 || len(items) == int(q.Limit) || len(q.internal.winEntries) == limit {
-			break
-		}
+// GetContext is like Get but it stops the lookup and returns the context error if the context is done.
+func (db *DB) GetContext(ctx context.Context, q *Query) (items [][]byte, err error) {
+	err = db.get(ctx, q, func(_ _Query, _ message.ID, val []byte) {
+		items = append(items, val)
+	})
+	return items, err
+}
 
-		if len(q.internal.winEntries) <= int(q.Limit+invalidCount) {
-			start = limit
-			limit = len(q.internal.winEntries)
-		} else {
-			start = limit
-			limit = limit + invalidCount
-		}
-	}
-	db.internal.meter.Gets.Inc(int64(len(items)))
-	db.internal.meter.OutMsgs.Inc(int64(len(items)))
-	return items, nil
+// GetEntries return entries matching the query paramater.
+// Entries contains the message ID, the topic, the time message was stored and the expiry of the message along with the payload.
+// The topic of the entry is empty if the topic was stored without the topic string.
+func (db *DB) GetEntries(q *Query) (entries []Entry, err error) {
+	err = db.get(context.Background(), q, func(qe _Query, id message.ID, val []byte) {
+		entries = append(entries, db.newEntry(qe, id, val))
+	})
+	return entries, err
 }
 
 // NewContract generates a new Contract.
@@ -340,14 +376,26 @@ func (db *DB) Put(topic, payload []byte) error {
 }
 
 // PutEntry puts entry into the DB, if Contract is not specified then it uses master Contract.
+// An entry set with WithReplace supersedes the message with the ID of the entry.
 // It is safe to modify the contents of the argument after PutEntry returns but not
 // before.
 func (db *DB) PutEntry(e *Entry) error {
+	return db.PutEntryContext(context.Background(), e)
+}
+
+// PutEntryContext is like PutEntry but it returns the context error if the context is done
+// before the entry is put into the memdb, i.e. while the memdb backs off writing logs.
+func (db *DB) PutEntryContext(ctx context.Context, e *Entry) error {
 	if err := db.ok(); err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	switch {
+	case db.opts.flags.readOnly:
+		return errImmutable
 	case len(e.Topic) == 0:
 		return errTopicEmpty
 	case len(e.Topic) > maxTopicLength:
@@ -358,28 +406,44 @@ func (db *DB) PutEntry(e *Entry) error {
 		return errValueTooLarge
 	}
 
+	if e.Replace {
+		return db.replace(ctx, e)
+	}
+
 	if err := db.setEntry(e); err != nil {
+		if err == errEntryDuplicate {
+			// a duplicate entry is acknowledged but not stored again.
+			e.reset()
+			return nil
+		}
 		return err
 	}
 
-	timeID, err := db.internal.mem.Put(e.entry.seq, e.entry.cache)
+	timeID, err := db.internal.mem.PutContext(ctx, e.entry.seq, e.entry.cache)
 	if err != nil {
+		db.internal.dedup.remove(e.entry.dedup)
 		return err
 	}
 
-	if ok := db.internal.timeWindow.add(timeID, e.entry.topicHash, newWinEntry(e.entry.seq, e.entry.expiresAt)); !ok {
+	timestamp := message.ID(e.entry.cache[entrySize:]).Time()
+	if ok := db.internal.timeWindow.add(timeID, e.entry.topicHash, newWinEntry(e.entry.seq, e.entry.expiresAt, timestamp)); !ok {
 		return errForbidden
 	}
+	db.internal.lastValues.add(_LastValue{topicHash: e.entry.topicHash, seq: e.entry.seq, timestamp: timestamp, expiresAt: e.entry.expiresAt})
 
 	if e.entry.topicSize != 0 {
 		t := new(message.Topic)
 		rawTopic := e.entry.cache[entrySize+idSize : entrySize+idSize+e.entry.topicSize]
 		t.Unmarshal(rawTopic)
-		db.internal.trie.add(newTopic(e.entry.topicHash, 0), t.Parts, t.Depth)
+		db.internal.trie.add(newTopic(e.entry.topicHash, t.Topic, 0), t.Parts, t.Depth)
 	}
 
 	db.internal.meter.Puts.Inc(1)
 
+	if db.internal.watchers.len() != 0 {
+		db.notify([]Entry{db.watchEntry(e)})
+	}
+
 	// reset message entry.
 	e.reset()
 	return nil
@@ -431,12 +495,26 @@ func (db *DB) DeleteEntry(e *Entry) error {
 //
 // Attempting to manually commit or rollback within the function will cause a panic.
 func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
+	return db.BatchContext(context.Background(), fn)
+}
+
+// BatchContext is like Batch but the transaction is rolled back and the context error is returned
+// if the context is done before the batch entries are written.
+func (db *DB) BatchContext(ctx context.Context, fn func(*Batch, <-chan struct{}) error) error {
+	if db.opts.flags.readOnly {
+		return errImmutable
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	b := db.batch()
+	b.ctx = ctx
 
 	b.setManaged()
 
 	// If an error is returned from the function then rollback and return error.
 	if err := fn(b, b.commitComplete); err != nil {
+		b.unsetManaged()
 		b.Abort()
 		close(b.commitComplete)
 		return err
@@ -449,6 +527,15 @@ func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
 // Sync write window entries into summary file and write index, and data to respective index and data files.
 // In case of any error during sync operation recovery is performed on log file (write ahead log).
 func (db *DB) Sync() error {
+	return db.SyncContext(context.Background())
+}
+
+// SyncContext is like Sync but it returns the context error if the context is done
+// while waiting for a running sync or compaction, or between time blocks of the sync.
+func (db *DB) SyncContext(ctx context.Context) error {
+	if db.opts.flags.readOnly {
+		return errImmutable
+	}
 	// start := time.Now()
 	if ok := db.internal.syncHandle.status(); ok {
 		// sync is in-progress.
@@ -456,7 +543,11 @@ func (db *DB) Sync() error {
 	}
 
 	// Sync happens synchronously.
-	db.internal.syncLockC <- struct{}{}
+	select {
+	case db.internal.syncLockC <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	defer func() {
 		<-db.internal.syncLockC
 	}()
@@ -467,7 +558,43 @@ func (db *DB) Sync() error {
 	defer func() {
 		db.internal.syncHandle.finish()
 	}()
-	return db.internal.syncHandle.Sync()
+	return db.internal.syncHandle.Sync(ctx)
+}
+
+// Refresh reads window and index blocks synced by the writer since the read-only DB is opened or refreshed.
+// Files replaced by compaction are reopened. Refresh does nothing if the DB is not read-only.
+func (db *DB) Refresh() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if !db.opts.flags.readOnly {
+		return nil
+	}
+	db.internal.compactLock.Lock()
+	defer db.internal.compactLock.Unlock()
+	if err := db.fs.reopen(); err != nil {
+		return err
+	}
+	inf := _DBInfo{}
+	if err := db.internal.info.readUnmarshalableAt(&inf, fixed, 0); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&db.internal.dbInfo.sequence, inf.sequence)
+	atomic.StoreUint64(&db.internal.dbInfo.count, inf.count)
+	if err := db.loadTrie(); err != nil {
+		return err
+	}
+	if err := db.internal.tombstones.read(); err != nil {
+		return err
+	}
+	if db.internal.lastValues != nil {
+		if err := db.internal.lastValues.read(); err != nil {
+			return err
+		}
+	}
+	// reset cursors of the iterators.
+	db.internal.compactGen++
+	return nil
 }
 
 // FileSize returns the total size of the disk storage used by the DB.
@@ -35,6 +35,8 @@ type (
 		encryption int8
 		sequence   uint64
 		count      uint64
+		// segmentSize is size of file segments in MB, zero if files are not segmented.
+		segmentSize uint32
 	}
 )
 
@@ -46,6 +48,7 @@ func (inf _DBInfo) MarshalBinary() ([]byte, error) {
 	buf[12] = uint8(inf.encryption)
 	binary.LittleEndian.PutUint64(buf[12:20], inf.sequence)
 	binary.LittleEndian.PutUint64(buf[20:28], inf.count)
+	binary.LittleEndian.PutUint32(buf[28:32], inf.segmentSize)
 
 	return buf, nil
 }
@@ -57,6 +60,7 @@ func (inf *_DBInfo) UnmarshalBinary(data []byte) error {
 	inf.encryption = int8(data[7])
 	inf.sequence = binary.LittleEndian.Uint64(data[12:20])
 	inf.count = binary.LittleEndian.Uint64(data[20:28])
+	inf.segmentSize = binary.LittleEndian.Uint32(data[28:32])
 
 	return nil
 }
@@ -17,6 +17,8 @@
 package unitdb
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"io"
 	"math"
@@ -25,11 +27,10 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/unit-io/bpool"
-	"github.com/unit-io/unitdb/crypto"
 	"github.com/unit-io/unitdb/memdb"
 	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
 )
 
 const (
@@ -40,7 +41,7 @@ const (
 	nPoolSize             = 27
 	lockPostfix           = ".lock"
 	idSize                = 9 // message ID prefix with additional encryption bit.
-	version               = 1 // file format version.
+	version               = 2 // file format version, the first window block is left empty from version 2.
 
 	// maxExpDur expired keys are deleted from DB after durType*maxExpDur.
 	// For example if durType is Minute and maxExpDur then
@@ -70,13 +71,16 @@ type (
 	_DB struct {
 		mutex _Mutex
 
+		// path is the DB directory.
+		path string
+
 		// The db start time.
 		start time.Time
 		// The metrics to measure timeseries on message events.
 		meter *Meter
 
-		dbInfo _DBInfo
-		mac    *crypto.MAC
+		dbInfo  _DBInfo
+		keyring *_Keyring
 
 		mem      *memdb.DB
 		bufPool  *bpool.BufferPool
@@ -86,6 +90,14 @@ type (
 
 		timeWindow *_TimeWindowBucket
 
+		// dedup is index of dedup keys of the entries put within the dedup window, it is nil for a read-only DB.
+		dedup *_Dedup
+
+		tombstones *_Tombstones
+
+		// lastValues is the last-value cache, it is nil if the cache is not enabled.
+		lastValues *_LastValues
+
 		// Trie
 		trie *_Trie
 
@@ -97,6 +109,32 @@ type (
 		syncWrites bool
 		syncHandle _SyncHandle
 
+		// Rollups
+		rollups []*_Rollup
+
+		// Topic compactions, it is nil if topic compaction is not configured.
+		topicCompactions *_TopicCompactions
+
+		// Retention policies
+		retention *_RetentionPolicies
+
+		// Seqs of entries stored with the topic
+		topicSeqs *_TopicSeqs
+
+		// Watchers of topics
+		watchers *_Watchers
+
+		// Codecs to compress payloads
+		codecs *_Codecs
+
+		// compactLock is locked exclusively to swap compacted files, compactGen is incremented on each swap.
+		compactLock sync.RWMutex
+		compactGen  uint64
+		// compactMu serializes compactions, compactChanges tracks entries changed while the files are compacted.
+		// compactChanges is set and read holding the sync lock, it is nil if compaction is not running.
+		compactMu      sync.Mutex
+		compactChanges *_CompactChanges
+
 		// Close.
 		closeW sync.WaitGroup
 		closeC chan struct{}
@@ -111,9 +149,10 @@ func (db *DB) writeInfo() error {
 			signature: signature,
 			version:   version,
 		},
-		encryption: db.internal.dbInfo.encryption,
-		sequence:   atomic.LoadUint64(&db.internal.dbInfo.sequence),
-		count:      atomic.LoadUint64(&db.internal.dbInfo.count),
+		encryption:  db.internal.dbInfo.encryption,
+		sequence:    atomic.LoadUint64(&db.internal.dbInfo.sequence),
+		count:       atomic.LoadUint64(&db.internal.dbInfo.count),
+		segmentSize: db.internal.dbInfo.segmentSize,
 	}
 
 	return db.internal.info.writeMarshalableAt(inf, 0)
@@ -128,21 +167,26 @@ func (db *DB) close() error {
 	// Signal all goroutines.
 	close(db.internal.closeC)
 
+	// Wait for all goroutines to exit before the lock is acquired, the syncer and the expirer take it to finish the running step.
+	db.internal.closeW.Wait()
+
 	// Acquire lock.
 	db.internal.syncLockC <- struct{}{}
 
-	// Wait for all goroutines to exit.
-	db.internal.closeW.Wait()
-
-	// close memdb.
-	db.internal.mem.Close()
+	if !db.opts.flags.readOnly {
+		// close memdb.
+		db.internal.mem.Close()
 
-	if err := db.writeInfo(); err != nil {
-		return err
-	}
-	db.internal.freeList.defrag()
-	if err := db.internal.freeList.write(); err != nil {
-		return err
+		if err := db.writeInfo(); err != nil {
+			return err
+		}
+		db.internal.freeList.defrag()
+		if err := db.internal.freeList.write(); err != nil {
+			return err
+		}
+		if err := db.internal.dedup.close(); err != nil {
+			return err
+		}
 	}
 	if err := db.fs.close(); err != nil {
 		return err
@@ -168,23 +212,32 @@ func (db *DB) close() error {
 func (db *DB) loadTrie() error {
 	r := newWindowReader(db.fs)
 	err := r.blockIterator(func(startSeq, topicHash uint64, off int64) (bool, error) {
-		e, err := db.internal.reader.readEntry(startSeq)
+		// a read-only DB updates offsets of the topics on refresh.
+		if db.opts.flags.readOnly && db.internal.trie.setOffset(_Topic{hash: topicHash, offset: off}) {
+			return false, nil
+		}
+		// topic is read from the first entry of the topic even if the entry is deleted.
+		e, err := db.internal.reader.findEntry(startSeq)
 		if err != nil {
 			return true, err
 		}
-		if e.topicSize == 0 {
+		if e.topicSize == 0 || e.msgOffset == -1 {
 			return false, nil
 		}
 		rawtopic, err := db.internal.reader.readTopic(e)
 		if err != nil {
+			if err == errMsgIDDeleted {
+				return false, nil
+			}
 			return true, err
 		}
+		db.internal.topicSeqs.add(startSeq)
 		t := new(message.Topic)
 		err = t.Unmarshal(rawtopic)
 		if err != nil {
 			return true, err
 		}
-		if ok := db.internal.trie.add(newTopic(topicHash, off), t.Parts, t.Depth); !ok {
+		if ok := db.internal.trie.add(newTopic(topicHash, t.Topic, off), t.Parts, t.Depth); !ok {
 			logger.Info().Str("context", "db.loadTrie: topic exist in the trie")
 			return false, nil
 		}
@@ -194,45 +247,275 @@ func (db *DB) loadTrie() error {
 }
 
 func (db *DB) readEntry(q _Query) (_IndexEntry, error) {
-	data, _ := db.internal.mem.Get(q.seq)
-	if data != nil {
-		var m _Entry
-		m.UnmarshalBinary(data[:entrySize])
-		e := _IndexEntry{
-			seq:       m.seq,
-			topicSize: m.topicSize,
-			valueSize: m.valueSize,
-
-			cache: data[entrySize:],
-		}
+	if e, ok := db.memEntry(q.seq); ok {
 		return e, nil
 	}
 
-	return db.internal.reader.readEntry(q.seq)
+	e, err := db.internal.reader.readEntry(q.seq)
+	if err == io.EOF || err == errEntryInvalid {
+		// entry was deleted before it was synced to the index file.
+		return _IndexEntry{}, errMsgIDDeleted
+	}
+	return e, err
+}
+
+// seqExists returns true if an entry of the seq is stored in the memdb or the index, a deleted entry of the index keeps its seq.
+func (db *DB) seqExists(seq uint64) (bool, error) {
+	if _, ok := db.memEntry(seq); ok {
+		return true, nil
+	}
+	if !db.internal.filter.Test(seq) {
+		return false, nil
+	}
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	r := newBlockReader(db.fs)
+	switch _, err := r.findEntry(seq); err {
+	case nil:
+		return true, nil
+	case io.EOF, errEntryInvalid:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// memEntry returns index entry of the seq if the entry is not yet synced.
+func (db *DB) memEntry(seq uint64) (_IndexEntry, bool) {
+	if db.internal.mem == nil {
+		return _IndexEntry{}, false
+	}
+	data, _ := db.internal.mem.Get(seq)
+	if data == nil {
+		return _IndexEntry{}, false
+	}
+	var m _Entry
+	m.UnmarshalBinary(data[:entrySize])
+	e := _IndexEntry{
+		seq:       m.seq,
+		topicSize: m.topicSize,
+		valueSize: m.valueSize,
+
+		cache: data[entrySize:],
+	}
+	return e, true
+}
+
+// get gets items matching the query paramater and calls function f for each item.
+func (db *DB) get(ctx context.Context, q *Query, f func(qe _Query, id message.ID, val []byte)) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case len(q.Topic) == 0:
+		return errTopicEmpty
+	case len(q.Topic) > maxTopicLength:
+		return errTopicTooLarge
+	}
+	// // CPU profiling by default
+	// defer profile.Start().Stop()
+	q.internal.opts = &_QueryOptions{defaultQueryLimit: db.opts.queryOptions.defaultQueryLimit, maxQueryLimit: db.opts.queryOptions.maxQueryLimit}
+	if err := q.parse(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mu := db.internal.mutex.getMutex(q.internal.prefix)
+	mu.RLock()
+	defer mu.RUnlock()
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	if err := db.lookup(ctx, q); err != nil {
+		return err
+	}
+	if len(q.internal.winEntries) == 0 {
+		return nil
+	}
+	start := 0
+	limit := q.Limit
+	if len(q.internal.winEntries) < int(q.Limit) {
+		limit = len(q.internal.winEntries)
+	}
+
+	count := 0
+	for {
+		invalidCount := 0
+		for _, query := range q.internal.winEntries[start:limit] {
+			if query.seq == 0 {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			id, val, err := db.readMessage(q, query)
+			if err != nil {
+				if err == errMsgIDDeleted || err == errMsgIDPrefixMismatch {
+					invalidCount++
+					continue
+				}
+				return err
+			}
+			f(query, id, val)
+			count++
+		}
+
+		if invalidCount == 0 || count == int(q.Limit) || len(q.internal.winEntries) == limit {
+			break
+		}
+
+		if len(q.internal.winEntries) <= int(q.Limit+invalidCount) {
+			start = limit
+			limit = len(q.internal.winEntries)
+		} else {
+			start = limit
+			limit = limit + invalidCount
+		}
+	}
+	db.internal.meter.Gets.Inc(int64(count))
+	db.internal.meter.OutMsgs.Inc(int64(count))
+	return nil
+}
+
+// newEntry returns entry of the query entry with the message ID, topic, contract, time and expiry of the message.
+func (db *DB) newEntry(qe _Query, id message.ID, val []byte) Entry {
+	e := Entry{
+		ID:        message.NewID(qe.seq),
+		Payload:   val,
+		ExpiresAt: qe.expiresAt,
+		Contract:  id.Contract(),
+		Timestamp: time.Unix(id.Time(), 0),
+	}
+	copy(e.ID, id[:8])
+	if name, ok := db.internal.trie.getName(qe.topicHash); ok && name != "" {
+		e.Topic = []byte(name)
+	}
+	return e
+}
+
+// readMessage reads message for the query entry and returns the message ID and the decoded value.
+// It returns errMsgIDDeleted if message is deleted and errMsgIDPrefixMismatch if message does not match the query.
+func (db *DB) readMessage(q *Query, qe _Query) (message.ID, []byte, error) {
+	s, err := db.readEntry(qe)
+	if err != nil {
+		if err != errMsgIDDeleted {
+			logger.Error().Err(err).Str("context", "db.readEntry")
+		}
+		return nil, nil, err
+	}
+	return db.decodeMessage(q, qe, s)
+}
+
+// decodeMessage reads message of the index entry and returns the message ID and the decoded value.
+// It returns errMsgIDDeleted if the message is covered by a range tombstone.
+func (db *DB) decodeMessage(q *Query, qe _Query, s _IndexEntry) (message.ID, []byte, error) {
+	id, val, err := db.internal.reader.readMessage(s)
+	if err != nil {
+		logger.Error().Err(err).Str("context", "data.readMessage")
+		return nil, nil, err
+	}
+	msgID := message.ID(id)
+	if !msgID.EvalRange(q.Contract, q.internal.cutoff, q.internal.upper) {
+		return nil, nil, errMsgIDPrefixMismatch
+	}
+	if db.internal.tombstones.deleted(qe.topicHash, s.seq, msgID.Time()) {
+		return nil, nil, errMsgIDDeleted
+	}
+
+	// last byte of ID holds flags of the entry.
+	flags := uint8(id[idSize-1])
+	if flags&flagEncrypted != 0 {
+		val, err = db.internal.keyring.decrypt(flags, val)
+		if err != nil {
+			logger.Error().Err(err).Str("context", "mac.decrypt")
+			return nil, nil, err
+		}
+	}
+	val, err = db.internal.codecs.decode((flags>>codecShift)&codecMask, val)
+	if err != nil {
+		logger.Error().Err(err).Str("context", "codec.Decode")
+		return nil, nil, err
+	}
+	db.internal.meter.OutBytes.Inc(int64(s.valueSize))
+	return msgID, val, nil
+}
+
+// readID reads message ID for the query entry.
+func (db *DB) readID(qe _Query) (message.ID, error) {
+	s, err := db.readEntry(qe)
+	if err != nil {
+		return nil, err
+	}
+	id, _, err := db.internal.reader.readMessage(s)
+	if err != nil {
+		return nil, err
+	}
+	return message.ID(id), nil
 }
 
 // lookups are performed in following order
 // ilookup lookups in memory entries from timeWindow
 // lookup lookups persisted entries from timeWindow file.
-func (db *DB) lookup(q *Query) error {
+// Entries are sorted in reverse time order, by seq unless entries were put with an earlier timestamp.
+func (db *DB) lookup(ctx context.Context, q *Query) error {
 	topics := db.internal.trie.lookup(q.internal.parts, q.internal.depth, q.internal.topicType)
 	sort.Slice(topics[:], func(i, j int) bool {
 		return topics[i].offset > topics[j].offset
 	})
+	// Entries after the upper time limit are filtered out later on reading the message IDs,
+	// so lookup is not limited to query limit if upper time limit is set on query.
+	maxEntries := q.Limit
+	if q.internal.upper > 0 {
+		maxEntries = q.internal.opts.maxQueryLimit
+	}
+	byTime := false
 	for _, topic := range topics {
-		if len(q.internal.winEntries) > q.Limit {
+		if len(q.internal.winEntries) > maxEntries {
 			break
 		}
-		limit := q.Limit - len(q.internal.winEntries)
-		wEntries := db.internal.timeWindow.lookup(db.fs, topic.hash, topic.offset, q.internal.cutoff, limit)
+		limit := maxEntries - len(q.internal.winEntries)
+		wEntries, ordered, err := db.internal.timeWindow.lookup(ctx, db.fs, topic.hash, topic.offset, q.internal.cutoff, q.internal.upper, limit, db.entryTime)
+		if err != nil {
+			return err
+		}
+		if !ordered {
+			byTime = true
+		}
 		for _, we := range wEntries {
-			q.internal.winEntries = append(q.internal.winEntries, _Query{topicHash: topic.hash, seq: we.seq()})
+			q.internal.winEntries = append(q.internal.winEntries, _Query{topicHash: topic.hash, seq: we.seq(), expiresAt: we.expiryTime(), timestamp: we.timestamp})
+		}
+	}
+	winEntries := q.internal.winEntries
+	if !byTime {
+		sort.Slice(winEntries, func(i, j int) bool {
+			return winEntries[i].seq > winEntries[j].seq
+		})
+		return nil
+	}
+	for i, qe := range winEntries {
+		if qe.timestamp == 0 {
+			winEntries[i].timestamp = db.entryTime(qe.seq)
 		}
 	}
+	sort.Slice(winEntries, func(i, j int) bool {
+		if winEntries[i].timestamp != winEntries[j].timestamp {
+			return winEntries[i].timestamp > winEntries[j].timestamp
+		}
+		return winEntries[i].seq > winEntries[j].seq
+	})
 
 	return nil
 }
 
+// entryTime returns the time of the entry from its message ID, it returns zero if the entry is deleted.
+func (db *DB) entryTime(seq uint64) int64 {
+	id, err := db.readID(_Query{seq: seq})
+	if err != nil {
+		return 0
+	}
+	return id.Time()
+}
+
 func (db *DB) parseTopic(contract uint32, topic []byte) (*message.Topic, uint32, error) {
 	t := new(message.Topic)
 
@@ -252,7 +535,6 @@ func (db *DB) parseTopic(contract uint32, topic []byte) (*message.Topic, uint32,
 
 func (db *DB) setEntry(e *Entry) error {
 	var id message.ID
-	var eBit uint8
 	var seq uint64
 	var rawTopic []byte
 	if !e.entry.parsed {
@@ -268,16 +550,34 @@ func (db *DB) setEntry(e *Entry) error {
 		}
 		t.AddContract(e.Contract)
 		e.entry.topicHash = t.GetHash(e.Contract)
-		// topic is packed if it is new topic entry
-		if _, ok := db.internal.trie.getOffset(e.entry.topicHash); !ok {
+		// topic is packed if it is new topic entry or the entry replaces the first entry of the topic.
+		if _, ok := db.internal.trie.getOffset(e.entry.topicHash); !ok || e.entry.carrier {
 			rawTopic = t.Marshal()
 			e.entry.topicSize = uint16(len(rawTopic))
 		}
 		e.entry.parsed = true
 	}
+	if !e.Timestamp.IsZero() && (e.Timestamp.Unix() < uid.Offset || e.Timestamp.Unix()-uid.Offset > math.MaxUint32) {
+		return errTimestampInvalid
+	}
+	codec, err := db.internal.codecs.get(e)
+	if err != nil {
+		return err
+	}
+	var dedupExpiry uint32
+	if e.DedupKey != nil {
+		h := dedupHash(e.Contract, e.entry.topicHash, e.DedupKey)
+		var ok bool
+		if dedupExpiry, ok = db.internal.dedup.add(h); !ok {
+			return errEntryDuplicate
+		}
+		e.entry.dedup = h
+	}
 	if e.ID != nil {
 		id = message.ID(e.ID)
 		seq = id.Sequence()
+		// seq of an imported entry is not allocated by the DB.
+		db.setSeq(seq)
 	} else {
 		seq = db.nextSeq()
 		id = message.NewID(seq)
@@ -285,30 +585,43 @@ func (db *DB) setEntry(e *Entry) error {
 	if seq == 0 {
 		panic("db.setEntry: seq is zero")
 	}
+	if !e.Timestamp.IsZero() {
+		id.SetTime(e.Timestamp)
+	}
 
 	id.SetContract(e.Contract)
 	e.entry.seq = seq
 	e.entry.expiresAt = e.ExpiresAt
-	val := snappy.Encode(nil, e.Payload)
+	val := codec.Encode(nil, e.Payload)
+	flags := codec.ID() << codecShift
 	if db.internal.dbInfo.encryption == 1 || e.Encryption {
-		eBit = 1
-		val = db.internal.mac.Encrypt(nil, val)
+		flags, val = db.internal.keyring.encrypt(flags, val)
 	}
-	e.entry.valueSize = uint32(len(val))
+	// checksum of the message is stored after the value.
+	flags |= flagChecksum
+	e.entry.valueSize = uint32(len(val)) + checksumSize
 	mLen := entrySize + idSize + uint32(e.entry.topicSize) + uint32(e.entry.valueSize)
-	e.entry.cache = make([]byte, mLen)
+	if e.entry.dedup != 0 {
+		// dedup record is stored after the message so the dedup key is recovered from the log.
+		e.entry.cache = make([]byte, mLen+dedupRecordSize)
+		binary.LittleEndian.PutUint64(e.entry.cache[mLen:mLen+8], e.entry.dedup)
+		binary.LittleEndian.PutUint32(e.entry.cache[mLen+8:], dedupExpiry)
+	} else {
+		e.entry.cache = make([]byte, mLen)
+	}
 	entryData, err := e.entry.MarshalBinary()
 	if err != nil {
 		return err
 	}
 	copy(e.entry.cache, entryData)
 	copy(e.entry.cache[entrySize:], id.Prefix())
-	e.entry.cache[entrySize+idSize-1] = byte(eBit)
+	e.entry.cache[entrySize+idSize-1] = byte(flags)
 	// topic data is added on first entry for the topic.
 	if e.entry.topicSize != 0 {
 		copy(e.entry.cache[entrySize+idSize:], rawTopic)
 	}
 	copy(e.entry.cache[entrySize+idSize+uint32(e.entry.topicSize):], val)
+	putChecksum(e.entry.cache[entrySize:mLen])
 	return nil
 }
 
@@ -318,24 +631,57 @@ func (db *DB) delete(topicHash, seq uint64) error {
 		return nil
 	}
 
-	db.internal.meter.Dels.Inc(1)
-	db.internal.mem.Delete(seq)
+	return db.deleteEntries([]_Query{{topicHash: topicHash, seq: seq}})
+}
 
-	// Test filter block for the message id presence.
-	if !db.internal.filter.Test(seq) {
-		return nil
-	}
+// deleteEntries deletes entries from memdb and index blocks and frees the data blocks of the entries.
+func (db *DB) deleteEntries(qs []_Query) error {
+	// Lock sync so the index block is not written concurrently.
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
 
-	w, err := newBlockWriter(db.fs, db.internal.freeList, nil)
+	buf := db.internal.bufPool.Get()
+	defer db.internal.bufPool.Put(buf)
+	w, err := newBlockWriter(db.fs, db.internal.freeList, buf)
 	if err != nil {
 		return err
 	}
-	e, err := w.del(seq)
-	if err != nil {
+	var dels []_IndexEntry
+	for _, q := range qs {
+		db.internal.meter.Dels.Inc(1)
+		db.internal.mem.Delete(q.seq)
+
+		// Test filter block for the message id presence.
+		if !db.internal.filter.Test(q.seq) {
+			continue
+		}
+		e, err := w.del(q.seq)
+		if err != nil {
+			return err
+		}
+		if e.seq == 0 {
+			continue
+		}
+		db.internal.compactChanges.change(e.seq)
+		dels = append(dels, e)
+	}
+	if len(dels) == 0 {
+		return nil
+	}
+	if err := w.write(); err != nil {
 		return err
 	}
-	db.internal.freeList.freeBlock(e.msgOffset, e.mSize())
-	db.decount(1)
+	for _, e := range dels {
+		if e.topicSize != 0 {
+			// free the value only, the topic is kept with the first entry of the topic.
+			db.internal.freeList.freeBlock(e.msgOffset+int64(idSize)+int64(e.topicSize), e.valueSize)
+		} else {
+			db.internal.freeList.freeBlock(e.msgOffset, e.mSize())
+		}
+	}
+	db.decount(uint64(len(dels)))
 	if db.internal.syncWrites {
 		return db.sync()
 	}
@@ -347,7 +693,7 @@ func (db *DB) batch() *Batch {
 	opts := &_Options{}
 	WithDefaultBatchOptions().set(opts)
 	opts.batchOptions.encryption = db.internal.dbInfo.encryption == 1
-	b := &Batch{db: db, opts: opts, writeLockC: make(chan struct{}, 1), buffer: db.internal.bufPool.Get()}
+	b := &Batch{db: db, ctx: context.Background(), opts: opts, writeLockC: make(chan struct{}, 1), buffer: db.internal.bufPool.Get()}
 	b.mem = db.internal.mem.NewBatch()
 	b.commitComplete = make(chan struct{})
 
@@ -363,6 +709,16 @@ func (db *DB) nextSeq() uint64 {
 	return atomic.AddUint64(&db.internal.dbInfo.sequence, 1)
 }
 
+// setSeq advances seq of the DB to the seq if the seq is larger than the current seq.
+func (db *DB) setSeq(seq uint64) {
+	for {
+		curr := db.seq()
+		if seq <= curr || atomic.CompareAndSwapUint64(&db.internal.dbInfo.sequence, curr, seq) {
+			return
+		}
+	}
+}
+
 func (db *DB) incount(count uint64) uint64 {
 	return atomic.AddUint64(&db.internal.dbInfo.count, count)
 }
@@ -17,12 +17,14 @@
 package unitdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sort"
 	"time"
 
 	"github.com/unit-io/bpool"
+	"github.com/unit-io/unitdb/message"
 )
 
 type (
@@ -123,13 +125,24 @@ func (db *_SyncHandle) abort() error {
 	return nil
 }
 
+// closing returns true once the DB is closed, background work stops between its steps.
+func (db *DB) closing() bool {
+	select {
+	case <-db.internal.closeC:
+		return true
+	default:
+		return false
+	}
+}
+
 func (db *DB) startSyncer(interval time.Duration) {
-	db.internal.closeW.Add(1)
-	defer db.internal.closeW.Done()
 	syncTicker := time.NewTicker(interval)
+	// close waits for the syncer to finish the running step.
+	db.internal.closeW.Add(1)
 	go func() {
 		defer func() {
 			syncTicker.Stop()
+			db.internal.closeW.Done()
 		}()
 		for {
 			select {
@@ -140,6 +153,18 @@ func (db *DB) startSyncer(interval time.Duration) {
 					logger.Error().Err(err).Str("context", "startSyncer").Msg("Error syncing to db")
 					panic(err)
 				}
+				if db.closing() {
+					return
+				}
+				if err := db.rollup(); err != nil {
+					logger.Error().Err(err).Str("context", "startSyncer").Msg("Error computing rollups")
+				}
+				if db.closing() {
+					return
+				}
+				if err := db.compactTopics(); err != nil {
+					logger.Error().Err(err).Str("context", "startSyncer").Msg("Error compacting topics")
+				}
 			}
 		}
 	}()
@@ -147,13 +172,44 @@ func (db *DB) startSyncer(interval time.Duration) {
 
 func (db *DB) startExpirer(durType time.Duration, maxDur int) {
 	expirerTicker := time.NewTicker(durType * time.Duration(maxDur))
+	// close waits for the expirer to finish the running step.
+	db.internal.closeW.Add(1)
 	go func() {
+		defer func() {
+			expirerTicker.Stop()
+			db.internal.closeW.Done()
+		}()
 		for {
 			select {
 			case <-expirerTicker.C:
-				db.expireEntries()
+				if db.opts.flags.backgroundKeyExpiry {
+					db.expireEntries()
+				}
+				if db.closing() {
+					return
+				}
+				if err := db.applyRetention(); err != nil {
+					logger.Error().Err(err).Str("context", "startExpirer").Msg("Error applying retention policies")
+				}
+				if db.closing() {
+					return
+				}
+				if err := db.purgeTombstones(); err != nil {
+					logger.Error().Err(err).Str("context", "startExpirer").Msg("Error deleting messages of range tombstones")
+				}
+				if db.closing() {
+					return
+				}
+				if err := db.dropSegments(); err != nil {
+					logger.Error().Err(err).Str("context", "startExpirer").Msg("Error removing data segments")
+				}
+				if db.closing() {
+					return
+				}
+				if err := db.internal.dedup.expire(); err != nil {
+					logger.Error().Err(err).Str("context", "startExpirer").Msg("Error expiring dedup keys")
+				}
 			case <-db.internal.closeC:
-				expirerTicker.Stop()
 				return
 			}
 		}
@@ -165,6 +221,12 @@ func (db *DB) sync() error {
 	if err := db.writeInfo(); err != nil {
 		return err
 	}
+	if err := db.internal.dedup.write(); err != nil {
+		return err
+	}
+	if err := db.internal.lastValues.write(); err != nil {
+		return err
+	}
 	if err := db.fs.sync(); err != nil {
 		return nil
 	}
@@ -209,12 +271,16 @@ func (db *_SyncHandle) sync(recovery bool) error {
 // Sync syncs entries into DB. Sync happens synchronously.
 // Sync write window entries into summary file and write index, and data to respective index and data files.
 // In case of any error during sync operation recovery is performed on log file (write ahead log).
-func (db *_SyncHandle) Sync() error {
+// Time blocks synced before the context is done remain synced.
+func (db *_SyncHandle) Sync(ctx context.Context) error {
 	// // CPU profiling by default
 	// defer profile.Start().Stop()
 	var err1 error
 	timeRelease := db.internal.timeWindow.release()
 	err := db.internal.mem.BlockIterator(func(timeID int64, seqs []uint64) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
 		winEntries := make(map[uint64]_WindowEntries)
 		sort.Slice(seqs[:], func(i, j int) bool {
 			return seqs[i] < seqs[j]
@@ -243,14 +309,25 @@ func (db *_SyncHandle) Sync() error {
 
 				cache: memdata[entrySize:],
 			}
+			record := dedupRecord(memdata, e)
+			if record != nil {
+				e.cache = e.cache[:e.mSize()]
+			}
 			if err := db.blockWriter.append(e); err != nil {
 				if err == errEntryExist {
 					continue
 				}
 				return true, err
 			}
+			db.internal.compactChanges.sync(seq, m.topicHash)
+			if m.topicSize != 0 {
+				db.internal.topicSeqs.add(seq)
+			}
+			if record != nil {
+				db.internal.dedup.append(record, false)
+			}
 
-			we := newWinEntry(seq, m.expiresAt)
+			we := newWinEntry(seq, m.expiresAt, message.ID(memdata[entrySize:]).Time())
 			if _, ok := winEntries[m.topicHash]; ok {
 				winEntries[m.topicHash] = append(winEntries[m.topicHash], we)
 			} else {
@@ -273,6 +350,7 @@ func (db *_SyncHandle) Sync() error {
 			if ok := db.internal.trie.setOffset(_Topic{hash: h, offset: wOff}); !ok {
 				return true, errors.New("db:Sync: timeWindow sync error: unable to set topic offset in trie")
 			}
+			db.internal.topicCompactions.mark(h, len(winEntries[h]))
 		}
 		if err1 != nil {
 			fmt.Println("db.sync: error ", err1)
@@ -298,6 +376,9 @@ func (db *_SyncHandle) Sync() error {
 		db.syncInfo.syncComplete = false
 		db.abort()
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	return db.sync(false)
 }
@@ -317,10 +398,19 @@ func (db *DB) expireEntries() error {
 			continue
 		}
 		e, err := db.internal.reader.readEntry(we.seq())
+		if err == errMsgIDDeleted {
+			continue
+		}
 		if err != nil {
 			return err
 		}
-		db.internal.freeList.free(e.seq, e.msgOffset, e.mSize())
+		db.internal.compactChanges.expire(e.seq)
+		if e.topicSize != 0 {
+			// free the value only, the topic is kept with the first entry of the topic.
+			db.internal.freeList.freeBlock(e.msgOffset+int64(idSize)+int64(e.topicSize), e.valueSize)
+		} else {
+			db.internal.freeList.free(e.seq, e.msgOffset, e.mSize())
+		}
 		db.decount(1)
 	}
 
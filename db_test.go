@@ -17,11 +17,19 @@
 package unitdb
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/unit-io/unitdb/message"
 )
 
 var (
@@ -316,3 +324,2061 @@ func TestWildcardTopics(t *testing.T) {
 		}
 	}
 }
+
+func TestRangeQuery(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit5.test")
+
+	var i uint16
+	var n uint16 = 100
+
+	for i = 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if data, err := db.Get(NewQuery(topic).WithRange(now.Add(-1*time.Hour), now.Add(1*time.Hour)).WithLimit(int(n))); len(data) != int(n) || err != nil {
+		t.Fatalf("expected %d; got %d, %v", n, len(data), err)
+	}
+	if data, err := db.Get(NewQuery(topic).WithRange(now.Add(-2*time.Hour), now.Add(-1*time.Hour)).WithLimit(int(n))); len(data) != 0 || err != nil {
+		t.Fatalf("expected 0; got %d, %v", len(data), err)
+	}
+	rangeTopic := append(topic, []byte(fmt.Sprintf("?from=%d", now.Add(1*time.Hour).Unix()))...)
+	if data, err := db.Get(NewQuery(rangeTopic).WithLimit(int(n))); len(data) != 0 || err != nil {
+		t.Fatalf("expected 0; got %d, %v", len(data), err)
+	}
+}
+
+func TestItems(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit6.test")
+
+	var i uint16
+	var n uint16 = 500
+
+	for i = 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		if i == n/2 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	it, err := db.Items(NewQuery(topic).WithLimit(int(n / 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i = 0
+	for it.Next() {
+		if val := []byte(fmt.Sprintf("msg.%2d", n-i-1)); !reflect.DeepEqual(val, it.Item()) {
+			t.Fatalf("expected %s; got %s", val, it.Item())
+		}
+		i++
+	}
+	if err := it.Err(); err != nil || i != n/2 {
+		t.Fatalf("expected %d; got %d, %v", n/2, i, err)
+	}
+	cursor := it.Cursor()
+	it.Close()
+
+	it, err = db.Items(NewQuery(topic).WithCursor(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for it.Next() {
+		if val := []byte(fmt.Sprintf("msg.%2d", n-i-1)); !reflect.DeepEqual(val, it.Item()) {
+			t.Fatalf("expected %s; got %s", val, it.Item())
+		}
+		i++
+	}
+	if err := it.Err(); err != nil || i != n {
+		t.Fatalf("expected %d; got %d, %v", n, i, err)
+	}
+}
+
+func TestGetEntries(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topics := [][]byte{[]byte("unit7.b.b1"), []byte("unit7.b..."), []byte("unit7.*.b1")}
+	for _, topic := range topics {
+		if err := db.PutEntry(NewEntry(topic, topic).WithID(db.NewID())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	entries, err := db.GetEntries(NewQuery([]byte("unit7.b.b1")).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(topics) {
+		t.Fatalf("expected %d; got %d", len(topics), len(entries))
+	}
+	for _, e := range entries {
+		if !reflect.DeepEqual(e.Topic, e.Payload) {
+			t.Fatalf("expected %s; got %s", e.Payload, e.Topic)
+		}
+		if time.Since(e.Timestamp) > time.Minute {
+			t.Fatalf("unexpected timestamp %v", e.Timestamp)
+		}
+		if err := db.DeleteEntry(NewEntry(e.Topic, nil).WithID(e.ID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, err := db.GetEntries(NewQuery([]byte("unit7.b.b1")).WithLimit(10)); len(entries) != 0 || err != nil {
+		t.Fatalf("expected 0; got %d, %v", len(entries), err)
+	}
+}
+
+func TestTopics(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topics := []string{"fleet.eu.dev1", "fleet.eu.dev1", "fleet.eu.dev2", "fleet.us.dev3"}
+	var ids [][]byte
+	for _, topic := range topics {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry([]byte(topic), []byte("msg for "+topic)).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteEntry(NewEntry([]byte(topics[1]), nil).WithID(ids[1])); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	infos, err := db.Topics([]byte("fleet.eu..."), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2; got %d", len(infos))
+	}
+	if string(infos[0].Topic) != "fleet.eu.dev1" || infos[0].Count != 1 {
+		t.Fatalf("expected fleet.eu.dev1 with 1 message; got %s with %d", infos[0].Topic, infos[0].Count)
+	}
+	if time.Since(infos[0].LastWrite) > time.Minute || infos[0].FirstWrite.After(infos[0].LastWrite) {
+		t.Fatalf("unexpected write times %v, %v", infos[0].FirstWrite, infos[0].LastWrite)
+	}
+	if infos, err := db.Topics([]byte("fleet.*.dev3"), 0); len(infos) != 1 || err != nil {
+		t.Fatalf("expected 1; got %d, %v", len(infos), err)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit8.metrics")
+	for i := 1; i <= 4; i++ {
+		payload := []byte(fmt.Sprintf(`{"sensor":{"temp":%d},"unit":"celsius"}`, i*10))
+		if err := db.Put(topic, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, err := db.Aggregate(NewQuery(topic), AggSpec{Func: AggAvg, Field: "sensor.temp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Count != 4 || results[0].Value != 25 {
+		t.Fatalf("expected avg 25 of 4 messages; got %v", results)
+	}
+	results, err = db.Aggregate(NewQuery(topic), AggSpec{Func: AggMax, Bucket: time.Minute, Field: "sensor.temp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, r := range results {
+		count += r.Count
+	}
+	if count != 4 || results[len(results)-1].Value != 40 {
+		t.Fatalf("expected max 40 of 4 messages; got %v", results)
+	}
+	if _, err := db.Aggregate(NewQuery(topic), AggSpec{Func: AggSum, Bucket: time.Millisecond}); err != errAggregateInvalid {
+		t.Fatalf("expected %v; got %v", errAggregateInvalid, err)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	cleanup()
+	rollup := Rollup{Source: []byte("unit9.sensor"), Target: []byte("unit9.sensor.1s"), Bucket: time.Second, Funcs: []AggFunc{AggAvg, AggMax}, Field: "temp"}
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithRollup(rollup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 1; i <= 3; i++ {
+		if err := db.Put(rollup.Source, []byte(fmt.Sprintf(`{"temp":%d,"unit":"celsius"}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// wait for the time bucket to finish.
+	time.Sleep(time.Until(time.Unix(time.Now().Unix()+1, 0)) + 10*time.Millisecond)
+	if err := db.rollup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.rollup(); err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.Get(NewQuery(rollup.Target).WithLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, item := range items {
+		c, ok := decodeNumber(item, "count")
+		if !ok {
+			t.Fatalf("unexpected rollup %s", item)
+		}
+		count += int(c)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3; got %d", count)
+	}
+
+	// topics matching a wildcard source topic are rolled up into their own target topics.
+	db.internal.rollups = append(db.internal.rollups, &_Rollup{Rollup: Rollup{Source: []byte("unit9.fleet.*"), Target: []byte("unit9.fleet.1s"), Bucket: time.Second, Funcs: []AggFunc{AggSum}, Field: "temp"}, last: make(map[string]int64)})
+	for i, topic := range []string{"unit9.fleet.dev1", "unit9.fleet.dev1", "unit9.fleet.dev2"} {
+		if err := db.Put([]byte(topic), []byte(fmt.Sprintf(`{"temp":%d}`, i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Until(time.Unix(time.Now().Unix()+1, 0)) + 10*time.Millisecond)
+	if err := db.rollup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.rollup(); err != nil {
+		t.Fatal(err)
+	}
+	for topic, want := range map[string]float64{"unit9.fleet.1s.dev1": 3, "unit9.fleet.1s.dev2": 3} {
+		items, err := db.Get(NewQuery([]byte(topic)).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := 0.0
+		for _, item := range items {
+			s, ok := decodeNumber(item, "sum")
+			if !ok {
+				t.Fatalf("unexpected rollup %s", item)
+			}
+			sum += s
+		}
+		if sum != want {
+			t.Fatalf("expected sum %v of %s; got %v", want, topic, sum)
+		}
+	}
+	if items, err := db.Get(NewQuery([]byte("unit9.fleet.1s.1s.dev1"))); len(items) != 0 || err != nil {
+		t.Fatalf("expected no rollups of rollups; got %d, %v", len(items), err)
+	}
+	if _, err := Open(dbPath, WithRollup(Rollup{Source: rollup.Source, Target: rollup.Target})); err != errRollupInvalid {
+		t.Fatalf("expected %v; got %v", errRollupInvalid, err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{"unit10.logs.app1", "unit10.logs.app2", "unit10.billing"} {
+		for i := 0; i < 3; i++ {
+			if err := db.Put([]byte(topic), []byte(fmt.Sprintf("msg %d for %s", i, topic))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.SetRetention(RetentionPolicy{Topic: []byte("unit10.logs...")}); err != errRetentionInvalid {
+		t.Fatalf("expected %v; got %v", errRetentionInvalid, err)
+	}
+	if err := db.SetRetention(RetentionPolicy{Topic: []byte("unit10.logs..."), MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := db.Get(NewQuery([]byte("unit10.logs.app1"))); len(items) != 3 || err != nil {
+		t.Fatalf("expected 3; got %d, %v", len(items), err)
+	}
+	// replace the policy to cap the size of the topics.
+	if err := db.SetRetention(RetentionPolicy{Topic: []byte("unit10.logs..."), MaxSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(db.Retentions()); n != 1 {
+		t.Fatalf("expected 1; got %d", n)
+	}
+	if err := db.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"unit10.logs.app1", "unit10.logs.app2"} {
+		if items, err := db.Get(NewQuery([]byte(topic))); len(items) != 0 || err != nil {
+			t.Fatalf("expected 0; got %d, %v", len(items), err)
+		}
+	}
+	if items, err := db.Get(NewQuery([]byte("unit10.billing"))); len(items) != 3 || err != nil {
+		t.Fatalf("expected 3; got %d, %v", len(items), err)
+	}
+	db.RemoveRetention([]byte("unit10.logs..."), 0)
+	if n := len(db.Retentions()); n != 0 {
+		t.Fatalf("expected 0; got %d", n)
+	}
+
+	// window blocks older than the max age are deleted without reading the messages.
+	old := time.Now().Add(-2 * time.Hour)
+	// messages of unit10.events.a fill a window block so the window block next to the head block is marked.
+	for i := 0; i < entriesPerWindowBlock+5; i++ {
+		if err := db.PutEntry(NewEntry([]byte("unit10.events.a"), []byte("old msg")).WithTimestamp(old)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.PutEntry(NewEntry([]byte("unit10.events.b"), []byte("old msg")).WithTimestamp(old)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("unit10.events.b"), []byte("new msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the policy set with the option is applied after reopen.
+	db, err = Open(dbPath, WithRetention(RetentionPolicy{Topic: []byte("unit10.events..."), MaxAge: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := len(db.Retentions()); n != 1 {
+		t.Fatalf("expected 1; got %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.applyRetention(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if items, err := db.Get(NewQuery([]byte("unit10.events.a"))); len(items) != 0 || err != nil {
+		t.Fatalf("expected 0; got %d, %v", len(items), err)
+	}
+	if items, err := db.Get(NewQuery([]byte("unit10.events.b"))); len(items) != 1 || string(items[0]) != "new msg" || err != nil {
+		t.Fatalf("expected new msg; got %q, %v", items, err)
+	}
+	if n := len(db.internal.retention.pruned); n != 1 {
+		t.Fatalf("expected 1 pruned topic; got %d", n)
+	}
+	// the head window block is not marked as messages synced later are appended to it.
+	for h, off := range db.internal.retention.pruned {
+		if head, _ := db.internal.trie.getOffset(h); off == head {
+			t.Fatalf("expected window block other than the head block %d", head)
+		}
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit10.events.a"), []byte("old msg")).WithTimestamp(old)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.applyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := db.Get(NewQuery([]byte("unit10.events.a"))); len(items) != 0 || err != nil {
+		t.Fatalf("expected 0; got %d, %v", len(items), err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithFreeBlockSize(1<<16), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids [][]byte
+	for i := 0; i < 50; i++ {
+		id := db.NewID()
+		payload := []byte(fmt.Sprintf("msg %d %s", i, make([]byte, 1000)))
+		if err := db.PutEntry(NewEntry([]byte("unit11.a"), payload).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put([]byte("unit11.b"), payload); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// delete messages including the first message of the topic.
+	for _, id := range ids[:40] {
+		if err := db.DeleteEntry(NewEntry([]byte("unit11.a"), nil).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	it, err := db.Items(NewQuery([]byte("unit11.b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10 && it.Next(); i++ {
+	}
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := dataFile.Size()
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dataFile.Size() >= size {
+		t.Fatalf("expected data file size less than %d; got %d", size, dataFile.Size())
+	}
+	// iterator resumes after compaction.
+	count := 10
+	for it.Next() {
+		count++
+	}
+	if count != 50 || it.Err() != nil {
+		t.Fatalf("expected 50; got %d, %v", count, it.Err())
+	}
+
+	// messages are synced and deleted while the files are copied.
+	c, err := newCompaction(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.copy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 50; i < 55; i++ {
+		if err := db.Put([]byte("unit11.b"), []byte(fmt.Sprintf("msg %d %s", i, make([]byte, 1000)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// messages put to new time blocks release the time block of the messages so these are synced.
+	for deadline := time.Now().Add(5 * time.Second); len(c.changes.synced) < 5 && time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Put([]byte("unit11.c"), []byte("msg 0")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if synced := len(c.changes.synced); synced < 5 {
+		t.Fatalf("expected messages synced while the files are copied; got %d", synced)
+	}
+	if err := db.DeleteEntry(NewEntry([]byte("unit11.a"), nil).WithID(ids[49])); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.finish(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.close()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if items, err := db.Get(NewQuery([]byte("unit11.a")).WithLimit(100)); len(items) != 9 || err != nil {
+		t.Fatalf("expected 9; got %d, %v", len(items), err)
+	}
+	items, err := db.Get(NewQuery([]byte("unit11.b")).WithLimit(100))
+	if len(items) != 55 || err != nil {
+		t.Fatalf("expected 55; got %d, %v", len(items), err)
+	}
+	if !bytes.HasPrefix(items[0], []byte("msg 54 ")) {
+		t.Fatalf("unexpected message %.10s", items[0])
+	}
+}
+
+func TestCompactExpired(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first message of the topics expires.
+	for _, topic := range []string{"unit11.d", "unit11.e"} {
+		if err := db.Put([]byte(topic+"?ttl=1s"), []byte("msg 0")); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < 5; i++ {
+			if err := db.Put([]byte(topic), []byte(fmt.Sprintf("msg %d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReencryptAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// topics are loaded from the expired first message on open.
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, topic := range []string{"unit11.d", "unit11.e"} {
+		if items, err := db.Get(NewQuery([]byte(topic + "?last=1h"))); len(items) != 4 || err != nil {
+			t.Fatalf("expected 4 items of %s; got %d, %v", topic, len(items), err)
+		}
+	}
+}
+
+func TestCompactCommitted(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithMutable(), WithSegmentSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids [][]byte
+	for i := 0; i < 30; i++ {
+		id := db.NewID()
+		// random payload so the message size is not reduced by compression.
+		value := make([]byte, 100000)
+		if _, err := rand.Read(value); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry([]byte("unit11.f"), append([]byte(fmt.Sprintf("msg %d ", i)), value...)).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// reopen the DB twice so recovered entries are synced.
+	for i := 0; i < 2; i++ {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(dbPath, WithMutable()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range ids[5:] {
+		if err := db.DeleteEntry(NewEntry([]byte("unit11.f"), nil).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the DB is closed once the compaction is committed, before the files are swapped.
+	c, err := newCompaction(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.copy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	db.internal.syncLockC <- struct{}{}
+	if err := c.catchUp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.commit(); err != nil {
+		t.Fatal(err)
+	}
+	<-db.internal.syncLockC
+	c.close()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dbPath, compactManifest)); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := os.Stat(path.Join(dbPath, compactManifest)); !os.IsNotExist(err) {
+		t.Fatalf("expected manifest to be removed; got %v", err)
+	}
+	if _, err := os.Stat(filePath(dbPath, _FileDesc{fileType: typeData, num: 2})); !os.IsNotExist(err) {
+		t.Fatalf("expected segment to be removed; got %v", err)
+	}
+	if db.internal.freeList.size != 0 {
+		t.Fatalf("expected empty lease; got %d", db.internal.freeList.size)
+	}
+	items, err := db.Get(NewQuery([]byte("unit11.f")).WithLimit(100))
+	if len(items) != 5 || err != nil {
+		t.Fatalf("expected 5; got %d, %v", len(items), err)
+	}
+	for _, item := range items {
+		if !bytes.HasPrefix(item, []byte("msg ")) || len(item) < 100000 {
+			t.Fatalf("unexpected message %.10s", item)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithBufferSize(1<<16), WithMemdbSize(1<<16), WithMutable(), WithSegmentSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids [][]byte
+	for i := 0; i < 30; i++ {
+		id := db.NewID()
+		// random payload so the message size is not reduced by compression.
+		value := make([]byte, 100000)
+		if _, err := rand.Read(value); err != nil {
+			t.Fatal(err)
+		}
+		payload := append([]byte(fmt.Sprintf("msg %d ", i)), value...)
+		if err := db.PutEntry(NewEntry([]byte("unit12.a"), payload).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte("unit12.b"), []byte(fmt.Sprintf("msg %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reopen the DB twice so recovered entries are synced.
+	for i := 0; i < 2; i++ {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(dbPath, WithMutable()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filePath(dbPath, _FileDesc{fileType: typeData, num: 2})); err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.Get(NewQuery([]byte("unit12.a")).WithLimit(100))
+	if len(items) == 0 || err != nil {
+		t.Fatalf("expected messages; got %d, %v", len(items), err)
+	}
+	// messages are read from the segments of the message offsets.
+	for _, item := range items {
+		if !bytes.HasPrefix(item, []byte("msg ")) || len(item) < 100000 {
+			t.Fatalf("unexpected message %.10s", item)
+		}
+	}
+	b, err := db.Get(NewQuery([]byte("unit12.b")).WithLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if err := db.DeleteEntry(NewEntry([]byte("unit12.a"), nil).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.dropSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filePath(dbPath, _FileDesc{fileType: typeData, num: 0})); !os.IsNotExist(err) {
+		t.Fatalf("expected segment to be removed; got %v", err)
+	}
+	// messages of the removed segment are read as deleted.
+	if _, err := db.internal.reader.dataFile.slice(0, int64(idSize)); err != errMsgIDDeleted {
+		t.Fatalf("expected %v; got %v", errMsgIDDeleted, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if items, err := db.Get(NewQuery([]byte("unit12.a")).WithLimit(100)); len(items) != 0 || err != nil {
+		t.Fatalf("expected 0; got %d, %v", len(items), err)
+	}
+	if items, err := db.Get(NewQuery([]byte("unit12.b")).WithLimit(100)); len(items) != len(b) || err != nil {
+		t.Fatalf("expected %d; got %d, %v", len(b), len(items), err)
+	}
+}
+
+// backupWriter calls fn on the first write to the writer.
+type backupWriter struct {
+	w    io.Writer
+	fn   func() error
+	err  error
+	done bool
+}
+
+func (w *backupWriter) Write(p []byte) (int, error) {
+	if !w.done {
+		w.done = true
+		w.err = w.fn()
+	}
+	return w.w.Write(p)
+}
+
+func TestBackup(t *testing.T) {
+	cleanup()
+	restorePath := dbPath + "-restore"
+	os.RemoveAll(restorePath)
+	defer os.RemoveAll(restorePath)
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put([]byte("unit13.a"), []byte(fmt.Sprintf("msg %d hello world", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit13.b"), []byte("msg hello world")).WithDedupKey([]byte("k1"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items, err := db.Get(NewQuery([]byte("unit13.a")).WithLimit(100))
+	if len(items) == 0 || err != nil {
+		t.Fatalf("expected messages; got %d, %v", len(items), err)
+	}
+	// sync is not blocked while the files are copied, entries synced after the snapshot are not in the backup.
+	var buf bytes.Buffer
+	w := &backupWriter{w: &buf, fn: func() error {
+		if err := db.Put([]byte("unit13.a"), []byte("msg 20 hello world")); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return db.SyncContext(ctx)
+	}}
+	if err := db.Backup(w); err != nil {
+		t.Fatal(err)
+	}
+	if w.err != nil {
+		t.Fatal(w.err)
+	}
+	if err := VerifyBackup(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte(nil), buf.Bytes()...)
+	corrupted[1024] ^= 0xff
+	if err := VerifyBackup(bytes.NewReader(corrupted)); err != errBackupCorrupted {
+		t.Fatalf("expected %v; got %v", errBackupCorrupted, err)
+	}
+	if err := Restore(bytes.NewReader(buf.Bytes()), dbPath); err != errRestoreNotEmpty {
+		t.Fatalf("expected %v; got %v", errRestoreNotEmpty, err)
+	}
+	if err := Restore(bytes.NewReader(buf.Bytes()), restorePath); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(restorePath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if got, err := restored.Get(NewQuery([]byte("unit13.a")).WithLimit(100)); !reflect.DeepEqual(got, items) || err != nil {
+		t.Fatalf("expected %d messages; got %d, %v", len(items), len(got), err)
+	}
+	// dedup keys are restored.
+	if err := restored.PutEntry(NewEntry([]byte("unit13.b"), []byte("msg hello world")).WithDedupKey([]byte("k1"))); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := restored.Get(NewQuery([]byte("unit13.b?last=1h"))); len(got) != 1 || err != nil {
+		t.Fatalf("expected 1 message; got %d, %v", len(got), err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithWatchBuffer(2, WatchDropOldest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all, err := db.Watch(ctx, []byte("unit14..."), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, err := db.Watch(ctx, []byte("unit14.*.b"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Put([]byte("unit14.a"), []byte(fmt.Sprintf("msg %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the oldest entry is dropped if the buffer is full.
+	for i := 1; i < 3; i++ {
+		e := <-all
+		if string(e.Topic) != "unit14.a" || string(e.Payload) != fmt.Sprintf("msg %d", i) {
+			t.Fatalf("unexpected entry %s %s", e.Topic, e.Payload)
+		}
+	}
+	select {
+	case e := <-one:
+		t.Fatalf("unexpected entry %s %s", e.Topic, e.Payload)
+	default:
+	}
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		return b.Put([]byte("unit14.c.b"), []byte("msg 3"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []<-chan Entry{one, all} {
+		if e := <-c; string(e.Topic) != "unit14.c.b" || string(e.Payload) != "msg 3" {
+			t.Fatalf("unexpected entry %s %s", e.Topic, e.Payload)
+		}
+	}
+	// channel is closed once the context is done.
+	cancel()
+	for range one {
+	}
+}
+
+// _PrefixCodec is a codec of a type that is not comparable.
+type _PrefixCodec struct {
+	prefix []byte
+}
+
+func (c _PrefixCodec) ID() uint8 { return CodecCustom + 2 }
+
+func (c _PrefixCodec) Encode(dst, src []byte) []byte {
+	return append(append(dst, c.prefix...), src...)
+}
+
+func (c _PrefixCodec) Decode(dst, src []byte) ([]byte, error) {
+	return append(dst, src[len(c.prefix):]...), nil
+}
+
+func TestCodecs(t *testing.T) {
+	cleanup()
+	if _, err := Open(dbPath, WithCodecs(NewZstdCodec(maxCodecID+1, nil))); err != errCodecIDRange {
+		t.Fatalf("expected %v; got %v", errCodecIDRange, err)
+	}
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit15.a"), []byte("snappy msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	custom := NewZstdCodec(CodecCustom, nil)
+	prefix := _PrefixCodec{prefix: []byte("p:")}
+	db, err = Open(dbPath, WithCodec(CodecZstd), WithTopicCodec("unit15.c", custom), WithCodecs(prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("unit15.b"), []byte("zstd msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit15.c"), []byte("dict msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit15.d"), []byte("raw msg")).WithCodec(CodecNone)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit15.e"), []byte("prefix msg")).WithCodec(prefix)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit15.d"), []byte("msg")).WithCodec(NewZstdCodec(CodecCustom+1, nil))); err != errCodecUnknown {
+		t.Fatalf("expected %v; got %v", errCodecUnknown, err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for topic, msg := range map[string]string{"unit15.a": "snappy msg", "unit15.b": "zstd msg", "unit15.c": "dict msg", "unit15.d": "raw msg", "unit15.e": "prefix msg"} {
+		items, err := db.Get(NewQuery([]byte(topic)).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 || string(items[0]) != msg {
+			t.Fatalf("expected %s; got %q", msg, items)
+		}
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	cleanup()
+	key0 := EncryptionKey{ID: 0, Key: []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m60")}
+	key1 := EncryptionKey{ID: 1, Key: []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m61")}
+	db, err := Open(dbPath, WithMutable(), WithEncryption(), WithEncryptionKey(key0.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit16.a"), []byte("msg encrypted with key 0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dbPath, WithMutable(), WithEncryption(), WithKeyring(key1, key0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit16.b"), []byte("msg encrypted with key 1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReencryptAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries are readable once the old key is removed from the keyring.
+	db, err = Open(dbPath, WithMutable(), WithEncryption(), WithKeyring(key1), WithEncryptionKey([]byte("4BWm1vZletvrCDGWsF6mex8oBSd59m62")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for topic, msg := range map[string]string{"unit16.a": "msg encrypted with key 0", "unit16.b": "msg encrypted with key 1"} {
+		items, err := db.Get(NewQuery([]byte(topic)).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 || string(items[0]) != msg {
+			t.Fatalf("expected %s; got %q", msg, items)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte("unit17.a"), []byte(fmt.Sprintf("msg %d hello world", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.Verify(context.Background(), func(p VerifyProgress) { n++ }); err != nil || n == 0 {
+		t.Fatalf("expected verified blocks; got %d, %v", n, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := func(name string, off int64) {
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if off < 0 {
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			off += fi.Size()
+		}
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0xff
+		if _, err := f.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// corrupt checksum of the last message and an index block.
+	corrupt(dbPath+"/data/unitdb0000.data", -1)
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var bad []VerifyProgress
+	err = db.Verify(context.Background(), func(p VerifyProgress) {
+		if p.Err != nil {
+			bad = append(bad, p)
+		}
+	})
+	if e, ok := err.(*ErrCorrupted); !ok || e.File != dataDir || len(bad) != 1 {
+		t.Fatalf("expected corrupted data file; got %v, %v", err, bad)
+	}
+	if _, err := db.Get(NewQuery([]byte("unit17.a")).WithLimit(10)); err == nil {
+		t.Fatal("expected corrupted message error")
+	}
+	corrupt(dbPath+"/index/unitdb0000.index", 100)
+	if err, ok := db.Verify(context.Background(), nil).(*ErrCorrupted); !ok || err.File != indexDir || err.Offset != 0 {
+		t.Fatalf("expected corrupted index file; got %v", err)
+	}
+
+	// an all-zero block is not valid.
+	f, err := os.OpenFile(dbPath+"/index/unitdb0000.index", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, blockSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err, ok := db.Verify(context.Background(), nil).(*ErrCorrupted); !ok || err.File != indexDir || err.Offset != 0 {
+		t.Fatalf("expected corrupted zero index block; got %v", err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	cleanup()
+	put := func(topic string) {
+		db, err := Open(dbPath, WithMutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := db.Put([]byte(topic), []byte(fmt.Sprintf("msg %d hello world", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// entries are synced to the files on open.
+	put("unit18.a")
+	put("unit18.b")
+	fi, err := os.Stat(dbPath + "/data/unitdb0000.data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Repair(dbPath); err != errLocked {
+		t.Fatalf("expected %v; got %v", errLocked, err)
+	}
+	db.Close()
+
+	corrupt := func(name string, off int64) {
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte{0xff}, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// corrupt the header, checksum of the last message of topic a and the window block of topic b.
+	corrupt(dbPath+"/unitdb.info", 0)
+	corrupt(dbPath+"/data/unitdb0000.data", fi.Size()-1)
+	wi, err := os.Stat(dbPath + "/window/unitdb0000.win")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt(dbPath+"/window/unitdb0000.win", wi.Size()-int64(blockSize)+10)
+	if err := ioutil.WriteFile(dbPath+"/logs/123.log", []byte("not a log"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Header || len(report.Logs) != 1 || len(report.Messages) != 1 || len(report.WindowBlocks) != 1 || report.Topics != 2 || report.Orphans != 9 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, err := os.Stat(report.Dir + "/" + reportName); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for topic, n := range map[string]int{"unit18.a": 9, "unit18.b": 1} {
+		if items, err := db.Get(NewQuery([]byte(topic)).WithLimit(100)); len(items) != n || err != nil {
+			t.Fatalf("expected %d messages of %s; got %d, %v", n, topic, len(items), err)
+		}
+	}
+	if err := db.Verify(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeWindow(t *testing.T) {
+	for _, repair := range []bool{false, true} {
+		cleanup()
+		// entries are synced to the files on open.
+		for i := 0; i < 2; i++ {
+			db, err := Open(dbPath, WithMutable())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; i == 0 && j < 400; j++ {
+				if err := db.Put([]byte("unit18.w"), []byte(fmt.Sprintf("msg %d", j))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// window file of version 1, the first block of the topic is the first block of the file and the next block links to it.
+		fs, err := newFile(dbPath, 1, _FileDesc{fileType: typeTimeWindow}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		winFile := fs._File
+		if winFile.currSize() != 3*int64(blockSize) {
+			t.Fatalf("expected 3 window blocks; got size %d", winFile.currSize())
+		}
+		r := _WindowReader{winFile: winFile, offset: int64(blockSize)}
+		first, err := r.readWindowBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.offset = 2 * int64(blockSize)
+		next, err := r.readWindowBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		next.next = 0
+		if _, err := winFile.WriteAt(append(first.marshalBinary(), next.marshalBinary()...), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := winFile.truncate(2 * int64(blockSize)); err != nil {
+			t.Fatal(err)
+		}
+		winFile.Close()
+		infoFile, err := newFile(dbPath, 1, _FileDesc{fileType: typeInfo}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info _DBInfo
+		if err := infoFile.readUnmarshalableAt(&info, fixed, 0); err != nil {
+			t.Fatal(err)
+		}
+		info.header.version = 1
+		if err := infoFile.writeMarshalableAt(info, 0); err != nil {
+			t.Fatal(err)
+		}
+		infoFile.Close()
+
+		if _, err := Open(dbPath, WithReadOnly()); err != errUpgradeRequired {
+			t.Fatalf("expected %v; got %v", errUpgradeRequired, err)
+		}
+		if repair {
+			if _, err := Repair(dbPath); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db, err := Open(dbPath, WithMutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.internal.dbInfo.header.version != version {
+			t.Fatalf("expected version %d; got %d", version, db.internal.dbInfo.header.version)
+		}
+		if items, err := db.Get(NewQuery([]byte("unit18.w?last=1h")).WithLimit(1000)); len(items) != 400 || err != nil {
+			t.Fatalf("expected 400; got %d, %v", len(items), err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	cleanup()
+	if _, err := Open(dbPath, WithReadOnly()); err == nil {
+		t.Fatal("expected error opening a DB that does not exist read-only")
+	}
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(topic []byte, n int) {
+		for i := 0; i < n; i++ {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg %d hello world", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// reopen the writer to sync the entries.
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(dbPath, WithMutable()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put([]byte("unit19.a"), 10)
+	defer func() { db.Close() }()
+
+	rdb, err := Open(dbPath, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	if rdb.internal.mem != nil {
+		t.Fatal("expected no blockcache for a read-only DB")
+	}
+	items, err := rdb.Get(NewQuery([]byte("unit19.a?last=1h")))
+	if err != nil || len(items) != 10 {
+		t.Fatalf("expected 10 items; got %d, %v", len(items), err)
+	}
+	if err := rdb.Put([]byte("unit19.a"), []byte("hello")); err != errImmutable {
+		t.Fatalf("expected errImmutable; got %v", err)
+	}
+
+	put([]byte("unit19.b"), 5)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Repair(dbPath); err != errLocked {
+		t.Fatalf("expected errLocked with a reader; got %v", err)
+	}
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	items, err = rdb.Get(NewQuery([]byte("unit19.b?last=1h")))
+	if err != nil || len(items) != 5 {
+		t.Fatalf("expected 5 items of the new topic after refresh; got %d, %v", len(items), err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit20.a")
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err := db.PutEntryContext(ctx, NewEntry(topic, []byte(fmt.Sprintf("msg %d hello world", i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SyncContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.GetContext(ctx, NewQuery(append(topic, []byte("?last=1h")...)))
+	if err != nil || len(items) != 10 {
+		t.Fatalf("expected 10 items; got %d, %v", len(items), err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := db.GetContext(cancelled, NewQuery(append(topic, []byte("?last=1h")...))); err != context.Canceled {
+		t.Fatalf("expected context.Canceled from GetContext; got %v", err)
+	}
+	if err := db.PutEntryContext(cancelled, NewEntry(topic, []byte("hello"))); err != context.Canceled {
+		t.Fatalf("expected context.Canceled from PutEntryContext; got %v", err)
+	}
+	if err := db.SyncContext(cancelled); err != context.Canceled {
+		t.Fatalf("expected context.Canceled from SyncContext; got %v", err)
+	}
+	err = db.BatchContext(cancelled, func(b *Batch, completed <-chan struct{}) error {
+		return b.Put(topic, []byte("hello"))
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled from BatchContext; got %v", err)
+	}
+
+	// batch is rolled back if the context is done before the batch is written.
+	bctx, bcancel := context.WithCancel(ctx)
+	err = db.BatchContext(bctx, func(b *Batch, completed <-chan struct{}) error {
+		if err := b.Put(topic, []byte("rolled back")); err != nil {
+			return err
+		}
+		bcancel()
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled from batch commit; got %v", err)
+	}
+	items, err = db.Get(NewQuery(append(topic, []byte("?last=1h")...)))
+	if err != nil || len(items) != 10 {
+		t.Fatalf("expected 10 items; got %d, %v", len(items), err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		e := NewEntry([]byte(fmt.Sprintf("unit21.%d", i%2)), []byte(fmt.Sprintf("msg %d hello world", i))).WithContract(contract)
+		if i == 0 {
+			e.WithTTL([]byte("1h"))
+		}
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	query := func(db *DB) (entries []Entry) {
+		for _, topic := range []string{"unit21.0", "unit21.1"} {
+			e, err := db.GetEntries(NewQuery([]byte(topic + "?last=1h")).WithContract(contract))
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, e...)
+		}
+		return entries
+	}
+	want := query(db)
+	if len(want) != 10 {
+		t.Fatalf("expected 10 entries; got %d", len(want))
+	}
+
+	for _, format := range []TransferFormat{FormatJSONLines, FormatCSV} {
+		var buf bytes.Buffer
+		n, err := db.Export(&buf, ExportSpec{Format: format, Contract: contract})
+		if err != nil || n != 10 {
+			t.Fatalf("%s: expected 10 exported entries; got %d, %v", format, n, err)
+		}
+		importPath := dbPath + "-import"
+		os.RemoveAll(importPath)
+		idb, err := Open(importPath, WithMutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := idb.Import(&buf, ImportSpec{Format: format, BatchSize: 3}); err != nil || n != 10 {
+			t.Fatalf("%s: expected 10 imported entries; got %d, %v", format, n, err)
+		}
+		got := query(idb)
+		if len(got) != len(want) {
+			t.Fatalf("%s: expected %d entries; got %d", format, len(want), len(got))
+		}
+		for i := range want {
+			if !bytes.Equal(got[i].ID, want[i].ID) || !bytes.Equal(got[i].Topic, want[i].Topic) || !bytes.Equal(got[i].Payload, want[i].Payload) ||
+				got[i].ExpiresAt != want[i].ExpiresAt || !got[i].Timestamp.Equal(want[i].Timestamp) {
+				t.Fatalf("%s: expected entry %+v; got %+v", format, want[i], got[i])
+			}
+		}
+		// new entries do not reuse seqs of imported entries.
+		if seq := message.ID(idb.NewID()).Sequence(); seq <= message.ID(want[0].ID).Sequence() {
+			t.Fatalf("%s: expected seq larger than imported seqs; got %d", format, seq)
+		}
+		idb.Close()
+		os.RemoveAll(importPath)
+	}
+
+	// exported IDs are not imported into a DB that stores entries with the seqs of the IDs.
+	var buf bytes.Buffer
+	if _, err := db.Export(&buf, ExportSpec{Contract: contract}); err != nil {
+		t.Fatal(err)
+	}
+	importPath := dbPath + "-import"
+	os.RemoveAll(importPath)
+	defer os.RemoveAll(importPath)
+	idb, err := Open(importPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idb.Close()
+	for i := 0; i < 3; i++ {
+		if err := idb.Put([]byte("unit21.b"), []byte(fmt.Sprintf("msg %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := idb.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := idb.Import(bytes.NewReader(buf.Bytes()), ImportSpec{}); err == nil || n != 0 {
+		t.Fatalf("expected import error; got %d, %v", n, err)
+	}
+	if n, err := idb.Import(bytes.NewReader(buf.Bytes()), ImportSpec{NewIDs: true}); err != nil || n != 10 {
+		t.Fatalf("expected 10 imported entries with new IDs; got %d, %v", n, err)
+	}
+	if err := idb.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := idb.Get(NewQuery([]byte("unit21.b?last=1h"))); err != nil || len(items) != 3 {
+		t.Fatalf("expected 3 items; got %d, %v", len(items), err)
+	}
+	if got := query(idb); len(got) != 10 {
+		t.Fatalf("expected 10 imported entries; got %d", len(got))
+	}
+
+	if _, err := db.Export(ioutil.Discard, ExportSpec{Format: "xml"}); err != errFormatInvalid {
+		t.Fatalf("expected %v; got %v", errFormatInvalid, err)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := []string{"unit22.a", "unit22.b", "unit23.c"}
+	for i := 0; i < 30; i++ {
+		if err := db.Put([]byte(topics[i%3]), []byte(fmt.Sprintf("msg %d hello world", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reopen the DB to sync the entries.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	entries, err := db.GetEntries(NewQuery([]byte("unit22.a?last=1h")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(entries[0].ID, []byte("unit22.a")); err != nil {
+		t.Fatal(err)
+	}
+
+	newQueries := func() []*Query {
+		return []*Query{
+			NewQuery([]byte("unit22.a?last=1h")).WithLimit(5),
+			NewQuery([]byte("unit22.b?last=1h")),
+			NewQuery(nil),
+			NewQuery([]byte("unit23.c?last=1h")).WithLimit(3),
+		}
+	}
+	results, err := db.GetMulti(newQueries())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results; got %d", len(results))
+	}
+	if results[2].Err != errTopicEmpty {
+		t.Fatalf("expected %v; got %v", errTopicEmpty, results[2].Err)
+	}
+	for i, q := range newQueries() {
+		if i == 2 {
+			continue
+		}
+		want, err := db.Get(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[i].Err != nil || !reflect.DeepEqual(results[i].Items, want) {
+			t.Fatalf("query %d: expected %q; got %q, %v", i, want, results[i].Items, results[i].Err)
+		}
+	}
+	if len(results[1].Items) != 10 || len(results[3].Items) != 3 {
+		t.Fatalf("expected 10 and 3 items; got %d and %d", len(results[1].Items), len(results[3].Items))
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit24.a")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	past := now.Add(-2 * time.Hour).Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("old %d", i))).WithTimestamp(past.Add(time.Duration(i) * time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("invalid")).WithTimestamp(time.Unix(0, 0))); err != errTimestampInvalid {
+		t.Fatalf("expected %v; got %v", errTimestampInvalid, err)
+	}
+
+	verify := func() {
+		items, err := db.Get(NewQuery([]byte("unit24.a?last=1h")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 10 {
+			t.Fatalf("expected 10 items in the last hour; got %d", len(items))
+		}
+		items, err = db.Get(NewQuery(topic).WithLimit(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := [][]byte{[]byte("msg 9"), []byte("msg 8"), []byte("msg 7")}; !reflect.DeepEqual(items, want) {
+			t.Fatalf("expected %q; got %q", want, items)
+		}
+		entries, err := db.GetEntries(NewQuery(topic).WithRange(now.Add(-3*time.Hour), now.Add(-time.Hour)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 5 {
+			t.Fatalf("expected 5 entries in the range; got %d", len(entries))
+		}
+		for i, e := range entries {
+			if want := fmt.Sprintf("old %d", 4-i); string(e.Payload) != want {
+				t.Fatalf("expected %s; got %s", want, e.Payload)
+			}
+			if want := past.Add(time.Duration(4-i) * time.Minute); !e.Timestamp.Equal(want) {
+				t.Fatalf("expected timestamp %v; got %v", want, e.Timestamp)
+			}
+		}
+	}
+	verify()
+	// reopen the DB to sync the entries.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify()
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	verify()
+}
+
+func TestDedup(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable(), WithDedupWindow(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(topic, key string) {
+		if err := db.PutEntry(NewEntry([]byte(topic), []byte("msg "+key)).WithDedupKey([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(topic string, want int) {
+		items, err := db.Get(NewQuery([]byte(topic + "?last=1h")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != want {
+			t.Fatalf("expected %d items of %s; got %d", want, topic, len(items))
+		}
+	}
+	put("unit25.a", "k1")
+	put("unit25.a", "k1")
+	put("unit25.b", "k1")
+	put("unit25.a", "k2")
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		for _, key := range []string{"k1", "k3", "k3"} {
+			if err := b.PutEntry(NewEntry([]byte("unit25.a"), []byte("msg "+key)).WithDedupKey([]byte(key))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count("unit25.a", 3)
+	count("unit25.b", 1)
+
+	// dedup keys are recovered from the write ahead log without the dedup file.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filePath(dbPath, _FileDesc{fileType: typeDedup})); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable(), WithDedupWindow(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	put("unit25.a", "k1")
+	count("unit25.a", 3)
+
+	// dedup keys of synced entries are read from the dedup file.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable(), WithDedupWindow(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	put("unit25.a", "k3")
+	put("unit25.a", "k4")
+	count("unit25.a", 4)
+}
+
+func TestReplace(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit26.replace")
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	replace := func(i int, payload string) {
+		if err := db.PutEntry(NewEntry(topic, []byte(payload)).WithID(ids[i]).WithReplace()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verify := func(want ...string) {
+		entries, err := db.GetEntries(NewQuery(append(topic, []byte("?last=1h")...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(want) {
+			t.Fatalf("expected %d items; got %d", len(want), len(entries))
+		}
+		for i, e := range entries {
+			if string(e.Payload) != want[i] {
+				t.Fatalf("expected item %d to be %s; got %s", i, want[i], e.Payload)
+			}
+			if !bytes.Equal(e.ID, ids[len(ids)-1-i]) {
+				t.Fatalf("expected item %d to keep its ID", i)
+			}
+		}
+	}
+
+	// entry not yet synced is replaced in the memdb.
+	replace(1, "fix.1")
+	verify("msg. 2", "fix.1", "msg. 0")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	verify("msg. 2", "fix.1", "msg. 0")
+
+	// synced entries are replaced in place, the first entry of the topic keeps the topic.
+	freeSize := db.internal.freeList.size
+	replace(0, "fix.0")
+	replace(1, "fix.11")
+	if db.internal.freeList.size <= freeSize {
+		t.Fatal("expected data blocks of the replaced entries to be freed")
+	}
+	verify("msg. 2", "fix.11", "fix.0")
+	if count := db.Count(); count != 3 {
+		t.Fatalf("expected count 3; got %d", count)
+	}
+
+	if err := db.PutEntry(NewEntry([]byte("unit26.other"), []byte("msg")).WithID(ids[2]).WithReplace()); err != errMsgIDPrefixMismatch {
+		t.Fatalf("expected error %v; got %v", errMsgIDPrefixMismatch, err)
+	}
+	if err := db.Delete(ids[2], topic); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(ids[2]).WithReplace()); err != errMsgIDDoesNotExist {
+		t.Fatalf("expected error %v; got %v", errMsgIDDoesNotExist, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ids = ids[:2]
+	verify("fix.11", "fix.0")
+}
+
+func TestDeleteRange(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, topic := range []string{"unit27.dev42.temp", "unit27.dev42.gps", "unit27.dev43.temp"} {
+		for i := 3; i > 0; i-- {
+			e := NewEntry([]byte(topic), []byte(fmt.Sprintf("msg.%2d", i))).WithTimestamp(now.Add(-time.Duration(i) * time.Hour))
+			if err := db.PutEntry(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	count := func(topic string, want int) {
+		items, err := db.Get(NewQuery([]byte(topic + "?last=5h")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != want {
+			t.Fatalf("expected %d items of %s; got %d", want, topic, len(items))
+		}
+	}
+	if err := db.DeleteRange([]byte("unit27.dev43.temp"), 0, now, now.Add(-time.Hour)); err != errRangeInvalid {
+		t.Fatalf("expected error %v; got %v", errRangeInvalid, err)
+	}
+	if err := db.DeleteRange([]byte("unit27.dev42..."), 0, time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteRange([]byte("unit27.dev43.temp"), 0, time.Time{}, now.Add(-90*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// messages put after the range is deleted are kept.
+	if err := db.Put([]byte("unit27.dev42.temp"), []byte("msg. 0")); err != nil {
+		t.Fatal(err)
+	}
+	verify := func() {
+		count("unit27.dev42.temp", 1)
+		count("unit27.dev42.gps", 0)
+		count("unit27.dev43.temp", 1)
+	}
+	verify()
+
+	// tombstones are read from the tombstone file.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	verify()
+	if count := db.Count(); count != 10 {
+		t.Fatalf("expected count 10; got %d", count)
+	}
+
+	// messages of tombstones are deleted in the background.
+	if err := db.purgeTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(db.internal.tombstones.list()); n != 0 {
+		t.Fatalf("expected tombstones to be removed; got %d", n)
+	}
+	if count := db.Count(); count != 2 {
+		t.Fatalf("expected count 2; got %d", count)
+	}
+	verify()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify()
+}
+
+func TestLastValue(t *testing.T) {
+	cleanup()
+	db, err := Open(dbPath, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Latest([]byte("unit28.dev1.temp"), 0); err != errLastValueDisabled {
+		t.Fatalf("expected error %v; got %v", errLastValueDisabled, err)
+	}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := db.Put([]byte("unit28.dev1.temp"), []byte(fmt.Sprintf("temp.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last-value cache is rebuilt if it is enabled on an existing DB.
+	if db, err = Open(dbPath, WithMutable(), WithLastValueCache()); err != nil {
+		t.Fatal(err)
+	}
+	latest := func(topic, want string) *Entry {
+		e, err := db.Latest([]byte(topic), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case want == "" && e != nil:
+			t.Fatalf("expected no message of %s; got %s", topic, e.Payload)
+		case want != "" && (e == nil || string(e.Payload) != want):
+			t.Fatalf("expected latest message %s of %s; got %v", want, topic, e)
+		}
+		return e
+	}
+	latest("unit28.dev1.temp", "temp. 2")
+
+	if err := db.PutEntry(NewEntry([]byte("unit28.dev1.gps"), []byte("gps.-2")).WithTimestamp(now.Add(-2 * time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit28.dev1.gps"), []byte("gps. 0")); err != nil {
+		t.Fatal(err)
+	}
+	// an older message does not replace the latest message.
+	if err := db.PutEntry(NewEntry([]byte("unit28.dev1.gps"), []byte("gps.-1")).WithTimestamp(now.Add(-time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		for i := 3; i < 5; i++ {
+			if err := b.Put([]byte("unit28.dev2.temp"), []byte(fmt.Sprintf("temp.%2d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest("unit28.dev1.gps", "gps. 0")
+	latest("unit28.dev2.temp", "temp. 4")
+	latest("unit28.dev3.temp", "")
+	if _, err := db.Latest([]byte("unit28.*.temp"), 0); err != errBadRequest {
+		t.Fatalf("expected error %v; got %v", errBadRequest, err)
+	}
+	verify := func() {
+		entries, err := db.LatestMatching([]byte("unit28.*.temp"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || string(entries[0].Topic) != "unit28.dev1.temp" || string(entries[1].Payload) != "temp. 4" {
+			t.Fatalf("expected latest messages of 2 topics; got %v", entries)
+		}
+	}
+	verify()
+
+	// the previous message is the latest message if the latest message is deleted.
+	e := latest("unit28.dev1.gps", "gps. 0")
+	if err := db.DeleteEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	latest("unit28.dev1.gps", "gps.-1")
+
+	// the last-value cache is read from the last-value file.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbPath, WithMutable(), WithLastValueCache()); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := len(db.internal.lastValues.values); n != 3 {
+		t.Fatalf("expected 3 topics in the last-value cache; got %d", n)
+	}
+	latest("unit28.dev1.gps", "gps.-1")
+	verify()
+
+	// the latest messages are read for the contract of the topics.
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit28.dev1.temp"), []byte("temp.c1")).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := db.Latest([]byte("unit28.dev1.temp"), contract); err != nil || e == nil || string(e.Payload) != "temp.c1" {
+		t.Fatalf("expected latest message temp.c1 of the contract; got %v, %v", e, err)
+	}
+	if entries, err := db.LatestMatching([]byte("unit28.*.temp"), contract); err != nil || len(entries) != 1 || string(entries[0].Payload) != "temp.c1" {
+		t.Fatalf("expected latest message of 1 topic of the contract; got %v, %v", entries, err)
+	}
+	verify()
+}
+
+func TestTopicCompaction(t *testing.T) {
+	cleanup()
+	compaction := TopicCompaction{Topic: []byte("unit29.state..."), KeepLatest: 2}
+	if _, err := Open(dbPath, WithTopicCompaction(TopicCompaction{Topic: compaction.Topic})); err != errCompactionInvalid {
+		t.Fatalf("expected error %v; got %v", errCompactionInvalid, err)
+	}
+	db, err := Open(dbPath, WithMutable(), WithTopicCompaction(compaction))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, topic := range []string{"unit29.state.dev1", "unit29.state.dev2", "unit29.log.dev1"} {
+		for i := 0; i < 5; i++ {
+			e := NewEntry([]byte(topic), []byte(fmt.Sprintf("msg.%2d", i))).WithTimestamp(now.Add(time.Duration(i-5) * time.Minute))
+			if err := db.PutEntry(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// an older message is superseded by the newest messages.
+	if err := db.PutEntry(NewEntry([]byte("unit29.state.dev2"), []byte("msg.-1")).WithTimestamp(now.Add(-time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	verify := func(topic string, want ...string) {
+		items, err := db.Get(NewQuery([]byte(topic + "?last=2h")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != len(want) {
+			t.Fatalf("expected %d items of %s; got %d", len(want), topic, len(items))
+		}
+		for i, item := range items {
+			if string(item) != want[i] {
+				t.Fatalf("expected item %s of %s; got %s", want[i], topic, item)
+			}
+		}
+	}
+	// messages are synced on recovery and topics are compacted once they are synced.
+	reopen := func() {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(dbPath, WithMutable(), WithTopicCompaction(compaction)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.compactTopics(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopen()
+	verify("unit29.state.dev1", "msg. 4", "msg. 3")
+	verify("unit29.state.dev2", "msg. 4", "msg. 3")
+	verify("unit29.log.dev1", "msg. 4", "msg. 3", "msg. 2", "msg. 1", "msg. 0")
+	if count := db.Count(); count != 9 {
+		t.Fatalf("expected count 9; got %d", count)
+	}
+
+	if err := db.Put([]byte("unit29.state.dev1"), []byte("msg. 5")); err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	defer db.Close()
+	verify("unit29.state.dev1", "msg. 5", "msg. 4")
+	verify("unit29.state.dev2", "msg. 4", "msg. 3")
+	if count := db.Count(); count != 9 {
+		t.Fatalf("expected count 9; got %d", count)
+	}
+
+	// topics synced since the last compaction are compacted without walking all messages of the topic.
+	if err := db.Put([]byte("unit29.state.dev1"), []byte("msg. 6")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		tc := db.internal.topicCompactions
+		tc.Lock()
+		n := len(tc.synced)
+		tc.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := db.Put([]byte("unit29.log.dev2"), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.compactTopics(); err != nil {
+		t.Fatal(err)
+	}
+	verify("unit29.state.dev1", "msg. 6", "msg. 5")
+}
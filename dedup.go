@@ -0,0 +1,178 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/hash"
+)
+
+const (
+	// dedupRecordSize is the size of the dedup record (hash and expiry) of an entry put with a dedup key.
+	dedupRecordSize = 12
+)
+
+// _Dedup is an index of dedup keys of the entries put within the dedup window.
+// A dedup record is stored after the message of the entry in the write ahead log
+// and records of synced entries are appended to the dedup file, so the index is recovered on open.
+type _Dedup struct {
+	sync.Mutex
+	file    _FileSet
+	window  time.Duration
+	keys    map[uint64]uint32 // map[hash]expiresAt
+	records []byte            // records of synced entries not yet appended to the dedup file.
+}
+
+func newDedup(fs _FileSet, window time.Duration) *_Dedup {
+	return &_Dedup{file: fs, window: window, keys: make(map[uint64]uint32)}
+}
+
+// dedupHash returns the hash of the dedup key of an entry of the contract and the topic.
+func dedupHash(contract uint32, topicHash uint64, key []byte) uint64 {
+	b := make([]byte, 12+len(key))
+	binary.LittleEndian.PutUint32(b[0:4], contract)
+	binary.LittleEndian.PutUint64(b[4:12], topicHash)
+	copy(b[12:], key)
+	return uint64(hash.New(b))<<32 | uint64(hash.WithSalt(b, contract))
+}
+
+// dedupRecord returns the dedup record stored after the message of the memdb entry if any.
+func dedupRecord(data []byte, e _IndexEntry) []byte {
+	off := entrySize + e.mSize()
+	if uint32(len(data)) < off+dedupRecordSize {
+		return nil
+	}
+	return data[off : off+dedupRecordSize]
+}
+
+// add adds the hash to the index, it returns false if the hash was added within the dedup window.
+func (d *_Dedup) add(h uint64) (uint32, bool) {
+	d.Lock()
+	defer d.Unlock()
+	now := uint32(time.Now().Unix())
+	if expiresAt, ok := d.keys[h]; ok && expiresAt > now {
+		return 0, false
+	}
+	expiresAt := uint32(time.Now().Add(d.window).Unix())
+	d.keys[h] = expiresAt
+	return expiresAt, true
+}
+
+// remove removes hashes of the entries that are not put.
+func (d *_Dedup) remove(hashes ...uint64) {
+	d.Lock()
+	defer d.Unlock()
+	for _, h := range hashes {
+		delete(d.keys, h)
+	}
+}
+
+// append appends the dedup record of a synced entry to write into the dedup file on sync.
+// The hash is added to the index if the entry is recovered from the write ahead log.
+func (d *_Dedup) append(record []byte, recovery bool) {
+	d.Lock()
+	defer d.Unlock()
+	if recovery {
+		d.keys[binary.LittleEndian.Uint64(record[:8])] = binary.LittleEndian.Uint32(record[8:12])
+	}
+	d.records = append(d.records, record...)
+}
+
+// expire removes hashes of the index added before the dedup window,
+// the dedup file is compacted if it holds twice the records of the index.
+func (d *_Dedup) expire() error {
+	d.Lock()
+	defer d.Unlock()
+	now := uint32(time.Now().Unix())
+	for h, expiresAt := range d.keys {
+		if expiresAt <= now {
+			delete(d.keys, h)
+		}
+	}
+	if size := d.file.currSize(); size == 0 || size < int64(2*len(d.keys)*dedupRecordSize) {
+		return nil
+	}
+	return d.rewrite()
+}
+
+// write appends the dedup records of the synced entries to the dedup file.
+func (d *_Dedup) write() error {
+	d.Lock()
+	defer d.Unlock()
+	if len(d.records) == 0 {
+		return nil
+	}
+	if _, err := d.file.write(d.records); err != nil {
+		return err
+	}
+	d.records = d.records[:0]
+	return nil
+}
+
+// read reads the dedup file into the index skipping the expired records.
+func (d *_Dedup) read() error {
+	d.Lock()
+	defer d.Unlock()
+	buf := make([]byte, d.file.currSize())
+	if _, err := d.file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	now := uint32(time.Now().Unix())
+	// a partial record written before a crash is skipped.
+	for ; len(buf) >= dedupRecordSize; buf = buf[dedupRecordSize:] {
+		if expiresAt := binary.LittleEndian.Uint32(buf[8:12]); expiresAt > now {
+			d.keys[binary.LittleEndian.Uint64(buf[:8])] = expiresAt
+		}
+	}
+	return nil
+}
+
+// close compacts and closes the dedup file.
+func (d *_Dedup) close() error {
+	if err := d.compact(); err != nil {
+		return err
+	}
+	return d.file.Close()
+}
+
+// compact rewrites the dedup file with the records of the index.
+func (d *_Dedup) compact() error {
+	d.Lock()
+	defer d.Unlock()
+	return d.rewrite()
+}
+
+// rewrite writes the records of the index to a temporary file renamed to the dedup file,
+// so a crash leaves either the old or the new records.
+func (d *_Dedup) rewrite() error {
+	buf := make([]byte, 0, len(d.keys)*dedupRecordSize)
+	var record [dedupRecordSize]byte
+	for h, expiresAt := range d.keys {
+		binary.LittleEndian.PutUint64(record[:8], h)
+		binary.LittleEndian.PutUint32(record[8:12], expiresAt)
+		buf = append(buf, record[:]...)
+	}
+	if err := d.file.rewrite(buf); err != nil {
+		return err
+	}
+	d.records = d.records[:0]
+	return nil
+}
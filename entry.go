@@ -36,6 +36,8 @@ type (
 
 		parsed    bool
 		topicHash uint64 // topicHash for recovery from log and not persisted to the DB.
+		dedup     uint64 // dedup is hash of the dedup key, it is persisted to the log and not persisted to the index file.
+		carrier   bool   // carrier is set to pack the topic if the entry replaces the first entry of the topic.
 		cache     []byte // entry from memdb if it exist.
 	}
 	// Entry entry is a message entry structure.
@@ -47,6 +49,10 @@ type (
 		ExpiresAt  uint32 // The time expiry of the message.
 		Contract   uint32 // The contract is used to as salt to hash topic parts and also used as prefix in the message ID.
 		Encryption bool
+		Codec      Codec     // The codec to compress the payload, the DB codec is used if it is not set.
+		Timestamp  time.Time // The time of the message, the time of put is used if it is not set. It is set on entries returned from a query.
+		DedupKey   []byte    // The key to deduplicate retransmitted entries of the topic within the dedup window.
+		Replace    bool      // Replace supersedes the message with the ID of the entry.
 	}
 )
 
@@ -88,18 +94,50 @@ func (e *Entry) WithTTL(ttl []byte) *Entry {
 	return e
 }
 
+// WithTimestamp sets the time of the message to put entry with its original time, i.e. to import historical data.
+// Queries order entries and apply time limits using the timestamp rather than the time of put.
+func (e *Entry) WithTimestamp(t time.Time) *Entry {
+	e.Timestamp = t
+	return e
+}
+
+// WithDedupKey sets the dedup key on entry. An entry put with the contract, topic and dedup key of an entry put within
+// the dedup window is acknowledged but not stored again, see WithDedupWindow.
+func (e *Entry) WithDedupKey(key []byte) *Entry {
+	e.DedupKey = key
+	return e
+}
+
+// WithReplace sets entry to supersede the message with the ID and topic of the entry. The ID, time and expiry
+// of the message are kept, so the new payload keeps the position of the message in the time window.
+func (e *Entry) WithReplace() *Entry {
+	e.Replace = true
+	return e
+}
+
 // WithEncryption sets encryption on entry.
 func (e *Entry) WithEncryption() *Entry {
 	e.Encryption = true
 	return e
 }
 
+// WithCodec sets codec to compress payload of the entry.
+// The codec must be a built-in codec or a codec registered with the DB.
+func (e *Entry) WithCodec(c Codec) *Entry {
+	e.Codec = c
+	return e
+}
+
 func (e *Entry) reset() {
 	e.entry.seq = 0
 	e.entry.topicSize = 0
 	e.entry.cache = nil
+	e.entry.dedup = 0
+	e.entry.carrier = false
 	e.ID = nil
 	e.Payload = nil
+	e.DedupKey = nil
+	e.Replace = false
 }
 
 func (e _Entry) ExpiresAt() uint32 {
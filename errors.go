@@ -37,9 +37,29 @@ var (
 	errFull                = errors.New("database is full")
 	errCorrupted           = errors.New("database is corrupted")
 	errLocked              = errors.New("database is locked")
+	errUpgradeRequired     = errors.New("database must be opened for writes to upgrade the file format")
 	errClosed              = errors.New("database is closed")
 	errBatchSeqComplete    = errors.New("batch seq is complete")
 	errWriteConflict       = errors.New("batch write conflict")
+	errCursorInvalid       = errors.New("cursor is invalid")
+	errAggregateInvalid    = errors.New("aggregate spec is invalid")
+	errRollupInvalid       = errors.New("rollup is invalid")
+	errRetentionInvalid    = errors.New("retention policy is invalid")
+	errSegmentLimit        = errors.New("segment limit reached")
+	errBackupCorrupted     = errors.New("backup is corrupted")
+	errRestoreNotEmpty     = errors.New("restore directory is not empty")
+	errCodecInvalid        = errors.New("codec is invalid")
+	errCodecUnknown        = errors.New("codec is unknown")
+	errCodecIDRange        = errors.New("codec ID is greater than 31")
+	errKeyInvalid          = errors.New("keyring is invalid")
+	errKeyUnknown          = errors.New("encryption key is unknown")
+	errFormatInvalid       = errors.New("format is invalid")
+	errRecordInvalid       = errors.New("record is invalid")
+	errTimestampInvalid    = errors.New("timestamp is out of range")
+	errEntryDuplicate      = errors.New("entry is a duplicate")
+	errRangeInvalid        = errors.New("time range is invalid")
+	errLastValueDisabled   = errors.New("last-value cache is not enabled")
+	errCompactionInvalid   = errors.New("topic compaction is invalid")
 	errBadRequest          = errors.New("The request was invalid or cannot be otherwise served")
 	errForbidden           = errors.New("The request is understood, but it has been refused or access is not allowed")
 )
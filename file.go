@@ -23,6 +23,7 @@ import (
 	"os"
 	"path"
 	"sync"
+	"time"
 )
 
 // _FileType represent a file type.
@@ -36,13 +37,17 @@ const (
 	typeData
 	typeLease
 	typeFilter
+	typeDedup
+	typeTombstone
+	typeLastValue
 
-	typeAll = typeInfo | typeTimeWindow | typeIndex | typeData | typeLease | typeFilter
+	typeAll = typeInfo | typeTimeWindow | typeIndex | typeData | typeLease | typeFilter | typeDedup | typeTombstone | typeLastValue
 
 	prefix   = "unitdb"
 	indexDir = "index"
 	dataDir  = "data"
 	winDir   = "window"
+	logDir   = "logs" // directory of write ahead logs of the memdb.
 )
 
 // _FileDesc is a 'file descriptor'.
@@ -82,6 +87,15 @@ func filePath(dirName string, fd _FileDesc) string {
 	case typeFilter:
 		suffix := fmt.Sprintf("%s.filter", prefix)
 		return path.Join(dirName, suffix)
+	case typeDedup:
+		suffix := fmt.Sprintf("%s.dedup", prefix)
+		return path.Join(dirName, suffix)
+	case typeTombstone:
+		suffix := fmt.Sprintf("%s.tombstone", prefix)
+		return path.Join(dirName, suffix)
+	case typeLastValue:
+		suffix := fmt.Sprintf("%s.lastvalue", prefix)
+		return path.Join(dirName, suffix)
 	default:
 		return fmt.Sprintf("%#x-%d", fd.fileType, fd.num)
 	}
@@ -97,6 +111,8 @@ type (
 		*os.File
 		fd   _FileDesc
 		size int64
+
+		segments *_Segments // segments of the file, nil if the file is not segmented.
 	}
 	_FileSet struct {
 		mu *sync.RWMutex
@@ -117,11 +133,29 @@ func createLockFile(dirName string) (_LockFile, error) {
 	return newLockFile(path.Join(dirName, suffix))
 }
 
-func newFile(path string, nFiles int16, fd _FileDesc) (_FileSet, error) {
+// createReaderLockFile to create lock file of read-only DBs.
+// Readers share the lock, an exclusive lock is taken to change files offline.
+func createReaderLockFile(dirName string, shared bool) (_LockFile, error) {
+	suffix := fmt.Sprintf("%s.rlock", prefix)
+	if shared {
+		return newSharedLockFile(path.Join(dirName, suffix))
+	}
+	return newLockFile(path.Join(dirName, suffix))
+}
+
+// openFlag returns the flag to open files of the DB, files of a read-only DB are opened for reads and are not created.
+func openFlag(readOnly bool) int {
+	if readOnly {
+		return os.O_RDONLY
+	}
+	return os.O_CREATE | os.O_RDWR
+}
+
+func newFile(path string, nFiles int16, fd _FileDesc, readOnly bool) (_FileSet, error) {
 	if nFiles == 0 {
 		return _FileSet{}, errors.New("no new file")
 	}
-	fileFlag := os.O_CREATE | os.O_RDWR
+	fileFlag := openFlag(readOnly)
 	fileMode := os.FileMode(0666)
 	f := _File{}
 	fs := _FileSet{mu: new(sync.RWMutex), fileMap: make(map[int16]_File, nFiles)}
@@ -147,6 +181,69 @@ func newFile(path string, nFiles int16, fd _FileDesc) (_FileSet, error) {
 	return fs, nil
 }
 
+// newSegmentedFile opens segment files of the file type, each segment holds the given size of file offsets.
+// The data file rolls to the next segment after the time period if dur is set.
+func newSegmentedFile(path string, fd _FileDesc, size int64, dur time.Duration, readOnly bool) (_FileSet, error) {
+	s, err := newSegments(path, fd, "", size, dur, readOnly)
+	if err != nil {
+		return _FileSet{}, err
+	}
+	f := _File{fd: fd, segments: s}
+	f.currSize()
+	fs := _FileSet{mu: new(sync.RWMutex), fileMap: map[int16]_File{fd.num: f}}
+	fs._File = &f
+	return fs, nil
+}
+
+// ReadAt reads from the segment of the offset if the file is segmented.
+func (f *_File) ReadAt(b []byte, off int64) (int, error) {
+	if f.segments != nil {
+		return f.segments.readAt(b, off)
+	}
+	return f.File.ReadAt(b, off)
+}
+
+// WriteAt writes to the segment of the offset if the file is segmented.
+func (f *_File) WriteAt(b []byte, off int64) (int, error) {
+	if f.segments != nil {
+		return f.segments.writeAt(b, off)
+	}
+	return f.File.WriteAt(b, off)
+}
+
+// Truncate changes the size of the file, segments beyond the size are removed if the file is segmented.
+func (f *_File) Truncate(size int64) error {
+	if f.segments != nil {
+		return f.segments.truncate(size)
+	}
+	return f.File.Truncate(size)
+}
+
+// Sync commits all segments of the file if the file is segmented.
+func (f *_File) Sync() error {
+	if f.segments != nil {
+		return f.segments.sync()
+	}
+	return f.File.Sync()
+}
+
+// Close closes all segments of the file if the file is segmented.
+func (f *_File) Close() error {
+	if f.segments != nil {
+		return f.segments.close()
+	}
+	return f.File.Close()
+}
+
+// nextOffset returns the offset to append n bytes at the offset.
+// The offset is moved to the start of the next segment if the segment is full or due to roll.
+func (f *_File) nextOffset(off, n int64) int64 {
+	if f.segments == nil {
+		return off
+	}
+	return f.segments.nextOffset(off, n)
+}
+
 func (f *_File) truncate(size int64) error {
 	if err := f.Truncate(size); err != nil {
 		return err
@@ -199,12 +296,19 @@ func (f *_File) readUnmarshalableAt(m encoding.BinaryUnmarshaler, size uint32, o
 }
 
 func (f *_File) currSize() int64 {
+	if f.segments != nil {
+		f.size = f.segments.currSize()
+		return f.size
+	}
 	stat, _ := f.Stat()
 	f.size = stat.Size()
 	return f.size
 }
 
 func (f *_File) Size() int64 {
+	if f.segments != nil {
+		return f.segments.currSize()
+	}
 	stat, _ := f.Stat()
 	return stat.Size()
 }
@@ -227,6 +331,129 @@ func (fs *_FileSet) getFile(fd _FileDesc) (*_File, error) {
 	return &_File{}, errors.New("file not found")
 }
 
+// replaceFile replaces the file of the same file type with the new file.
+// The new file is renamed to the path of the replaced file.
+func (fs *_FileSet) replaceFile(nf *_File) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, fileset := range fs.list {
+		if fileset.fd.fileType != nf.fd.fileType || fileset.fd.num != nf.fd.num {
+			continue
+		}
+		f := fileset._File
+		if f.segments != nil {
+			err := f.segments.replace(nf.segments)
+			f.currSize()
+			fileset.fileMap[f.fd.num] = *f
+			return err
+		}
+		name := f.Name()
+		if err := nf.Close(); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		renameErr := os.Rename(nf.Name(), name)
+		// reopen the file even if rename fails so the file set remains usable.
+		fi, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, os.FileMode(0666))
+		if err != nil {
+			return err
+		}
+		f.File = fi
+		f.fd.fd = fi.Fd()
+		f.currSize()
+		fileset.fileMap[f.fd.num] = *f
+		return renameErr
+	}
+	return errors.New("file not found")
+}
+
+// rewrite replaces the contents of the file with the data. The data is written to a temporary file, synced and
+// renamed to the path of the file, so a crash leaves either the old or the new contents of the file.
+func (fs *_FileSet) rewrite(data []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f := fs._File
+	name := f.Name()
+	tmp, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	renameErr := os.Rename(tmp.Name(), name)
+	if renameErr == nil {
+		renameErr = syncDir(path.Dir(name))
+	} else {
+		os.Remove(tmp.Name())
+	}
+	// reopen the file even if rename fails so the file set remains usable.
+	fi, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	f.File = fi
+	f.fd.fd = fi.Fd()
+	f.currSize()
+	fs.fileMap[f.fd.num] = *f
+	return renameErr
+}
+
+// reopen reopens files replaced by the writer of the DB and reads the current file sizes.
+func (fs *_FileSet) reopen() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, fileset := range fs.list {
+		f := fileset._File
+		if f.segments != nil {
+			if err := f.segments.reload(); err != nil {
+				return err
+			}
+			f.currSize()
+			fileset.fileMap[f.fd.num] = *f
+			continue
+		}
+		name := f.Name()
+		curr, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		stat, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(curr, stat) {
+			fi, err := os.OpenFile(name, os.O_RDONLY, os.FileMode(0666))
+			if err != nil {
+				return err
+			}
+			f.Close()
+			f.File = fi
+			f.fd.fd = fi.Fd()
+		}
+		f.currSize()
+		fileset.fileMap[f.fd.num] = *f
+	}
+	return nil
+}
+
 func (fs *_FileSet) sync() error {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
@@ -24,20 +24,23 @@ import (
 )
 
 type _UnixFileLock struct {
-	f    *os.File
-	name string
+	f      *os.File
+	name   string
+	shared bool
 }
 
-// Unlock removes the lock from file.
+// Unlock removes the lock from file, the file of a shared lock is kept for other readers.
 func (fl *_UnixFileLock) unlock() error {
-	if err := os.Remove(fl.name); err != nil {
-		return err
+	if !fl.shared {
+		if err := os.Remove(fl.name); err != nil {
+			return err
+		}
 	}
 	return fl.f.Close()
 }
 
-func lockFile(f *os.File) error {
-	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+func lockFile(f *os.File, how int) error {
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
 		if err == syscall.EWOULDBLOCK {
 			err = os.ErrExist
 		}
@@ -47,13 +50,36 @@ func lockFile(f *os.File) error {
 }
 
 func newLockFile(name string) (_LockFile, error) {
+	return openLockFile(name, false)
+}
+
+// newSharedLockFile takes a shared lock on the file, it fails if the file is locked exclusively.
+func newSharedLockFile(name string) (_LockFile, error) {
+	return openLockFile(name, true)
+}
+
+func openLockFile(name string, shared bool) (_LockFile, error) {
 	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
-	if err := lockFile(f); err != nil {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err := lockFile(f, how); err != nil {
 		f.Close()
 		return nil, err
 	}
-	return &_UnixFileLock{f, name}, nil
+	return &_UnixFileLock{f, name, shared}, nil
+}
+
+// syncDir syncs the directory so a renamed file is persisted.
+func syncDir(dirName string) error {
+	d, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
@@ -30,19 +30,23 @@ var (
 )
 
 const (
-	errorLockViolation    = 0x21
-	lockfileExclusiveLock = 3
+	errorLockViolation      = 0x21
+	lockfileFailImmediately = 1
+	lockfileExclusiveLock   = 3
 )
 
 type _WindowsFileLock struct {
-	fd   syscall.Handle
-	name string
+	fd     syscall.Handle
+	name   string
+	shared bool
 }
 
-// unlock removes the lock from file.
+// unlock removes the lock from file, the file of a shared lock is kept for other readers.
 func (fl *_WindowsFileLock) unlock() error {
-	if err := os.Remove(fl.name); err != nil {
-		return err
+	if !fl.shared {
+		if err := os.Remove(fl.name); err != nil {
+			return err
+		}
 	}
 	return syscall.Close(fl.fd)
 }
@@ -56,6 +60,15 @@ func lockFile(h syscall.Handle, flags, reserved, locklow, lockhigh uint32, ol *s
 }
 
 func newLockFile(name string) (_LockFile, error) {
+	return openLockFile(name, false)
+}
+
+// newSharedLockFile takes a shared lock on the file, it fails if the file is locked exclusively.
+func newSharedLockFile(name string) (_LockFile, error) {
+	return openLockFile(name, true)
+}
+
+func openLockFile(name string, shared bool) (_LockFile, error) {
 	path, err := syscall.UTF16PtrFromString(name)
 	if err != nil {
 		return nil, err
@@ -75,10 +88,19 @@ func newLockFile(name string) (_LockFile, error) {
 			syscall.Close(fd)
 		}
 	}()
+	flags := uint32(lockfileExclusiveLock)
+	if shared {
+		flags = lockfileFailImmediately
+	}
 	var ol syscall.Overlapped
-	err = lockFile(fd, lockfileExclusiveLock, 0, 1, 0, &ol)
+	err = lockFile(fd, flags, 0, 1, 0, &ol)
 	if err != nil {
 		return nil, err
 	}
-	return &_WindowsFileLock{fd, name}, nil
+	return &_WindowsFileLock{fd, name, shared}, nil
+}
+
+// syncDir does nothing, a directory cannot be synced on Windows.
+func syncDir(dirName string) error {
+	return nil
 }
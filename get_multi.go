@@ -0,0 +1,231 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"context"
+	"io"
+	"sort"
+)
+
+type (
+	// Result is the result of a query of GetMulti.
+	Result struct {
+		Items [][]byte // The items matching the query.
+		Err   error    // The error of the query, the items are nil if the query failed.
+	}
+
+	// _MultiQuery holds window entries and items of a query of GetMulti.
+	_MultiQuery struct {
+		idx   int // index of the query in queries of GetMulti.
+		q     *Query
+		items [][]byte // items in order of the window entries of the query.
+
+		// start and limit are window entries to read, invalid is count of deleted entries of the window entries.
+		start, limit int
+		count        int
+		invalid      int
+		done         bool
+	}
+
+	// _MultiRead is a window entry of a query to read.
+	_MultiRead struct {
+		mq  *_MultiQuery
+		pos int
+		qe  _Query
+		e   _IndexEntry
+		err error
+	}
+)
+
+// GetMulti returns items matching each of the queries in a single call.
+// Queries of the same prefix are grouped, index blocks are read once for all queries of the group
+// and messages are read in order of data file offsets. Errors of queries are returned in the results,
+// an error is returned if the DB is closed.
+func (db *DB) GetMulti(queries []*Query) ([]Result, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(queries))
+	mqs := make([]*_MultiQuery, 0, len(queries))
+	for i, q := range queries {
+		switch {
+		case len(q.Topic) == 0:
+			results[i].Err = errTopicEmpty
+			continue
+		case len(q.Topic) > maxTopicLength:
+			results[i].Err = errTopicTooLarge
+			continue
+		}
+		q.internal.opts = &_QueryOptions{defaultQueryLimit: db.opts.queryOptions.defaultQueryLimit, maxQueryLimit: db.opts.queryOptions.maxQueryLimit}
+		if err := q.parse(); err != nil {
+			results[i].Err = err
+			continue
+		}
+		mqs = append(mqs, &_MultiQuery{idx: i, q: q})
+	}
+	sort.SliceStable(mqs, func(i, j int) bool {
+		return mqs[i].q.internal.prefix < mqs[j].q.internal.prefix
+	})
+
+	for i := 0; i < len(mqs); {
+		j := i + 1
+		for j < len(mqs) && mqs[j].q.internal.prefix == mqs[i].q.internal.prefix {
+			j++
+		}
+		db.getMulti(mqs[i:j], results)
+		i = j
+	}
+
+	count := 0
+	for _, mq := range mqs {
+		if results[mq.idx].Err != nil {
+			continue
+		}
+		for _, item := range mq.items {
+			if item != nil {
+				results[mq.idx].Items = append(results[mq.idx].Items, item)
+			}
+		}
+		count += mq.count
+	}
+	db.internal.meter.Gets.Inc(int64(count))
+	db.internal.meter.OutMsgs.Inc(int64(count))
+	return results, nil
+}
+
+// getMulti looks up and reads items of the queries of the same prefix,
+// the read lock of the prefix is held until the index and data reads of the queries finish.
+func (db *DB) getMulti(mqs []*_MultiQuery, results []Result) {
+	mu := db.internal.mutex.getMutex(mqs[0].q.internal.prefix)
+	mu.RLock()
+	defer mu.RUnlock()
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	for _, mq := range mqs {
+		if err := db.lookup(context.Background(), mq.q); err != nil {
+			results[mq.idx].Err = err
+			mq.done = true
+			continue
+		}
+		mq.items = make([][]byte, len(mq.q.internal.winEntries))
+		mq.limit = len(mq.q.internal.winEntries)
+		if mq.q.Limit < mq.limit {
+			mq.limit = mq.q.Limit
+		}
+	}
+
+	for {
+		var reads []*_MultiRead
+		for _, mq := range mqs {
+			if mq.done {
+				continue
+			}
+			for pos := mq.start; pos < mq.limit; pos++ {
+				if qe := mq.q.internal.winEntries[pos]; qe.seq != 0 {
+					reads = append(reads, &_MultiRead{mq: mq, pos: pos, qe: qe})
+				}
+			}
+		}
+		if len(reads) == 0 {
+			break
+		}
+		db.readEntries(reads)
+		sort.SliceStable(reads, func(i, j int) bool {
+			return reads[i].e.msgOffset < reads[j].e.msgOffset
+		})
+		for _, r := range reads {
+			mq := r.mq
+			if mq.done {
+				continue
+			}
+			if r.err == nil {
+				_, mq.items[r.pos], r.err = db.decodeMessage(mq.q, r.qe, r.e)
+			}
+			switch r.err {
+			case nil:
+				mq.count++
+			case errMsgIDDeleted, errMsgIDPrefixMismatch:
+				mq.invalid++
+			default:
+				results[mq.idx].Err = r.err
+				mq.done = true
+			}
+		}
+		for _, mq := range mqs {
+			mq.next()
+		}
+	}
+}
+
+// next sets window entries to read in place of deleted entries, the query is done if there are no deleted entries or the limit is reached.
+func (mq *_MultiQuery) next() {
+	if mq.done {
+		return
+	}
+	n := len(mq.q.internal.winEntries)
+	if mq.invalid == 0 || mq.count == mq.q.Limit || mq.limit == n {
+		mq.done = true
+		return
+	}
+	mq.start = mq.limit
+	mq.limit += mq.invalid
+	if mq.limit > n {
+		mq.limit = n
+	}
+	mq.invalid = 0
+}
+
+// readEntries reads index entries of the window entries in order of seq, an index block is read once for the entries of the block.
+func (db *DB) readEntries(reads []*_MultiRead) {
+	sort.Slice(reads, func(i, j int) bool {
+		return reads[i].qe.seq < reads[j].qe.seq
+	})
+	r := newBlockReader(db.fs)
+	var b _IndexBlock
+	var bErr error
+	bIdx := int32(-1)
+	for _, rd := range reads {
+		if e, ok := db.memEntry(rd.qe.seq); ok {
+			rd.e = e
+			continue
+		}
+		if idx := blockIndex(rd.qe.seq); idx != bIdx {
+			bIdx = idx
+			r.offset = blockOffset(idx)
+			b, bErr = r.readIndexBlock()
+		}
+		switch {
+		case bErr == io.EOF:
+			rd.err = errMsgIDDeleted
+			continue
+		case bErr != nil:
+			rd.err = bErr
+			continue
+		}
+		// entry was deleted before it was synced to the index file if it is not found.
+		rd.err = errMsgIDDeleted
+		for i := 0; i < entriesPerIndexBlock; i++ {
+			if e := b.entries[i]; e.seq == rd.qe.seq {
+				if !e.isDeleted() {
+					rd.e, rd.err = e, nil
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	cursorSize = 16
+)
+
+type (
+	// _TopicCursor walks window entries of a topic in reverse order of the message seq.
+	_TopicCursor struct {
+		topicHash uint64
+		entries   _WindowEntries // buffered entries in descending seq order.
+		next      int64          // offset of the next window block, -1 if all window blocks are read.
+	}
+
+	// ItemIterator iterates items matching the query in reverse order of the message seq.
+	ItemIterator struct {
+		db      *DB
+		query   *Query
+		winFile *_File
+		cursors []*_TopicCursor
+		gen     uint64 // compaction generation of the cursors.
+
+		limit int
+		count int
+
+		// lastSeq and lastTopicHash are seq and topic hash of the last item returned by the iterator.
+		lastSeq       uint64
+		lastTopicHash uint64
+
+		qe     _Query
+		id     message.ID
+		item   []byte
+		err    error
+		closed bool
+	}
+)
+
+// Items returns an iterator for items matching the query parameter.
+// Unlike Get the iterator does not materialize items, so it is not limited to maxQueryLimit,
+// it returns all matching items unless Query.Limit is set. The default query limit and the limit
+// of the last parameter of the topic do not apply to the iterator, the limit is read before the query is parsed.
+// Items are returned in reverse order of the message seq, that is the order the messages were stored. Unlike Get
+// the items are not ordered by the message time, so messages put with Entry.WithTimestamp may be out of time order.
+// Use Query.WithCursor to resume iteration from the last item returned by a previous iterator.
+func (db *DB) Items(q *Query) (*ItemIterator, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(q.Topic) == 0:
+		return nil, errTopicEmpty
+	case len(q.Topic) > maxTopicLength:
+		return nil, errTopicTooLarge
+	}
+	// the limit set on the query, parse sets the default limit.
+	limit := q.Limit
+	q.internal.opts = &_QueryOptions{defaultQueryLimit: db.opts.queryOptions.defaultQueryLimit, maxQueryLimit: db.opts.queryOptions.maxQueryLimit}
+	if err := q.parse(); err != nil {
+		return nil, err
+	}
+	it := &ItemIterator{db: db, query: q, limit: limit, lastSeq: math.MaxUint64}
+	if q.internal.cursor != nil {
+		if len(q.internal.cursor) != cursorSize {
+			return nil, errCursorInvalid
+		}
+		it.lastSeq = binary.LittleEndian.Uint64(q.internal.cursor[:8])
+		it.lastTopicHash = binary.LittleEndian.Uint64(q.internal.cursor[8:16])
+	}
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, err
+	}
+	it.winFile = winFile
+
+	mu := db.internal.mutex.getMutex(q.internal.prefix)
+	mu.RLock()
+	defer mu.RUnlock()
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	validCursor := it.lastTopicHash == 0
+	for _, topic := range it.resetCursors() {
+		if topic.hash == it.lastTopicHash {
+			validCursor = true
+		}
+	}
+	if !validCursor {
+		return nil, errCursorInvalid
+	}
+
+	return it, nil
+}
+
+// resetCursors adds cursors for topics matching the query to resume iteration from the last item.
+// Cursors are reset if window blocks are moved by compaction.
+func (it *ItemIterator) resetCursors() _Topics {
+	q := it.query
+	it.gen = it.db.internal.compactGen
+	it.cursors = nil
+	topics := it.db.internal.trie.lookup(q.internal.parts, q.internal.depth, q.internal.topicType)
+	for _, topic := range topics {
+		it.addCursor(topic, q.internal.upper)
+	}
+	return topics
+}
+
+// addCursor adds cursor to walk window entries of the topic.
+func (it *ItemIterator) addCursor(topic _Topic, upper int64) {
+	c := &_TopicCursor{topicHash: topic.hash, next: topic.offset}
+	c.entries = it.db.internal.timeWindow.ilookup(topic.hash, upper, math.MaxInt32)
+	sort.Slice(c.entries, func(i, j int) bool {
+		return c.entries[i].seq() > c.entries[j].seq()
+	})
+	c.skip(it.lastSeq)
+	it.cursors = append(it.cursors, c)
+}
+
+// skip skips buffered entries newer than or equal to the seq.
+func (c *_TopicCursor) skip(seq uint64) {
+	i := 0
+	for i < len(c.entries) && c.entries[i].seq() >= seq {
+		i++
+	}
+	c.entries = c.entries[i:]
+}
+
+// fill reads window blocks of the topic until there are buffered entries or all window blocks are read.
+func (c *_TopicCursor) fill(it *ItemIterator) error {
+	for len(c.entries) == 0 && c.next != -1 {
+		r := _WindowReader{winFile: it.winFile, offset: c.next}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			if err == io.EOF {
+				c.next = -1
+				return nil
+			}
+			return err
+		}
+		if b.topicHash != c.topicHash {
+			c.next = -1
+			return nil
+		}
+		for i := int(b.entryIdx) - 1; i >= 0; i-- {
+			we := b.entries[i]
+			if we.seq() == 0 || we.isExpired() {
+				continue
+			}
+			c.entries = append(c.entries, we)
+		}
+		sort.Slice(c.entries, func(i, j int) bool {
+			return c.entries[i].seq() > c.entries[j].seq()
+		})
+		c.skip(it.lastSeq)
+		c.next = b.next
+		if b.next == 0 || b.cutoff(it.query.internal.cutoff) {
+			c.next = -1
+		}
+	}
+	return nil
+}
+
+// Next advances the iterator to the next item. It returns false when iteration is complete or on an error.
+func (it *ItemIterator) Next() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+	if it.limit > 0 && it.count >= it.limit {
+		return false
+	}
+	if err := it.db.ok(); err != nil {
+		it.err = err
+		return false
+	}
+	it.db.internal.compactLock.RLock()
+	defer it.db.internal.compactLock.RUnlock()
+	if it.gen != it.db.internal.compactGen {
+		it.resetCursors()
+	}
+	for {
+		qe, ok, err := it.nextEntry()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if !ok {
+			return false
+		}
+		id, val, err := it.db.readMessage(it.query, qe)
+		if err != nil {
+			if err == errMsgIDDeleted || err == errMsgIDPrefixMismatch {
+				continue
+			}
+			it.err = err
+			return false
+		}
+		it.qe = qe
+		it.id = id
+		it.item = val
+		it.count++
+		it.db.internal.meter.Gets.Inc(1)
+		it.db.internal.meter.OutMsgs.Inc(1)
+		return true
+	}
+}
+
+// nextEntry returns the next window entry of the topic cursors in reverse order of the message seq.
+func (it *ItemIterator) nextEntry() (_Query, bool, error) {
+	var curr *_TopicCursor
+	for _, c := range it.cursors {
+		if err := c.fill(it); err != nil {
+			return _Query{}, false, err
+		}
+		if len(c.entries) == 0 {
+			continue
+		}
+		if curr == nil || c.entries[0].seq() > curr.entries[0].seq() {
+			curr = c
+		}
+	}
+	if curr == nil {
+		return _Query{}, false, nil
+	}
+	we := curr.entries[0]
+	curr.entries = curr.entries[1:]
+	it.lastSeq = we.seq()
+	it.lastTopicHash = curr.topicHash
+	return _Query{topicHash: curr.topicHash, seq: we.seq(), expiresAt: we.expiryTime()}, true, nil
+}
+
+// Item returns the current item. It is valid until the next call to Next.
+func (it *ItemIterator) Item() []byte {
+	return it.item
+}
+
+// Entry returns the current item as an entry with the message ID, topic, contract, time and expiry of the item.
+// It is valid until the next call to Next.
+func (it *ItemIterator) Entry() Entry {
+	return it.db.newEntry(it.qe, it.id, it.item)
+}
+
+// Err returns an error encountered during iteration if any.
+func (it *ItemIterator) Err() error {
+	return it.err
+}
+
+// Cursor returns an opaque cursor to resume the query from the last item returned by the iterator.
+func (it *ItemIterator) Cursor() []byte {
+	cursor := make([]byte, cursorSize)
+	binary.LittleEndian.PutUint64(cursor[:8], it.lastSeq)
+	binary.LittleEndian.PutUint64(cursor[8:16], it.lastTopicHash)
+	return cursor
+}
+
+// Close closes the iterator.
+func (it *ItemIterator) Close() error {
+	it.closed = true
+	it.cursors = nil
+	it.id = nil
+	it.item = nil
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/unit-io/unitdb/crypto"
+)
+
+// The last byte of message ID holds flags of the stored entry, the encryption flag, the codec ID,
+// the checksum flag if the checksum is stored after the value and the key ID flag if the key ID is stored before the encrypted value.
+const (
+	flagEncrypted = 1 << 0
+	flagChecksum  = 1 << 6
+	flagKeyID     = 1 << 7
+	codecShift    = 1
+	codecMask     = 0x1f
+
+	keyIDSize = 4
+)
+
+type (
+	// EncryptionKey is a key of the keyring, the key ID is stored with the entries encrypted with the key.
+	// Entries encrypted before key IDs were stored are decrypted with the key ID zero.
+	EncryptionKey struct {
+		ID  uint32
+		Key []byte
+	}
+
+	// _Keyring holds the current key to encrypt entries and old keys to decrypt entries.
+	_Keyring struct {
+		current uint32
+		macs    map[uint32]*crypto.MAC
+	}
+)
+
+func newKeyring(opts *_Options) (*_Keyring, error) {
+	k := &_Keyring{macs: make(map[uint32]*crypto.MAC)}
+	keys := opts.keyring
+	if len(keys) == 0 {
+		keys = []EncryptionKey{{Key: opts.encryptionKey}}
+	}
+	k.current = keys[0].ID
+	for _, key := range keys {
+		if _, ok := k.macs[key.ID]; ok {
+			return nil, errKeyInvalid
+		}
+		mac, err := crypto.New(key.Key)
+		if err != nil {
+			return nil, err
+		}
+		k.macs[key.ID] = mac
+	}
+	// encryption key of the options decrypts entries without key ID if it is not in the keyring.
+	if _, ok := k.macs[0]; !ok {
+		mac, err := crypto.New(opts.encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		k.macs[0] = mac
+	}
+	return k, nil
+}
+
+// encrypt encrypts value with the current key and returns flags of the entry.
+// The key ID is not stored if the current key ID is zero so the DB remains readable by previous versions.
+func (k *_Keyring) encrypt(flags uint8, val []byte) (uint8, []byte) {
+	flags = (flags | flagEncrypted) &^ flagKeyID
+	val = k.macs[k.current].Encrypt(nil, val)
+	if k.current == 0 {
+		return flags, val
+	}
+	dst := make([]byte, keyIDSize, keyIDSize+len(val))
+	binary.LittleEndian.PutUint32(dst, k.current)
+	return flags | flagKeyID, append(dst, val...)
+}
+
+// decrypt decrypts value with the key of the entry.
+func (k *_Keyring) decrypt(flags uint8, val []byte) ([]byte, error) {
+	keyID, val, err := k.keyID(flags, val)
+	if err != nil {
+		return nil, err
+	}
+	mac, ok := k.macs[keyID]
+	if !ok {
+		return nil, errKeyUnknown
+	}
+	// Decrypt writes into the source, the value can be the entry in memdb.
+	return mac.Decrypt(nil, append([]byte(nil), val...))
+}
+
+// keyID returns key ID of the encrypted value and the value without the key ID.
+func (k *_Keyring) keyID(flags uint8, val []byte) (uint32, []byte, error) {
+	if flags&flagKeyID == 0 {
+		return 0, val, nil
+	}
+	if len(val) < keyIDSize {
+		return 0, nil, errCorrupted
+	}
+	return binary.LittleEndian.Uint32(val[:keyIDSize]), val[keyIDSize:], nil
+}
+
+// reencrypt encrypts value of the message with the current key if it is encrypted with an old key.
+func (k *_Keyring) reencrypt(msg []byte, topicSize uint16) ([]byte, error) {
+	flags := msg[idSize-1]
+	if flags&flagEncrypted == 0 {
+		return msg, nil
+	}
+	off := idSize + uint32(topicSize)
+	end := len(msg)
+	if flags&flagChecksum != 0 {
+		end -= checksumSize
+	}
+	keyID, _, err := k.keyID(flags, msg[off:end])
+	if err != nil {
+		return nil, err
+	}
+	if keyID == k.current {
+		return msg, nil
+	}
+	val, err := k.decrypt(flags, msg[off:end])
+	if err != nil {
+		return nil, err
+	}
+	flags, val = k.encrypt(flags, val)
+	newMsg := make([]byte, off, int(off)+len(val)+checksumSize)
+	copy(newMsg, msg[:off])
+	newMsg[idSize-1] = flags
+	newMsg = append(newMsg, val...)
+	if flags&flagChecksum != 0 {
+		newMsg = append(newMsg, make([]byte, checksumSize)...)
+		putChecksum(newMsg)
+	}
+	return newMsg, nil
+}
+
+// ReencryptAll rewrites entries encrypted with old keys of the keyring with the current key.
+// It rewrites the files the same way as Compact, so it can be run in background and it is aborted if the context is cancelled.
+// Entries not yet synced to the DB are not rewritten.
+func (db *DB) ReencryptAll(ctx context.Context) error {
+	return db.compact(ctx, true)
+}
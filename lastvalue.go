@@ -0,0 +1,383 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// lastValueSize is the size of the last-value record (topic hash, seq, time and expiry).
+	lastValueSize = 28
+)
+
+type (
+	// _LastValue is the latest message of the topic, a record with a zero seq removes the topic from the cache.
+	_LastValue struct {
+		topicHash uint64
+		seq       uint64
+		timestamp int64
+		expiresAt uint32
+	}
+
+	// _LastValues is the last-value cache, it maps the topic hash to the latest message of the topic.
+	// Records of the changed topics are appended to the last-value file on sync,
+	// the file is compacted if it holds twice the records of the cache.
+	_LastValues struct {
+		sync.RWMutex
+		file    _FileSet
+		values  map[uint64]_LastValue
+		changed map[uint64]struct{} // topics changed since the last-value file is written.
+	}
+)
+
+func newLastValues(fs _FileSet) *_LastValues {
+	return &_LastValues{file: fs, values: make(map[uint64]_LastValue), changed: make(map[uint64]struct{})}
+}
+
+// after returns true if the message is newer than the message v.
+func (lv _LastValue) after(v _LastValue) bool {
+	if lv.timestamp != v.timestamp {
+		return lv.timestamp > v.timestamp
+	}
+	return lv.seq > v.seq
+}
+
+func (lv _LastValue) isExpired() bool {
+	return lv.expiresAt != 0 && lv.expiresAt <= uint32(time.Now().Unix())
+}
+
+func (lv _LastValue) marshalBinary() []byte {
+	buf := make([]byte, lastValueSize)
+	binary.LittleEndian.PutUint64(buf[:8], lv.topicHash)
+	binary.LittleEndian.PutUint64(buf[8:16], lv.seq)
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(lv.timestamp))
+	binary.LittleEndian.PutUint32(buf[24:28], lv.expiresAt)
+	return buf
+}
+
+func (lv *_LastValue) unmarshalBinary(data []byte) {
+	lv.topicHash = binary.LittleEndian.Uint64(data[:8])
+	lv.seq = binary.LittleEndian.Uint64(data[8:16])
+	lv.timestamp = int64(binary.LittleEndian.Uint64(data[16:24]))
+	lv.expiresAt = binary.LittleEndian.Uint32(data[24:28])
+}
+
+// add adds the message to the cache if it is newer than the cached message of the topic.
+// It does nothing if the last-value cache is not enabled.
+func (c *_LastValues) add(values ..._LastValue) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, v := range values {
+		if curr, ok := c.values[v.topicHash]; ok && !v.after(curr) {
+			continue
+		}
+		c.values[v.topicHash] = v
+		c.changed[v.topicHash] = struct{}{}
+	}
+}
+
+// swap sets the message of the topic if the cached message of the topic is the message old,
+// the topic is removed from the cache if the seq is zero.
+func (c *_LastValues) swap(old, v _LastValue) {
+	c.Lock()
+	defer c.Unlock()
+	if curr, ok := c.values[v.topicHash]; !ok || curr != old {
+		// a newer message is put since the cached message is read.
+		return
+	}
+	if v.seq == 0 {
+		delete(c.values, v.topicHash)
+	} else {
+		c.values[v.topicHash] = v
+	}
+	c.changed[v.topicHash] = struct{}{}
+}
+
+func (c *_LastValues) get(topicHash uint64) (_LastValue, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	v, ok := c.values[topicHash]
+	return v, ok
+}
+
+// write appends records of the changed topics to the last-value file.
+// It does nothing if the last-value cache is not enabled.
+func (c *_LastValues) write() error {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.changed) == 0 {
+		return nil
+	}
+	if size := c.file.currSize(); size > 0 && size >= int64(2*len(c.values)*lastValueSize) {
+		return c.rewrite()
+	}
+	var buf []byte
+	for h := range c.changed {
+		v, ok := c.values[h]
+		if !ok {
+			v = _LastValue{topicHash: h}
+		}
+		buf = append(buf, v.marshalBinary()...)
+	}
+	if _, err := c.file.write(buf); err != nil {
+		return err
+	}
+	if err := c.file.Sync(); err != nil {
+		return err
+	}
+	c.changed = make(map[uint64]struct{})
+	return nil
+}
+
+// rewrite rewrites the last-value file with the records of the cache,
+// the records are written to a temporary file that replaces the last-value file so a crash does not lose the cache.
+func (c *_LastValues) rewrite() error {
+	buf := make([]byte, 0, len(c.values)*lastValueSize)
+	for _, v := range c.values {
+		buf = append(buf, v.marshalBinary()...)
+	}
+	if err := c.file.rewrite(buf); err != nil {
+		return err
+	}
+	c.changed = make(map[uint64]struct{})
+	return nil
+}
+
+// read reads the last-value file into the cache, a partial record written before a crash is skipped.
+func (c *_LastValues) read() error {
+	c.Lock()
+	defer c.Unlock()
+	buf := make([]byte, c.file.currSize())
+	if _, err := c.file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	c.values = make(map[uint64]_LastValue)
+	for ; len(buf) >= lastValueSize; buf = buf[lastValueSize:] {
+		var v _LastValue
+		v.unmarshalBinary(buf)
+		if v.seq == 0 {
+			delete(c.values, v.topicHash)
+			continue
+		}
+		c.values[v.topicHash] = v
+	}
+	return nil
+}
+
+// rebuildLastValues looks up the latest message of each topic if the last-value file is empty,
+// i.e. if the last-value cache is enabled on an existing DB.
+func (db *DB) rebuildLastValues() error {
+	c := db.internal.lastValues
+	if c.file.currSize() != 0 {
+		return nil
+	}
+	for _, topic := range db.internal.trie.allTopics() {
+		v, ok, err := db.lookupLatest(topic)
+		if err != nil {
+			return err
+		}
+		if ok {
+			c.add(v)
+		}
+	}
+	return nil
+}
+
+// lookupLatest looks up the latest message of the topic from the window entries,
+// it is used if the cached message of the topic is deleted or expired.
+func (db *DB) lookupLatest(topic _Topic) (_LastValue, bool, error) {
+	for limit := 8; ; limit *= 2 {
+		wEntries, _, err := db.internal.timeWindow.lookup(context.Background(), db.fs, topic.hash, topic.offset, 0, 0, limit, db.entryTime)
+		if err != nil {
+			return _LastValue{}, false, err
+		}
+		// window entries are the latest entries of the topic up to the limit, so the latest valid entry is the latest message.
+		var latest _LastValue
+		var found bool
+		for _, we := range wEntries {
+			id, err := db.readID(_Query{seq: we.seq()})
+			if err != nil {
+				if err == errMsgIDDeleted {
+					continue
+				}
+				return _LastValue{}, false, err
+			}
+			if db.internal.tombstones.deleted(topic.hash, we.seq(), id.Time()) {
+				continue
+			}
+			v := _LastValue{topicHash: topic.hash, seq: we.seq(), timestamp: id.Time(), expiresAt: we.expiryTime()}
+			if !found || v.after(latest) {
+				latest, found = v, true
+			}
+		}
+		if found || len(wEntries) < limit {
+			return latest, found, nil
+		}
+	}
+}
+
+// Latest returns the latest message of the topic for the contract from the last-value cache, it returns nil if the topic has no messages.
+// The last-value cache is enabled using WithLastValueCache option.
+func (db *DB) Latest(topic []byte, contract uint32) (*Entry, error) {
+	if err := db.checkLatest(topic); err != nil {
+		return nil, err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return nil, err
+	}
+	if t.TopicType == message.TopicWildcard {
+		return nil, errBadRequest
+	}
+	t.AddContract(contract)
+	h := t.GetHash(contract)
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	off, ok := db.internal.trie.getOffset(h)
+	if !ok {
+		return nil, nil
+	}
+	name, _ := db.internal.trie.getName(h)
+	e, ok, err := db.latestEntry(newTopic(h, []byte(name), off), contract)
+	if err != nil || !ok {
+		return nil, err
+	}
+	db.internal.meter.Gets.Inc(1)
+	db.internal.meter.OutMsgs.Inc(1)
+	return &e, nil
+}
+
+// LatestMatching returns the latest message of each concrete topic of the contract matching the wildcard topic from the last-value cache.
+// A '*' part of the wildcard topic matches any single part of the topic and a trailing '...' matches any number of parts.
+// Topics without messages are skipped, entries are sorted by the topic.
+func (db *DB) LatestMatching(wildcardTopic []byte, contract uint32) ([]Entry, error) {
+	if err := db.checkLatest(wildcardTopic); err != nil {
+		return nil, err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	parts := splitTopic(wildcardTopic)
+	var entries []Entry
+	for _, topic := range db.internal.trie.topics(contract) {
+		if topic.name == "" {
+			continue
+		}
+		name := splitTopic([]byte(topic.name))
+		if isWildcardTopic(name) || !matchTopic(parts, name) {
+			continue
+		}
+		e, ok, err := db.latestEntry(topic, contract)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Topic, entries[j].Topic) < 0
+	})
+	db.internal.meter.Gets.Inc(int64(len(entries)))
+	db.internal.meter.OutMsgs.Inc(int64(len(entries)))
+	return entries, nil
+}
+
+func (db *DB) checkLatest(topic []byte) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case db.internal.lastValues == nil:
+		return errLastValueDisabled
+	case len(topic) == 0:
+		return errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return errTopicTooLarge
+	}
+	return nil
+}
+
+// isWildcardTopic returns true if a part of the topic is '*' or the topic has a trailing '...'.
+func isWildcardTopic(parts [][]byte) bool {
+	for _, p := range parts {
+		if string(p) == message.TopicGenericSymbol || (len(p) == 1 && p[0] == message.TopicWildcardSymbol) {
+			return true
+		}
+	}
+	return false
+}
+
+// latestEntry reads the cached message of the topic, the cache is refreshed if the message is deleted or expired.
+func (db *DB) latestEntry(topic _Topic, contract uint32) (Entry, bool, error) {
+	c := db.internal.lastValues
+	q := &Query{Contract: contract}
+	v, ok := c.get(topic.hash)
+	if !ok {
+		return Entry{}, false, nil
+	}
+	for {
+		if !v.isExpired() {
+			qe := _Query{topicHash: topic.hash, seq: v.seq, expiresAt: v.expiresAt}
+			id, val, err := db.readMessage(q, qe)
+			switch err {
+			case nil:
+				return db.newEntry(qe, id, val), true, nil
+			case errMsgIDPrefixMismatch:
+				return Entry{}, false, nil
+			case errMsgIDDeleted:
+			default:
+				return Entry{}, false, err
+			}
+		}
+		latest, ok, err := db.lookupLatest(topic)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		if ok && latest == v {
+			// the message is in the window entries but it is not readable.
+			return Entry{}, false, nil
+		}
+		if !ok {
+			latest = _LastValue{topicHash: topic.hash}
+		}
+		c.swap(v, latest)
+		if v, ok = c.get(topic.hash); !ok {
+			return Entry{}, false, nil
+		}
+	}
+}
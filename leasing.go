@@ -21,6 +21,7 @@ import (
 	"io"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/unit-io/unitdb/hash"
 )
@@ -38,6 +39,7 @@ type _Lease struct {
 	blocks                []*_FreeBlocks
 	size                  int64 // Total size of free blocks.
 	minimumFreeBlocksSize int64 // Minimum free blocks size before free blocks are reused for new allocation.
+	paused                int32 // free blocks are not reused while paused, messages are appended to the data file.
 	consistent            *hash.Consistent
 }
 
@@ -177,11 +179,20 @@ func (l *_Lease) free(seq uint64, off int64, size uint32) {
 	l.freeBlock(off, size)
 }
 
+// pause stops reuse of free blocks until resume is called.
+func (l *_Lease) pause() {
+	atomic.AddInt32(&l.paused, 1)
+}
+
+func (l *_Lease) resume() {
+	atomic.AddInt32(&l.paused, -1)
+}
+
 func (l *_Lease) allocate(size uint32) int64 {
 	if size == 0 {
 		panic("unable to allocate zero bytes")
 	}
-	if l.size < l.minimumFreeBlocksSize {
+	if l.size < l.minimumFreeBlocksSize || atomic.LoadInt32(&l.paused) > 0 {
 		return -1
 	}
 	fbs := l.freeBlocks(uint64(size))
@@ -205,6 +216,85 @@ func (l *_Lease) allocate(size uint32) int64 {
 	return off
 }
 
+// freeSize returns the size of the offset range between start and end covered by free blocks.
+func (l *_Lease) freeSize(start, end int64) int64 {
+	var blocks []_FreeBlock
+	for i := 0; i < nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.RLock()
+		for _, b := range fbs.fb {
+			if b.offset < end && b.offset+int64(b.size) > start {
+				blocks = append(blocks, b)
+			}
+		}
+		fbs.RUnlock()
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].offset < blocks[j].offset
+	})
+	// free blocks may overlap if a message is freed more than once.
+	var size int64
+	off := start
+	for _, b := range blocks {
+		lo, hi := b.offset, b.offset+int64(b.size)
+		if lo < off {
+			lo = off
+		}
+		if hi > end {
+			hi = end
+		}
+		if hi > lo {
+			size += hi - lo
+			off = hi
+		}
+	}
+	return size
+}
+
+// dropBlocks removes free blocks within the offset range between start and end.
+// Free blocks crossing the range are trimmed to the part outside the range.
+func (l *_Lease) dropBlocks(start, end int64) {
+	var trimmed []_FreeBlock
+	for i := 0; i < nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.Lock()
+		fb := fbs.fb[:0]
+		for _, b := range fbs.fb {
+			lo, hi := b.offset, b.offset+int64(b.size)
+			if lo >= end || hi <= start {
+				fb = append(fb, b)
+				continue
+			}
+			delete(fbs.cache, b.offset)
+			l.size -= int64(b.size)
+			if lo < start {
+				trimmed = append(trimmed, _FreeBlock{offset: lo, size: uint32(start - lo)})
+			}
+			if hi > end {
+				trimmed = append(trimmed, _FreeBlock{offset: end, size: uint32(hi - end)})
+			}
+		}
+		fbs.fb = fb
+		fbs.Unlock()
+	}
+	for _, b := range trimmed {
+		l.freeBlock(b.offset, b.size)
+	}
+}
+
+// reset removes all free blocks and writes empty lease to the file.
+func (l *_Lease) reset() error {
+	for i := 0; i < nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.Lock()
+		fbs.fb = nil
+		fbs.cache = make(map[int64]bool)
+		fbs.Unlock()
+	}
+	l.size = 0
+	return l.write()
+}
+
 func (l *_Lease) read() error {
 	off := int64(0)
 	blocks := &_FreeBlocks{cache: make(map[int64]bool)}
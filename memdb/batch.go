@@ -17,6 +17,7 @@
 package memdb
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
@@ -81,12 +82,20 @@ func (b *Batch) Put(key uint64, data []byte) error {
 
 // Write starts writing entries into DB.
 func (b *Batch) Write() error {
+	return b.WriteContext(context.Background())
+}
+
+// WriteContext is like Write but it returns the context error if the context is done before
+// the entries are queued to write to the log. Entries not written are released on Abort.
+func (b *Batch) WriteContext(ctx context.Context) error {
 	b.writeLockC <- struct{}{}
 	defer func() {
 		<-b.writeLockC
 	}()
 	b.batchGroup = append(b.batchGroup, b.tinyLog.timeID())
-	b.db.internal.logManager.writeWait(b.tinyLog)
+	if err := b.db.internal.logManager.writeWait(ctx, b.tinyLog); err != nil {
+		return err
+	}
 	b.newTinyLog()
 
 	return nil
@@ -95,6 +104,11 @@ func (b *Batch) Write() error {
 // Commit commits changes to the DB. In batch operation commit is managed and client is not allowed to call Commit.
 // On Commit complete batch operation signal to the caller if the batch is fully committed to DB.
 func (b *Batch) Commit() error {
+	return b.CommitContext(context.Background())
+}
+
+// CommitContext is like Commit but the batch is aborted if the context is done before the entries are written.
+func (b *Batch) CommitContext(ctx context.Context) error {
 	_assert(!b.managed, "managed batch commit not allowed")
 	defer func() {
 		close(b.commitComplete)
@@ -102,7 +116,7 @@ func (b *Batch) Commit() error {
 	}()
 
 	// Write batch entries.
-	if err := b.Write(); err != nil {
+	if err := b.WriteContext(ctx); err != nil {
 		return err
 	}
 
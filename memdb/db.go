@@ -17,6 +17,7 @@
 package memdb
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"os"
@@ -365,11 +366,20 @@ func (db *DB) Delete(key uint64) error {
 
 // Put inserts a new key-value pair to the DB.
 func (db *DB) Put(key uint64, data []byte) (int64, error) {
+	return db.PutContext(context.Background(), key, data)
+}
+
+// PutContext is like Put but it returns the context error if the context is done
+// while the time block is held by the log writer backing off.
+func (db *DB) PutContext(ctx context.Context, key uint64, data []byte) (int64, error) {
 	if err := db.ok(); err != nil {
 		return 0, err
 	}
 
-	timeID := db.timeID()
+	timeID, err := db.internal.logManager.timeIDContext(ctx)
+	if err != nil {
+		return 0, err
+	}
 	db.mu.RLock()
 	block, ok := db.timeBlocks[timeID]
 	db.mu.RUnlock()
@@ -390,6 +400,45 @@ func (db *DB) Put(key uint64, data []byte) (int64, error) {
 	return int64(timeID), nil
 }
 
+// Replace puts data of the key into the current time block and removes the key from the time block of the previous data.
+// Unlike Delete the key is not written as deleted into the WAL, so the WAL keeps the previous data until its time block is released.
+func (db *DB) Replace(ctx context.Context, key uint64, data []byte) (int64, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+
+	prevID, ok := db.keyTimeID(key)
+	timeID, err := db.PutContext(ctx, key, data)
+	if err != nil || !ok {
+		return timeID, err
+	}
+	db.mu.RLock()
+	block, ok := db.timeBlocks[prevID]
+	db.mu.RUnlock()
+	if !ok {
+		return timeID, nil
+	}
+
+	timeLock := db.timeLock()
+	timeLock.RLock()
+	defer timeLock.RUnlock()
+
+	block.Lock()
+	if prevID != _TimeID(timeID) {
+		delete(block.records, iKey(false, key))
+	}
+	// the key is counted once put into the time block of the previous data.
+	block.count--
+	if len(block.records) == 0 && prevID < db.timeID() {
+		// released timeblock from the WAL if all records are replaced.
+		block.Unlock()
+		return timeID, db.releaseLog(prevID)
+	}
+	block.Unlock()
+
+	return timeID, nil
+}
+
 // NewBatch returns unmanaged Batch so caller can perform Put, Write, Commit, Abort to the Batch.
 func (db *DB) NewBatch() *Batch {
 	return db.batch()
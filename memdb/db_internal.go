@@ -236,6 +236,51 @@ func (db *DB) seek(key uint64, cutoff int64) error {
 	return errEntryDoesNotExist
 }
 
+// keyTimeID returns the most recent time ID of the time block having the key.
+func (db *DB) keyTimeID(key uint64) (_TimeID, bool) {
+	db.mu.RLock()
+	// Get time block
+	blockKey := db.blockKey(key)
+	r, ok := db.timeFilters[blockKey]
+	db.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+
+	var timeIDs []_TimeID
+	r.RLock()
+	for timeID := range r.timeRecords {
+		timeIDs = append(timeIDs, timeID)
+	}
+	r.RUnlock()
+	sort.Slice(timeIDs[:], func(i, j int) bool {
+		return timeIDs[i] > timeIDs[j]
+	})
+	ikey := iKey(false, key)
+	for _, timeID := range timeIDs {
+		db.mu.RLock()
+		block, ok := db.timeBlocks[timeID]
+		db.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		block.RLock()
+		_, ok = block.records[ikey]
+		block.RUnlock()
+		if ok {
+			return timeID, true
+		}
+		r.RLock()
+		fltr := r.timeRecords[timeID]
+		r.RUnlock()
+		if !fltr.Test(key) {
+			return 0, false
+		}
+	}
+
+	return 0, false
+}
+
 // move moves the entry to the new block
 func (db *DB) move(timeID _TimeID, key uint64) error {
 	newTimeID := db.timeID()
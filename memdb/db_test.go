@@ -17,8 +17,10 @@
 package memdb
 
 import (
+	"context"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSimple(t *testing.T) {
@@ -206,3 +208,37 @@ func TestLogRelease(t *testing.T) {
 	}
 	verifyAndClose()
 }
+
+func TestPutContext(t *testing.T) {
+	db, err := Open(WithLogFilePath("test"), WithLogReset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the put waits for the log writer to release the tinyLog until the context is done.
+	p := db.internal.logManager
+	unlockC := p.lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := db.PutContext(ctx, 1, []byte("msg.1")); err != context.DeadlineExceeded {
+		p.unlock(unlockC)
+		t.Fatalf("expected %v; got %v", context.DeadlineExceeded, err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.unlock(unlockC)
+	}()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	timeID, err := db.PutContext(ctx, 2, []byte("msg.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(2); data == nil || err != nil {
+		t.Fatalf("expected message; got %v, %v", data, err)
+	}
+	if err := db.Free(timeID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -17,6 +17,7 @@
 package memdb
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -92,6 +93,10 @@ type (
 		stop       chan struct{}
 		stopOnce   sync.Once
 		stopWg     sync.WaitGroup
+
+		// unlockC is closed once the lock taken to write the tinyLog is released.
+		unlockMu sync.Mutex
+		unlockC  chan struct{}
 	}
 )
 
@@ -136,7 +141,9 @@ func (db *DB) newLogManager(opts *_TinyLogOptions) {
 		writeQueue: make(chan *_TinyLog, 1),
 		logQueue:   make(chan *_TinyLog, opts.poolCapacity),
 		stop:       make(chan struct{}),
+		unlockC:    make(chan struct{}),
 	}
+	close(logManager.unlockC)
 
 	logManager.newTinyLog()
 
@@ -163,6 +170,48 @@ func (p *_TinyLogManager) timeID() _TimeID {
 	return p.tinyLog.timeID()
 }
 
+// timeIDContext returns tinyLog timeID, it returns the context error if the context is done
+// while the tinyLog is enqueued to write.
+func (p *_TinyLogManager) timeIDContext(ctx context.Context) (_TimeID, error) {
+	if p.mu.TryRLock() {
+		defer p.mu.RUnlock()
+		return p.tinyLog.timeID(), nil
+	}
+	if ctx.Done() == nil {
+		return p.timeID(), nil
+	}
+	for {
+		p.unlockMu.Lock()
+		unlockC := p.unlockC
+		p.unlockMu.Unlock()
+		select {
+		case <-unlockC:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		if p.mu.TryRLock() {
+			defer p.mu.RUnlock()
+			return p.tinyLog.timeID(), nil
+		}
+	}
+}
+
+// lock locks the tinyLog to write, it returns the channel to close once the lock is released.
+func (p *_TinyLogManager) lock() chan struct{} {
+	unlockC := make(chan struct{})
+	p.unlockMu.Lock()
+	p.unlockC = unlockC
+	p.unlockMu.Unlock()
+	p.mu.Lock()
+	return unlockC
+}
+
+// unlock unlocks the tinyLog and signals the callers waiting for the lock to be released.
+func (p *_TinyLogManager) unlock(unlockC chan struct{}) {
+	p.mu.Unlock()
+	close(unlockC)
+}
+
 // size returns maximum number of concurrent jobs.
 func (p *_TinyLogManager) size() int {
 	return p.opts.poolCapacity
@@ -189,13 +238,19 @@ func (p *_TinyLogManager) write() {
 	}
 }
 
-// writeWait enqueues the log and waits for it to be executed.
-func (p *_TinyLogManager) writeWait(tinyLog *_TinyLog) {
+// writeWait enqueues the log and waits for it to be executed. It returns the context error
+// if the context is done before the log is enqueued, the log is not written in this case.
+func (p *_TinyLogManager) writeWait(ctx context.Context, tinyLog *_TinyLog) error {
 	if tinyLog == nil {
-		return
+		return nil
+	}
+	select {
+	case p.writeQueue <- tinyLog:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	p.writeQueue <- tinyLog
 	<-tinyLog.doneChan
+	return nil
 }
 
 // writeLoop enqueue the tiny log to the log pool.
@@ -232,10 +287,10 @@ func (p *_TinyLogManager) writeLoop(interval time.Duration) {
 				}
 				fallthrough
 			default:
-				p.mu.Lock()
+				unlockC := p.lock()
 				p.write()
 				p.newTinyLog()
-				p.mu.Unlock()
+				p.unlock(unlockC)
 			}
 		}
 	}
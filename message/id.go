@@ -18,6 +18,7 @@ package message
 
 import (
 	"encoding/binary"
+	"time"
 
 	"github.com/unit-io/unitdb/uid"
 )
@@ -61,6 +62,16 @@ func (id ID) Sequence() uint64 {
 	return binary.LittleEndian.Uint64(id[8:16])
 }
 
+// Time returns the time the ID was generated in unix seconds.
+func (id ID) Time() int64 {
+	return uid.Time(id[0:4])
+}
+
+// Contract gets the contract for the id.
+func (id ID) Contract() uint32 {
+	return binary.LittleEndian.Uint32(id[4:8])
+}
+
 // SetContract sets Contract on ID.
 func (id *ID) SetContract(contract uint32) {
 	newid := make(ID, fixed)
@@ -69,6 +80,14 @@ func (id *ID) SetContract(contract uint32) {
 	*id = newid
 }
 
+// SetTime sets time on ID.
+func (id *ID) SetTime(t time.Time) {
+	newid := make(ID, fixed)
+	copy(newid[:fixed], *id)
+	binary.LittleEndian.PutUint32(newid[0:4], uid.Apoch(t))
+	*id = newid
+}
+
 // Prefix return message ID only containing prefix.
 func (id ID) Prefix() ID {
 	prefix := make(ID, 8)
@@ -84,3 +103,19 @@ func (id ID) EvalPrefix(contract uint32, cutoff int64) bool {
 	}
 	return binary.LittleEndian.Uint32(id[4:8]) == contract
 }
+
+// EvalRange matches the prefix with the time range [from, to).
+// A zero from or to leaves that end of the range open.
+func (id ID) EvalRange(contract uint32, from, to int64) bool {
+	if binary.LittleEndian.Uint32(id[4:8]) != contract {
+		return false
+	}
+	t := uid.Time(id[0:4])
+	if from > 0 && t < from {
+		return false
+	}
+	if to > 0 && t >= to {
+		return false
+	}
+	return true
+}
@@ -19,6 +19,7 @@ package message
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"strconv"
 	"time"
 	"unsafe"
@@ -40,6 +41,10 @@ const (
 
 	// Wildcard wildcard is hash for wildcard topic such as '*' or '...'
 	Wildcard = uint32(857445537)
+
+	// namedTopic marks the marshaled topic contains the topic string.
+	// A topic marshaled without the topic string starts with the topic depth which is never zero.
+	namedTopic = 0x0
 )
 
 // TopicOption represents a key/value pair option.
@@ -132,6 +137,30 @@ func (t *Topic) Last() (time.Time, int, bool) {
 	return zeroTime, 0, ok
 }
 
+// Range returns the 'from' and 'to' options, which are the time range of messages to retrieve.
+// The time is specified either in unix seconds or in RFC3339 format.
+func (t *Topic) Range() (time.Time, time.Time, bool) {
+	from, fromOk := t.timeOption("from")
+	to, toOk := t.timeOption("to")
+	return from, to, fromOk || toOk
+}
+
+// timeOption retrieves a time option.
+func (t *Topic) timeOption(name string) (time.Time, bool) {
+	val, sec, ok := t.getOption(name)
+	if !ok {
+		return zeroTime, false
+	}
+	if sec > 0 {
+		return toUnix(int64(sec)), true
+	}
+	tm, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return zeroTime, false
+	}
+	return tm, true
+}
+
 // toUnix converts the time to Unix Time with validation.
 func toUnix(t int64) time.Time {
 	if t == 0 {
@@ -255,14 +284,16 @@ func parseWildcardTopic(contract uint32, topic *Topic) (ok bool) {
 
 	depth := uint8(0)
 	q := []byte(TopicGenericSymbol)
-	if bytes.HasSuffix(topic.Topic, q) {
+	// topic is trimmed to parse the parts, but the topic string is kept as is.
+	text := topic.Topic
+	if bytes.HasSuffix(text, q) {
 		depth++
-		topic.Topic = bytes.TrimRight(topic.Topic, string(TopicGenericSymbol))
+		text = bytes.TrimRight(text, string(TopicGenericSymbol))
 		topic.TopicType = TopicWildcard
 		topic.Depth = TopicMaxDepth
 	}
 
-	parts := bytes.FieldsFunc(topic.Topic, fn.splitTopic)
+	parts := bytes.FieldsFunc(text, fn.splitTopic)
 	q = []byte{TopicWildcardSymbol}
 	part = Part{}
 	wildchars := uint8(0)
@@ -307,30 +338,43 @@ func parseWildcardTopic(contract uint32, topic *Topic) (ok bool) {
 }
 
 // Marshal serializes topic to binary.
+// The topic is prefixed with a zero byte to mark the topic string is added after the parts.
 func (t *Topic) Marshal() []byte {
 	// preallocate buffer of appropriate size
 	var size int
-	//Depth size
-	size++
+	//Marker, depth and parts count size
+	size += 4
 	for range t.Parts {
 		size += 5
 	}
+	size += len(t.Topic)
 	buf := make([]byte, size)
 
 	var n int
+	buf[n] = namedTopic
+	n++
 	buf[n] = byte(t.Depth)
 	n++
+	binary.LittleEndian.PutUint16(buf[n:], uint16(len(t.Parts)))
+	n += 2
 	for _, part := range t.Parts {
 		buf[n] = byte(part.Wildchars)
 		n++
 		binary.LittleEndian.PutUint32(buf[n:], part.Hash)
 		n += 4
 	}
+	copy(buf[n:], t.Topic)
 	return buf
 }
 
 // Unmarshal de-serializes topic from binary data.
 func (t *Topic) Unmarshal(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("topic.Unmarshal: topic is empty")
+	}
+	if data[0] == namedTopic {
+		return t.unmarshalNamed(data)
+	}
 	buf := bytes.NewBuffer(data)
 
 	var parts []Part
@@ -351,6 +395,32 @@ func (t *Topic) Unmarshal(data []byte) error {
 	return nil
 }
 
+// unmarshalNamed de-serializes topic and the topic string from binary data.
+func (t *Topic) unmarshalNamed(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("topic.Unmarshal: topic is invalid")
+	}
+	depth := uint8(data[1])
+	count := int(binary.LittleEndian.Uint16(data[2:4]))
+	data = data[4:]
+	if len(data) < 5*count {
+		return errors.New("topic.Unmarshal: topic is invalid")
+	}
+	parts := make([]Part, 0, count)
+	for i := 0; i < count; i++ {
+		parts = append(parts, Part{
+			Hash:      binary.LittleEndian.Uint32(data[1:5]),
+			Wildchars: uint8(data[0]),
+		})
+		data = data[5:]
+	}
+	t.Depth = depth
+	t.Parts = parts
+	t.Topic = make([]byte, len(data))
+	copy(t.Topic, data)
+	return nil
+}
+
 // unsafeToString is used to convert a slice
 // of bytes to a string without incurring overhead.
 func unsafeToString(bs []byte) string {
@@ -32,6 +32,12 @@ type _Flags struct {
 
 	// backgroundKeyExpiry sets flag to run key expirer.
 	backgroundKeyExpiry bool
+
+	// readOnly opens the DB for reads without the write ahead log and background goroutines.
+	readOnly bool
+
+	// lastValueCache keeps the latest message of each topic to read it using DB.Latest.
+	lastValueCache bool
 }
 
 // _BatchOptions is used to set options when using batch operation.
@@ -68,6 +74,9 @@ type _Options struct {
 	// encryptionKey is used for message encryption.
 	encryptionKey []byte
 
+	// keyring sets the current key to encrypt messages and old keys to decrypt messages.
+	keyring []EncryptionKey
+
 	// bufferSize sets Size of buffer to use for pooling.
 	bufferSize int64
 
@@ -76,6 +85,39 @@ type _Options struct {
 
 	// freeBlockSize minimum freeblocks size before free blocks are allocated and reused.
 	freeBlockSize int64
+
+	// rollups configures continuous downsampling of topics.
+	rollups []Rollup
+
+	// topicCompactions configures topics to keep only the newest messages.
+	topicCompactions []TopicCompaction
+
+	// segmentSize sets size of data, index and window file segments, zero to write a single file of each type.
+	segmentSize int64
+
+	// segmentDuration sets time period to roll data file to the next segment.
+	segmentDuration time.Duration
+
+	// watchBufferSize sets size of buffer of a watcher.
+	watchBufferSize int
+
+	// watchOverflow sets policy applied if the buffer of a watcher is full.
+	watchOverflow WatchOverflow
+
+	// codec sets codec to compress payloads, snappy is used if codec is not set.
+	codec Codec
+
+	// topicCodecs sets codecs to compress payloads of topics matching the prefix.
+	topicCodecs []_TopicCodec
+
+	// codecs registers codecs to decode payloads.
+	codecs []Codec
+
+	// dedupWindow sets time period to deduplicate entries put with a dedup key.
+	dedupWindow time.Duration
+
+	// retention sets retention policies applied by the expirer.
+	retention []RetentionPolicy
 }
 
 // Options it contains configurable options and flags for DB.
@@ -125,6 +167,15 @@ func WithEncryption() Options {
 	})
 }
 
+// WithReadOnly opens an existing DB for reads, the DB can be opened by a writer and any number of readers.
+// Files are opened for reads and are not created, the blockcache and the write ahead log are not opened.
+// Writes are rejected, use DB.Refresh to read blocks synced by the writer after the DB is opened.
+func WithReadOnly() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.readOnly = true
+	})
+}
+
 // WithBackgroundKeyExpiry sets background key expiry for DB.
 func WithBackgroundKeyExpiry() Options {
 	return newFuncOption(func(o *_Options) {
@@ -132,6 +183,14 @@ func WithBackgroundKeyExpiry() Options {
 	})
 }
 
+// WithLastValueCache enables the last-value cache, the cache keeps the latest message of each topic
+// to read the current state of the topics using DB.Latest and DB.LatestMatching.
+func WithLastValueCache() Options {
+	return newFuncOption(func(o *_Options) {
+		o.flags.lastValueCache = true
+	})
+}
+
 // WithDefaultBatchOptions will set some default values for Batch operation.
 //   contract: MasterContract
 //   encryption: False
@@ -187,6 +246,12 @@ func WithDefaultOptions() Options {
 		if o.freeBlockSize == 0 {
 			o.freeBlockSize = 1 << 27 // minimum size of (128MB).
 		}
+		if o.watchBufferSize == 0 {
+			o.watchBufferSize = 1000
+		}
+		if o.dedupWindow == 0 {
+			o.dedupWindow = 10 * time.Minute
+		}
 		if o.encryptionKey == nil {
 			o.encryptionKey = []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")
 		}
@@ -246,3 +311,89 @@ func WithEncryptionKey(key []byte) Options {
 		o.encryptionKey = key
 	})
 }
+
+// WithKeyring sets the current key to encrypt messages and old keys to decrypt messages encrypted before the key rotation.
+// Use DB.ReencryptAll() to encrypt messages with the current key before removing old keys from the keyring.
+func WithKeyring(current EncryptionKey, old ...EncryptionKey) Options {
+	return newFuncOption(func(o *_Options) {
+		o.keyring = append([]EncryptionKey{current}, old...)
+	})
+}
+
+// WithRollup adds rollup to continuously downsample messages of the source topic into the target topic.
+// Rollups are computed by the syncer for each finished time bucket.
+func WithRollup(r Rollup) Options {
+	return newFuncOption(func(o *_Options) {
+		o.rollups = append(o.rollups, r)
+	})
+}
+
+// WithRetention adds retention policy to limit age or size of messages stored on topics matching the topic pattern of the policy.
+// Policies set with the option are applied each time the DB is opened, use DB.SetRetention to add a policy to an open DB.
+func WithRetention(p RetentionPolicy) Options {
+	return newFuncOption(func(o *_Options) {
+		o.retention = append(o.retention, p)
+	})
+}
+
+// WithTopicCompaction keeps only the newest messages of each topic matching the topic pattern of the compaction.
+func WithTopicCompaction(c TopicCompaction) Options {
+	return newFuncOption(func(o *_Options) {
+		o.topicCompactions = append(o.topicCompactions, c)
+	})
+}
+
+// WithSegmentSize splits data, index and window files into segment files of the size, the size is rounded up to MB.
+// The segment size is set when the DB is created, it has no effect on an existing DB. Free blocks are not reused
+// in a segmented data file, so a data segment is removed once all its messages are deleted or expired.
+func WithSegmentSize(size int64) Options {
+	return newFuncOption(func(o *_Options) {
+		o.segmentSize = (size + 1<<20 - 1) &^ (1<<20 - 1)
+	})
+}
+
+// WithSegmentDuration rolls data file to the next segment after the time period, for example daily.
+// Time periods are aligned to UTC. A new DB uses segments of 1GB if the segment size is not set.
+func WithSegmentDuration(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.segmentDuration = dur
+	})
+}
+
+// WithWatchBuffer sets the buffer size of a watcher and the policy applied if the buffer is full.
+func WithWatchBuffer(size int, overflow WatchOverflow) Options {
+	return newFuncOption(func(o *_Options) {
+		o.watchBufferSize = size
+		o.watchOverflow = overflow
+	})
+}
+
+// WithCodec sets codec to compress payloads. Entries stored with another codec are decoded with the codec they were stored with.
+func WithCodec(c Codec) Options {
+	return newFuncOption(func(o *_Options) {
+		o.codec = c
+	})
+}
+
+// WithTopicCodec sets codec to compress payloads of topics with the prefix, for example a zstd codec with a dictionary trained on the payloads of the topics.
+// The codec with the longest matching prefix is used.
+func WithTopicCodec(prefix string, c Codec) Options {
+	return newFuncOption(func(o *_Options) {
+		o.topicCodecs = append(o.topicCodecs, _TopicCodec{prefix: prefix, codec: c})
+	})
+}
+
+// WithCodecs registers custom codecs to decode payloads stored with the codecs, for example if the codec of a topic is changed.
+func WithCodecs(codecs ...Codec) Options {
+	return newFuncOption(func(o *_Options) {
+		o.codecs = append(o.codecs, codecs...)
+	})
+}
+
+// WithDedupWindow sets time period to deduplicate entries put with a dedup key, the default is 10 minutes.
+// An entry put with the contract, topic and dedup key of an entry put within the window is acknowledged but not stored again.
+func WithDedupWindow(dur time.Duration) Options {
+	return newFuncOption(func(o *_Options) {
+		o.dedupWindow = dur
+	})
+}
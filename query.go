@@ -17,6 +17,8 @@
 package unitdb
 
 import (
+	"time"
+
 	"github.com/unit-io/unitdb/message"
 )
 
@@ -25,6 +27,8 @@ type (
 	_Query struct {
 		topicHash uint64
 		seq       uint64
+		expiresAt uint32
+		timestamp int64
 	}
 	_InternalQuery struct {
 		parts      []message.Part // The parts represents a topic which contains a contract and a list of hashes for various parts of the topic.
@@ -32,7 +36,9 @@ type (
 		topicType  uint8
 		prefix     uint64 // The prefix is generated from contract and first of the topic.
 		cutoff     int64  // The cutoff is time limit check on message IDs.
+		upper      int64  // The upper is upper time limit check on message IDs.
 		winEntries []_Query
+		cursor     []byte // The cursor to resume query from the last item of an iterator.
 
 		opts *_QueryOptions
 	}
@@ -63,6 +69,20 @@ func (q *Query) WithLimit(limit int) *Query {
 	return q
 }
 
+// WithRange sets time range on query to get messages stored at or after from and before to.
+// A zero from or to leaves that end of the range open.
+func (q *Query) WithRange(from, to time.Time) *Query {
+	q.internal.cutoff = unixTime(from)
+	q.internal.upper = unixTime(to)
+	return q
+}
+
+// WithCursor sets cursor on query to resume the query from the last item returned by an iterator.
+func (q *Query) WithCursor(cursor []byte) *Query {
+	q.internal.cursor = cursor
+	return q
+}
+
 func (q *Query) parse() error {
 	if q.Contract == 0 {
 		q.Contract = message.MasterContract
@@ -92,8 +112,21 @@ func (q *Query) parse() error {
 			q.Limit = limit
 		}
 	}
+	// In case of range, include it to the query.
+	if from, to, ok := topic.Range(); ok {
+		q.internal.cutoff = unixTime(from)
+		q.internal.upper = unixTime(to)
+	}
 	if q.Limit == 0 {
 		q.Limit = q.internal.opts.defaultQueryLimit
 	}
 	return nil
 }
+
+// unixTime converts time to unix time, zero time is converted to zero.
+func unixTime(t time.Time) int64 {
+	if t.IsZero() || t.Unix() < 0 {
+		return 0
+	}
+	return t.Unix()
+}
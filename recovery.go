@@ -59,9 +59,12 @@ func (db *_SyncHandle) startRecovery() error {
 
 	var err1 error
 	pendingEntries := make(map[uint64]_WindowEntries)
+	// recovered seqs, a seq recovered again from a later time block is an entry replaced before it was synced.
+	recovered := make(map[uint64]struct{})
 
 	err := db.internal.mem.All(func(timeID int64, seqs []uint64) (bool, error) {
 		winEntries := make(map[uint64]_WindowEntries)
+		var replaced []_IndexEntry
 		sort.Slice(seqs[:], func(i, j int) bool {
 			return seqs[i] < seqs[j]
 		})
@@ -89,25 +92,44 @@ func (db *_SyncHandle) startRecovery() error {
 
 				cache: memdata[entrySize:],
 			}
+			if record := dedupRecord(memdata, e); record != nil {
+				e.cache = e.cache[:e.mSize()]
+				db.internal.dedup.append(record, true)
+			}
 			if err := db.blockWriter.append(e); err != nil {
-				if err == errEntryExist {
-					continue
+				if err != errEntryExist {
+					return true, err
 				}
-				return true, err
+				if _, ok := recovered[seq]; ok {
+					// the window entry is recovered from the earlier time block.
+					prev, err := db.blockWriter.replace(e)
+					if err != nil && err != errMsgIDDoesNotExist {
+						return true, err
+					}
+					if err == nil {
+						replaced = append(replaced, prev)
+					}
+				}
+				continue
 			}
+			recovered[seq] = struct{}{}
 			if m.topicSize != 0 {
+				db.internal.topicSeqs.add(seq)
 				rawtopic, _ := db.internal.reader.readTopic(e)
 
 				t := new(message.Topic)
 				if err := t.Unmarshal(rawtopic); err != nil {
 					return false, err
 				}
-				db.internal.trie.add(newTopic(m.topicHash, 0), t.Parts, t.Depth)
+				db.internal.trie.add(newTopic(m.topicHash, t.Topic, 0), t.Parts, t.Depth)
 			}
+			timestamp := message.ID(memdata[entrySize:]).Time()
+			we := newWinEntry(m.seq, m.expiresAt, timestamp)
+			db.internal.lastValues.add(_LastValue{topicHash: m.topicHash, seq: m.seq, timestamp: timestamp, expiresAt: m.expiresAt})
 			if _, ok := winEntries[m.topicHash]; ok {
-				winEntries[m.topicHash] = append(winEntries[m.topicHash], newWinEntry(e.seq, m.expiresAt))
+				winEntries[m.topicHash] = append(winEntries[m.topicHash], we)
 			} else {
-				winEntries[m.topicHash] = _WindowEntries{newWinEntry(m.seq, m.expiresAt)}
+				winEntries[m.topicHash] = _WindowEntries{we}
 			}
 			db.internal.filter.Append(e.seq)
 			db.syncInfo.count++
@@ -136,6 +158,9 @@ func (db *_SyncHandle) startRecovery() error {
 		if err := db.sync(true); err != nil {
 			return true, err
 		}
+		for _, prev := range replaced {
+			db.internal.freeList.free(prev.seq, prev.msgOffset, prev.mSize())
+		}
 		if db.syncInfo.syncComplete {
 			// if err := timeRelease(timeID); err != nil {
 			// 	return false, err
@@ -0,0 +1,597 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	fltr "github.com/unit-io/unitdb/filter"
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/wal"
+)
+
+const (
+	quarantineDir = "quarantine"
+	reportName    = "report.json"
+
+	// maxFreeBlockSize is maximum size of a free block written to the lease.
+	maxFreeBlockSize = 1 << 30
+)
+
+type (
+	// RepairReport reports changes made by Repair to the DB.
+	RepairReport struct {
+		Dir          string   `json:"dir"`           // The directory of quarantined blocks, messages and logs.
+		Header       bool     `json:"header"`        // The header of the info file was rewritten.
+		Logs         []string `json:"logs"`          // The write ahead logs quarantined.
+		IndexBlocks  []int64  `json:"index_blocks"`  // The offsets of index blocks quarantined.
+		WindowBlocks []int64  `json:"window_blocks"` // The offsets of window blocks quarantined.
+		Messages     []int64  `json:"messages"`      // The offsets of messages quarantined, their entries are deleted.
+		Topics       int      `json:"topics"`        // The number of topics of the window block chains.
+		Entries      int      `json:"entries"`       // The number of entries of the index.
+		Orphans      int      `json:"orphans"`       // The number of entries not linked to a topic.
+		FreeSize     int64    `json:"free_size"`     // The size of free blocks of the data file.
+	}
+
+	// _Repair rebuilds window block chains, lease and filter of the DB from the index and data files.
+	_Repair struct {
+		path   string
+		opts   *_Options
+		fs     *_FileSet
+		info   _DBInfo
+		report *RepairReport
+
+		maxSeq uint64
+		// seqs is map of seqs of live entries and deleted entries keeping the topic to the time of the entries.
+		seqs map[uint64]int64
+		// carriers is map of topic hash to seq of the first entry of the topic.
+		carriers map[uint64]uint64
+		// used is list of message ranges in use in the data file.
+		used [][2]int64
+	}
+)
+
+// Repair scans the index and data files of a closed DB and repairs the DB. It quarantines unreadable write ahead logs,
+// index blocks, window blocks and messages, rebuilds window block chains of the topics, the lease and the filter,
+// and writes a report along with the quarantined files. Use WithSegmentSize if the info file of a segmented DB is corrupted.
+func Repair(dirName string, opts ...Options) (*RepairReport, error) {
+	options := &_Options{}
+	WithDefaultOptions().set(options)
+	for _, opt := range opts {
+		if opt != nil {
+			opt.set(options)
+		}
+	}
+	if _, err := os.Stat(dirName); err != nil {
+		return nil, err
+	}
+	lock, err := createLockFile(dirName)
+	if err != nil {
+		if err == os.ErrExist {
+			err = errLocked
+		}
+		return nil, err
+	}
+	defer lock.unlock()
+	// fail if the DB is opened read-only by other processes.
+	rlock, err := createReaderLockFile(dirName, false)
+	if err != nil {
+		if err == os.ErrExist {
+			err = errLocked
+		}
+		return nil, err
+	}
+	defer rlock.unlock()
+
+	r := &_Repair{
+		path:     dirName,
+		opts:     options,
+		report:   &RepairReport{Dir: path.Join(dirName, quarantineDir, time.Now().UTC().Format("20060102T150405"))},
+		seqs:     make(map[uint64]int64),
+		carriers: make(map[uint64]uint64),
+	}
+	if err := os.MkdirAll(r.report.Dir, 0777); err != nil {
+		return nil, err
+	}
+	if err := completeCompaction(dirName); err != nil {
+		return nil, err
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	defer r.fs.close()
+	for _, f := range []func() error{r.repairLogs, r.repairIndex, r.repairWindow, r.repairLease, r.repairFilter, r.writeInfo, r.writeReport} {
+		if err := f(); err != nil {
+			return r.report, err
+		}
+	}
+	return r.report, nil
+}
+
+// open reads the info file and opens files of the DB. The header is rewritten if it is corrupted.
+func (r *_Repair) open() error {
+	infoFile, err := newFile(r.path, 1, _FileDesc{fileType: typeInfo}, false)
+	if err != nil {
+		return err
+	}
+	if infoFile.currSize() >= int64(fixed) {
+		if err := infoFile.readUnmarshalableAt(&r.info, fixed, 0); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(r.info.header.signature[:], signature[:]) {
+		r.info = _DBInfo{
+			header:      _Header{signature: signature, version: version},
+			segmentSize: uint32(r.opts.segmentSize >> 20),
+		}
+		if r.opts.flags.encryption {
+			r.info.encryption = 1
+		}
+		r.report.Header = true
+	}
+	r.maxSeq = r.info.sequence
+
+	segmentSize := int64(r.info.segmentSize) << 20
+	openFile := func(fd _FileDesc) (_FileSet, error) {
+		if segmentSize == 0 {
+			return newFile(r.path, 1, fd, false)
+		}
+		return newSegmentedFile(r.path, fd, segmentSize, 0, false)
+	}
+	list := []_FileSet{infoFile}
+	for _, fileType := range []_FileType{typeTimeWindow, typeIndex, typeData} {
+		f, err := openFile(_FileDesc{fileType: fileType})
+		if err != nil {
+			return err
+		}
+		list = append(list, f)
+	}
+	for _, fileType := range []_FileType{typeLease, typeFilter} {
+		f, err := newFile(r.path, 1, _FileDesc{fileType: fileType}, false)
+		if err != nil {
+			return err
+		}
+		list = append(list, f)
+	}
+	r.fs = &_FileSet{mu: new(sync.RWMutex), list: list}
+	return nil
+}
+
+// quarantine writes the unreadable block or message to the quarantine directory.
+func (r *_Repair) quarantine(name string, off int64, data []byte) error {
+	return ioutil.WriteFile(path.Join(r.report.Dir, fmt.Sprintf("%s-%d.bin", name, off)), data, 0666)
+}
+
+// repairLogs moves the write ahead logs that cannot be recovered to the quarantine directory.
+func (r *_Repair) repairLogs() error {
+	dir := path.Join(r.path, logDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".log") {
+			continue
+		}
+		name := path.Join(dir, fi.Name())
+		var maxSeq uint64
+		ok, err := wal.ValidLog(name, func(record []byte) bool {
+			return validLogRecord(record, &maxSeq)
+		})
+		if err != nil {
+			return err
+		}
+		if ok {
+			if maxSeq > r.maxSeq {
+				r.maxSeq = maxSeq
+			}
+			continue
+		}
+		if err := os.Rename(name, path.Join(r.report.Dir, fi.Name())); err != nil {
+			return err
+		}
+		r.report.Logs = append(r.report.Logs, fi.Name())
+	}
+	return nil
+}
+
+// validLogRecord validates the record of the write ahead log, each record of the log holds entries of the memdb.
+// The max seq is set to the largest seq of the entries of the record.
+func validLogRecord(record []byte, maxSeq *uint64) bool {
+	for len(record) > 0 {
+		rec, ok := nextRecord(&record)
+		if !ok || len(rec) < 9 {
+			return false
+		}
+		key := binary.LittleEndian.Uint64(rec[1:9])
+		if rec[0] == 1 {
+			// deleted key holds the time ID of the entry.
+			if len(rec) < 17 {
+				return false
+			}
+			continue
+		}
+		if !validLogEntry(key, rec[9:]) {
+			return false
+		}
+		if key > *maxSeq {
+			*maxSeq = key
+		}
+	}
+	return true
+}
+
+// nextRecord returns the next length prefixed entry of the record of the memdb.
+func nextRecord(data *[]byte) ([]byte, bool) {
+	if len(*data) < 4 {
+		return nil, false
+	}
+	n := int(binary.LittleEndian.Uint32((*data)[:4]))
+	if n < 4 || n > len(*data) {
+		return nil, false
+	}
+	record := (*data)[4:n]
+	*data = (*data)[n:]
+	return record, true
+}
+
+// validLogEntry validates the entry of the write ahead log, records of the memdb other than entries are skipped.
+func validLogEntry(seq uint64, data []byte) bool {
+	if len(data) < entrySize {
+		return true
+	}
+	var m _Entry
+	if err := m.UnmarshalBinary(data[:entrySize]); err != nil || m.seq != seq {
+		return true
+	}
+	e := _IndexEntry{seq: m.seq, topicSize: m.topicSize, valueSize: m.valueSize}
+	msg := data[entrySize:]
+	// dedup record of the entry put with a dedup key is stored after the message.
+	if n := int64(len(msg)); n != int64(e.mSize()) && n != int64(e.mSize())+dedupRecordSize {
+		return false
+	}
+	msg = msg[:e.mSize()]
+	if msg[idSize-1]&flagChecksum != 0 && !validChecksum(msg) {
+		return false
+	}
+	if m.topicSize != 0 {
+		t := new(message.Topic)
+		if err := t.Unmarshal(msg[idSize : idSize+uint32(m.topicSize)]); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// repairIndex validates index blocks and messages of the entries. Unreadable index blocks are quarantined and replaced
+// with empty blocks, entries of unreadable messages are deleted.
+func (r *_Repair) repairIndex() error {
+	indexFile, err := r.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return err
+	}
+	dataFile, err := r.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return err
+	}
+	size := indexFile.currSize()
+	dataSize := dataFile.currSize()
+	for bIdx := int32(0); blockOffset(bIdx)+int64(blockSize) <= size; bIdx++ {
+		off := blockOffset(bIdx)
+		buf, err := indexFile.slice(off, off+int64(blockSize))
+		if err != nil {
+			return err
+		}
+		var b _IndexBlock
+		if !validBlockChecksum(buf) || b.unmarshalBinary(buf) != nil || !validIndexBlock(b, bIdx) {
+			if err := r.quarantine(indexDir, off, buf); err != nil {
+				return err
+			}
+			if _, err := indexFile.WriteAt(_IndexBlock{}.marshalBinary(), off); err != nil {
+				return err
+			}
+			r.report.IndexBlocks = append(r.report.IndexBlocks, off)
+			continue
+		}
+		dirty := false
+		for i := 0; i < entriesPerIndexBlock; i++ {
+			e := b.entries[i]
+			if e.seq == 0 {
+				continue
+			}
+			if e.seq > r.maxSeq {
+				r.maxSeq = e.seq
+			}
+			if e.msgOffset == -1 {
+				continue
+			}
+			ok, err := r.repairEntry(dataFile, dataSize, &b.entries[i])
+			if err != nil {
+				return err
+			}
+			if !ok {
+				dirty = true
+			}
+		}
+		if dirty {
+			if _, err := indexFile.WriteAt(b.marshalBinary(), off); err != nil {
+				return err
+			}
+		}
+	}
+	return indexFile.Sync()
+}
+
+// validIndexBlock validates entries of the index block.
+func validIndexBlock(b _IndexBlock, bIdx int32) bool {
+	for i := 0; i < entriesPerIndexBlock; i++ {
+		e := b.entries[i]
+		if e.seq == 0 {
+			continue
+		}
+		if blockIndex(e.seq) != bIdx || e.msgOffset < -1 || e.valueSize > maxValueLength<<1 {
+			return false
+		}
+	}
+	return true
+}
+
+// repairEntry validates message of the entry and records the entry. It returns false if the entry is deleted.
+func (r *_Repair) repairEntry(dataFile *_File, dataSize int64, e *_IndexEntry) (bool, error) {
+	end := e.msgOffset + int64(e.mSize())
+	if end > dataSize {
+		r.report.Messages = append(r.report.Messages, e.msgOffset)
+		e.msgOffset = -1
+		return false, nil
+	}
+	msg, err := dataFile.slice(e.msgOffset, end)
+	if err == errMsgIDDeleted {
+		// message of a removed data segment.
+		e.msgOffset = -1
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	valid := e.valueSize == 0 || msg[idSize-1]&flagChecksum == 0 || validChecksum(msg)
+	var topicHash uint64
+	if e.topicSize != 0 {
+		t := new(message.Topic)
+		if err := t.Unmarshal(msg[idSize : idSize+uint32(e.topicSize)]); err != nil || len(t.Parts) == 0 {
+			valid = false
+			e.valueSize = 0
+		} else {
+			topicHash = t.GetHash(message.ID(msg[:idSize]).Contract())
+		}
+	}
+	if !valid {
+		if err := r.quarantine(dataDir, e.msgOffset, msg); err != nil {
+			return false, err
+		}
+		r.report.Messages = append(r.report.Messages, e.msgOffset)
+		if topicHash == 0 {
+			e.msgOffset = -1
+			return false, nil
+		}
+		// entry keeps the topic if the value is unreadable.
+		e.valueSize = 0
+	}
+	r.seqs[e.seq] = message.ID(msg[:idSize]).Time()
+	if topicHash != 0 {
+		if seq, ok := r.carriers[topicHash]; !ok || e.seq < seq {
+			r.carriers[topicHash] = e.seq
+		}
+	}
+	if e.valueSize != 0 {
+		r.report.Entries++
+	}
+	r.used = append(r.used, [2]int64{e.msgOffset, e.msgOffset + int64(e.mSize())})
+	return valid, nil
+}
+
+// repairWindow reads window entries of the entries of the index and writes a new window file with a single chain of window blocks for each topic.
+// Entries of a topic are linked to the first entry of the topic if the window blocks of the topic are unreadable.
+func (r *_Repair) repairWindow() error {
+	winFile, err := r.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return err
+	}
+	topics := make(map[uint64]_WindowEntries)
+	linked := make(map[uint64]struct{})
+	size := winFile.currSize()
+	// the first block holds entries in a window file written before version 2.
+	for off := int64(0); off+int64(blockSize) <= size; off += int64(blockSize) {
+		buf, err := winFile.slice(off, off+int64(blockSize))
+		if err != nil {
+			return err
+		}
+		if off == 0 && bytes.Count(buf, []byte{0}) == len(buf) {
+			continue
+		}
+		var b _WinBlock
+		if !validBlockChecksum(buf) || b.unmarshalBinary(buf) != nil || b.entryIdx > entriesPerWindowBlock {
+			if err := r.quarantine(winDir, off, buf); err != nil {
+				return err
+			}
+			r.report.WindowBlocks = append(r.report.WindowBlocks, off)
+			continue
+		}
+		for i := 0; i < int(b.entryIdx); i++ {
+			we := b.entries[i]
+			if _, ok := r.seqs[we.seq()]; !ok {
+				continue
+			}
+			if _, ok := linked[we.seq()]; ok {
+				continue
+			}
+			linked[we.seq()] = struct{}{}
+			topics[b.topicHash] = append(topics[b.topicHash], we)
+		}
+	}
+	for h, seq := range r.carriers {
+		if _, ok := linked[seq]; !ok {
+			linked[seq] = struct{}{}
+			topics[h] = append(topics[h], newWinEntry(seq, 0, 0))
+		}
+	}
+	r.report.Orphans = len(r.seqs) - len(linked)
+
+	newWin, err := newCompactFile(winFile)
+	if err != nil {
+		return err
+	}
+	c := &_Compaction{newWin: newWin}
+	defer c.close()
+	// The first block is left empty so a window block never links to the offset zero.
+	if _, err := newWin.write(_WinBlock{}.marshalBinary()); err != nil {
+		return err
+	}
+	hashes := make([]uint64, 0, len(topics))
+	for h := range topics {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	for _, h := range hashes {
+		entries := topics[h]
+		sort.Slice(entries, func(i, j int) bool { return entries[i].seq() < entries[j].seq() })
+		// topic is loaded from the first entry of the oldest window block.
+		if _, ok := r.carriers[h]; !ok || entries[0].seq() != r.carriers[h] {
+			r.report.Orphans += len(entries)
+			continue
+		}
+		var off, cutoffTime int64
+		for len(entries) > 0 {
+			n := len(entries)
+			if n > entriesPerWindowBlock {
+				n = entriesPerWindowBlock
+			}
+			b := _WinBlock{topicHash: h, next: off, cutoffTime: cutoffTime, entryIdx: uint16(n)}
+			copy(b.entries[:], entries[:n])
+			for i, we := range entries[:n] {
+				b.entries[i].timestamp = r.seqs[we.seq()]
+				b.setTime(b.entries[i].timestamp)
+			}
+			cutoffTime = b.cutoffTime
+			if off, err = c.writeWindowBlock(b); err != nil {
+				return err
+			}
+			entries = entries[n:]
+		}
+		r.report.Topics++
+	}
+	if err := newWin.Sync(); err != nil {
+		return err
+	}
+	if err := r.fs.replaceFile(newWin); err != nil {
+		return err
+	}
+	c.newWin = nil
+	return nil
+}
+
+// repairLease writes the free blocks of the data file not used by the messages of the entries.
+func (r *_Repair) repairLease() error {
+	leaseFile, err := r.fs.getFile(_FileDesc{fileType: typeLease})
+	if err != nil {
+		return err
+	}
+	dataFile, err := r.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return err
+	}
+	lease := newLease(_FileSet{_File: leaseFile}, r.opts.freeBlockSize)
+	sort.Slice(r.used, func(i, j int) bool { return r.used[i][0] < r.used[j][0] })
+	free := func(start, end int64) {
+		for start < end {
+			size := end - start
+			if size > maxFreeBlockSize {
+				size = maxFreeBlockSize
+			}
+			lease.freeBlock(start, uint32(size))
+			start += size
+		}
+	}
+	var off int64
+	for _, u := range r.used {
+		if u[0] > off {
+			free(off, u[0])
+		}
+		if u[1] > off {
+			off = u[1]
+		}
+	}
+	free(off, dataFile.currSize())
+	r.report.FreeSize = lease.size
+	return lease.write()
+}
+
+// repairFilter writes the filter of the seqs of the entries.
+func (r *_Repair) repairFilter() error {
+	filterFile, err := r.fs.getFile(_FileDesc{fileType: typeFilter})
+	if err != nil {
+		return err
+	}
+	g := fltr.NewFilterGenerator()
+	for seq := range r.seqs {
+		g.Append(seq)
+	}
+	if err := filterFile.Truncate(0); err != nil {
+		return err
+	}
+	_, err = filterFile.WriteAt(g.Finish(), 0)
+	return err
+}
+
+// writeInfo writes the info file with the sequence and the count of the entries.
+func (r *_Repair) writeInfo() error {
+	infoFile, err := r.fs.getFile(_FileDesc{fileType: typeInfo})
+	if err != nil {
+		return err
+	}
+	// the window file is rebuilt with the first block left empty.
+	r.info.header.version = version
+	r.info.sequence = r.maxSeq
+	r.info.count = uint64(r.report.Entries)
+	if infoFile.currSize() < int64(fixed) {
+		if _, err := infoFile.extend(fixed - uint32(infoFile.currSize())); err != nil {
+			return err
+		}
+	}
+	return infoFile.writeMarshalableAt(r.info, 0)
+}
+
+// writeReport writes the report into the quarantine directory.
+func (r *_Repair) writeReport() error {
+	data, err := json.MarshalIndent(r.report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(r.report.Dir, reportName), data, 0666)
+}
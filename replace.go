@@ -0,0 +1,167 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// replace supersedes the message with the ID and topic of the entry, the ID, time and expiry of the message are kept.
+// A message not yet synced is replaced in the memdb and a synced message is replaced in the index and data files,
+// the files are synced before the previous message is freed.
+func (db *DB) replace(ctx context.Context, e *Entry) error {
+	if len(e.ID) == 0 {
+		return errMsgIDEmpty
+	}
+	seq := message.ID(e.ID).Sequence()
+	if e.Contract == 0 {
+		e.Contract = message.MasterContract
+	}
+	t, _, err := db.parseTopic(e.Contract, e.Topic)
+	if err != nil {
+		return err
+	}
+	t.AddContract(e.Contract)
+	topicHash := t.GetHash(e.Contract)
+
+	// Lock sync so the message is not synced while it is replaced.
+	select {
+	case db.internal.syncLockC <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+
+	memdata, _ := db.internal.mem.Get(seq)
+	var prev _IndexEntry
+	var m _Entry
+	if memdata != nil {
+		m.UnmarshalBinary(memdata[:entrySize])
+		prev = _IndexEntry{
+			seq:       m.seq,
+			topicSize: m.topicSize,
+			valueSize: m.valueSize,
+
+			cache: memdata[entrySize:],
+		}
+	} else {
+		prev, err = db.readEntry(_Query{seq: seq})
+		if err == errMsgIDDeleted || (err == nil && prev.isDeleted()) {
+			return errMsgIDDoesNotExist
+		}
+		if err != nil {
+			return err
+		}
+	}
+	id, _, err := db.internal.reader.readMessage(prev)
+	if err == errMsgIDDeleted {
+		return errMsgIDDoesNotExist
+	}
+	if err != nil {
+		return err
+	}
+	prefix := message.ID(id)
+	if prefix.Contract() != e.Contract {
+		return errMsgIDPrefixMismatch
+	}
+	if memdata != nil {
+		if m.topicHash != topicHash {
+			return errMsgIDPrefixMismatch
+		}
+		e.ExpiresAt = m.expiresAt
+	} else {
+		off, ok := db.internal.trie.getOffset(topicHash)
+		if !ok {
+			return errMsgIDPrefixMismatch
+		}
+		we, ok, err := db.internal.timeWindow.find(ctx, db.fs, topicHash, off, seq, prefix.Time())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errMsgIDPrefixMismatch
+		}
+		e.ExpiresAt = we.expiryTime()
+	}
+
+	e.Timestamp = time.Unix(prefix.Time(), 0)
+	e.DedupKey = nil
+	e.entry.parsed = false
+	e.entry.carrier = prev.topicSize != 0
+	if err := db.setEntry(e); err != nil {
+		return err
+	}
+
+	if memdata != nil {
+		timeID, err := db.internal.mem.Replace(ctx, seq, e.entry.cache)
+		if err != nil {
+			return err
+		}
+		// the window entry is moved to the time block of the replacing entry so it is synced along with the entry.
+		db.internal.timeWindow.move(timeID, topicHash, newWinEntry(seq, e.entry.expiresAt, prefix.Time()))
+	} else {
+		buf := db.internal.bufPool.Get()
+		defer db.internal.bufPool.Put(buf)
+		w, err := newBlockWriter(db.fs, db.internal.freeList, buf)
+		if err != nil {
+			return err
+		}
+		prev, err = w.replace(_IndexEntry{
+			seq:       seq,
+			topicSize: e.entry.topicSize,
+			valueSize: e.entry.valueSize,
+
+			cache: e.entry.cache[entrySize:],
+		})
+		if err != nil {
+			return err
+		}
+		db.internal.compactChanges.change(seq)
+		if err := w.write(); err != nil {
+			return err
+		}
+		// sync the replacing message and the index block before the previous message is freed,
+		// so its data block is not reused while the index on disk still refers to it.
+		if err := w.dataFile.Sync(); err != nil {
+			return err
+		}
+		if err := w.indexFile.Sync(); err != nil {
+			return err
+		}
+		db.internal.freeList.free(prev.seq, prev.msgOffset, prev.mSize())
+		if db.internal.syncWrites {
+			if err := db.sync(); err != nil {
+				return err
+			}
+		}
+	}
+
+	db.internal.meter.Puts.Inc(1)
+
+	if db.internal.watchers.len() != 0 {
+		db.notify([]Entry{db.watchEntry(e)})
+	}
+
+	// reset message entry.
+	e.reset()
+	return nil
+}
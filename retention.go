@@ -0,0 +1,316 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// maxRetentionDeletes is the maximum number of entries deleted at once on applying retention policy.
+	maxRetentionDeletes = 1000
+)
+
+type (
+	// RetentionPolicy limits age and size of messages stored on topics of a contract.
+	// Messages outside the policy are deleted by the expirer even if they were stored without a TTL.
+	RetentionPolicy struct {
+		// Topic is the topic pattern as in DB.Topics, the policy applies to all topics of the contract if it is empty.
+		Topic    []byte
+		Contract uint32
+		// MaxAge deletes messages older than the max age, zero means no age limit.
+		MaxAge time.Duration
+		// MaxSize caps the size in bytes of messages of all matching topics, oldest messages are deleted first.
+		// Zero means no size limit.
+		MaxSize int64
+	}
+
+	_RetentionPolicies struct {
+		sync.RWMutex
+		policies []RetentionPolicy
+
+		// pruned holds offset of the window block of a topic from which the window blocks of the topic are older
+		// than a max age and their entries are deleted. It is reset if window blocks are moved by compaction.
+		pruned    map[uint64]int64
+		prunedGen uint64
+	}
+)
+
+// newRetentionPolicies validates the policies set on open of the DB.
+func newRetentionPolicies(policies []RetentionPolicy) (*_RetentionPolicies, error) {
+	r := &_RetentionPolicies{}
+	for _, p := range policies {
+		if err := r.set(p); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// set adds the retention policy or replaces the policy of the same topic and contract.
+func (r *_RetentionPolicies) set(p RetentionPolicy) error {
+	switch {
+	case p.MaxAge < 0 || p.MaxSize < 0 || (p.MaxAge == 0 && p.MaxSize == 0):
+		return errRetentionInvalid
+	case len(p.Topic) > maxTopicLength:
+		return errTopicTooLarge
+	}
+	if p.Contract == 0 {
+		p.Contract = message.MasterContract
+	}
+	r.Lock()
+	defer r.Unlock()
+	for i, policy := range r.policies {
+		if policy.Contract == p.Contract && bytes.Equal(policy.Topic, p.Topic) {
+			r.policies[i] = p
+			return nil
+		}
+	}
+	r.policies = append(r.policies, p)
+	return nil
+}
+
+// SetRetention adds the retention policy or replaces the policy of the same topic and contract.
+// Use WithRetention option to set the policy on open of the DB.
+func (db *DB) SetRetention(p RetentionPolicy) error {
+	return db.internal.retention.set(p)
+}
+
+// RemoveRetention removes the retention policy of the topic and contract.
+func (db *DB) RemoveRetention(topic []byte, contract uint32) {
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	r := db.internal.retention
+	r.Lock()
+	defer r.Unlock()
+	for i, policy := range r.policies {
+		if policy.Contract == contract && bytes.Equal(policy.Topic, topic) {
+			r.policies = append(r.policies[:i], r.policies[i+1:]...)
+			return
+		}
+	}
+}
+
+// Retentions returns the retention policies.
+func (db *DB) Retentions() []RetentionPolicy {
+	r := db.internal.retention
+	r.RLock()
+	defer r.RUnlock()
+	return append([]RetentionPolicy(nil), r.policies...)
+}
+
+// applyRetention deletes messages outside the retention policies.
+func (db *DB) applyRetention() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	for _, p := range db.Retentions() {
+		if err := db.retain(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retain deletes messages outside the policy.
+func (db *DB) retain(p RetentionPolicy) error {
+	var dels []_Query
+	var pruned map[uint64]int64
+	var err error
+	if p.MaxSize == 0 {
+		dels, pruned, err = db.outsideMaxAge(p)
+	} else {
+		dels, err = db.outsidePolicy(p)
+	}
+	if err != nil {
+		return err
+	}
+	for len(dels) > 0 {
+		n := len(dels)
+		if n > maxRetentionDeletes {
+			n = maxRetentionDeletes
+		}
+		if err := db.deleteEntries(dels[:n]); err != nil {
+			return err
+		}
+		dels = dels[n:]
+	}
+	r := db.internal.retention
+	r.Lock()
+	defer r.Unlock()
+	for h, off := range pruned {
+		r.pruned[h] = off
+	}
+	return nil
+}
+
+// retentionTopics returns topics matching the policy.
+func (db *DB) retentionTopics(p RetentionPolicy) []_Topic {
+	var topics []_Topic
+	parts := splitTopic(p.Topic)
+	for _, topic := range db.internal.trie.topics(p.Contract) {
+		if len(p.Topic) != 0 && (topic.name == "" || !matchTopic(parts, splitTopic([]byte(topic.name)))) {
+			continue
+		}
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// outsidePolicy walks messages of topics matching the policy in reverse time order and returns messages outside the policy.
+func (db *DB) outsidePolicy(p RetentionPolicy) ([]_Query, error) {
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, err
+	}
+	it := &ItemIterator{db: db, query: &Query{}, winFile: winFile, lastSeq: math.MaxUint64}
+	for _, topic := range db.retentionTopics(p) {
+		it.addCursor(topic, 0)
+	}
+	cutoff := int64(0)
+	if p.MaxAge > 0 {
+		cutoff = time.Now().Add(-p.MaxAge).Unix()
+	}
+	var size int64
+	var dels []_Query
+	for {
+		qe, ok, err := it.nextEntry()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		e, err := db.readEntry(qe)
+		if err != nil {
+			if err == errMsgIDDeleted {
+				continue
+			}
+			return nil, err
+		}
+		id, _, err := db.internal.reader.readMessage(e)
+		if err != nil {
+			return nil, err
+		}
+		size += int64(e.mSize())
+		if (p.MaxSize > 0 && size > p.MaxSize) || message.ID(id).Time() < cutoff {
+			dels = append(dels, qe)
+		}
+	}
+	return dels, nil
+}
+
+// outsideMaxAge returns messages of topics matching the policy older than the max age of the policy.
+// Window blocks with the cutoff time older than the max age are deleted without reading the messages, and
+// the walk of a topic stops at the window block from which the older window blocks were deleted earlier.
+// It returns offsets of the window blocks of the topics from which the older window blocks are deleted.
+func (db *DB) outsideMaxAge(p RetentionPolicy) ([]_Query, map[uint64]int64, error) {
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, nil, err
+	}
+	r := db.internal.retention
+	r.Lock()
+	if r.pruned == nil || r.prunedGen != db.internal.compactGen {
+		r.pruned = make(map[uint64]int64)
+		r.prunedGen = db.internal.compactGen
+	}
+	prunedOff := make(map[uint64]int64, len(r.pruned))
+	for h, off := range r.pruned {
+		prunedOff[h] = off
+	}
+	r.Unlock()
+
+	cutoff := time.Now().Add(-p.MaxAge).Unix()
+	var dels []_Query
+	older := func(qe _Query) error {
+		id, err := db.readID(qe)
+		if err != nil {
+			if err == errMsgIDDeleted {
+				return nil
+			}
+			return err
+		}
+		if id.Time() < cutoff {
+			dels = append(dels, qe)
+		}
+		return nil
+	}
+	pruned := make(map[uint64]int64)
+	for _, topic := range db.retentionTopics(p) {
+		for _, we := range db.internal.timeWindow.ilookup(topic.hash, 0, math.MaxInt32) {
+			if err := older(_Query{topicHash: topic.hash, seq: we.seq(), expiresAt: we.expiryTime()}); err != nil {
+				return nil, nil, err
+			}
+		}
+		// mark is offset of the newest window block from which all walked window blocks are older than the max age.
+		// The head window block of the topic is not marked as later syncs append entries to it, the next block is marked instead.
+		mark := int64(0)
+		for off := topic.offset; off != 0 && off != prunedOff[topic.hash]; {
+			wr := _WindowReader{winFile: winFile, offset: off}
+			b, err := wr.readWindowBlock()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, nil, err
+			}
+			if b.topicHash != topic.hash {
+				break
+			}
+			cutoffBlock := b.cutoff(cutoff)
+			switch {
+			case !cutoffBlock:
+				mark = 0
+			case mark == 0 && off == topic.offset:
+				mark = b.next
+			case mark == 0:
+				mark = off
+			}
+			for i := 0; i < int(b.entryIdx); i++ {
+				we := b.entries[i]
+				if we.seq() == 0 {
+					continue
+				}
+				qe := _Query{topicHash: topic.hash, seq: we.seq(), expiresAt: we.expiryTime()}
+				if cutoffBlock {
+					dels = append(dels, qe)
+					continue
+				}
+				if err := older(qe); err != nil {
+					return nil, nil, err
+				}
+			}
+			off = b.next
+		}
+		if mark != 0 {
+			pruned[topic.hash] = mark
+		}
+	}
+	return dels, pruned, nil
+}
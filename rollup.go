@@ -0,0 +1,181 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// aggNames are names of aggregate functions used as fields of rollup payloads.
+var aggNames = [...]string{"count", "sum", "min", "max", "avg"}
+
+type (
+	// Rollup configures continuous downsampling of messages of the source topic into the target topic.
+	// Each finished time bucket is written to the target topic as a JSON payload containing the
+	// bucket "time" in unix seconds, the message "count" and a field for each aggregate function.
+	// If the source topic is a wildcard topic each matching topic is rolled up into its own target topic,
+	// the target topic followed by the parts of the topic from the first wildcard part of the source topic.
+	Rollup struct {
+		Source   []byte        // The topic or the wildcard topic to query messages to rollup.
+		Target   []byte        // The topic or the prefix of the topics to write rollups to.
+		Contract uint32        // The contract of the source and target topics.
+		Bucket   time.Duration // The width of the time bucket.
+		Funcs    []AggFunc     // The aggregate functions to compute for each bucket.
+		Field    string        // The numeric field of the payload to aggregate, see AggSpec.
+	}
+
+	_Rollup struct {
+		mu sync.Mutex
+		Rollup
+		// last is the end time of the last rolled up bucket of each source topic, a topic is added once read from its target topic.
+		last map[string]int64
+	}
+)
+
+func newRollups(rollups []Rollup) ([]*_Rollup, error) {
+	var rs []*_Rollup
+	for _, r := range rollups {
+		if len(r.Source) == 0 || len(r.Target) == 0 || r.Bucket < time.Second {
+			return nil, errRollupInvalid
+		}
+		for _, f := range r.Funcs {
+			if f > AggAvg {
+				return nil, errRollupInvalid
+			}
+		}
+		rs = append(rs, &_Rollup{Rollup: r, last: make(map[string]int64)})
+	}
+	return rs, nil
+}
+
+// rollup computes rollups for finished time buckets and writes them to the target topics.
+func (db *DB) rollup() error {
+	now := time.Now().Unix()
+	for _, r := range db.internal.rollups {
+		if err := db.rollupBuckets(r, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) rollupBuckets(r *_Rollup, now int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, source := range db.rollupSources(r) {
+		if err := db.rollupTopic(r, source, r.target(source), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupSources returns the source topic, or the topics matching the source topic if it is a wildcard topic.
+// Target topics of the rollup are skipped so rollups are not rolled up again.
+func (db *DB) rollupSources(r *_Rollup) [][]byte {
+	parts := splitTopic(r.Source)
+	if !isWildcardTopic(parts) {
+		return [][]byte{r.Source}
+	}
+	contract := r.Contract
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	targets := append(splitTopic(r.Target), []byte(message.TopicGenericSymbol))
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	var sources [][]byte
+	for _, topic := range db.internal.trie.topics(contract) {
+		if topic.name == "" {
+			continue
+		}
+		name := splitTopic([]byte(topic.name))
+		if isWildcardTopic(name) || !matchTopic(parts, name) || matchTopic(targets, name) {
+			continue
+		}
+		sources = append(sources, []byte(topic.name))
+	}
+	return sources
+}
+
+// target returns the target topic of the source topic. The target topic of a topic matching the wildcard source topic
+// is the target topic followed by the parts of the topic from the first wildcard part of the source topic.
+func (r *_Rollup) target(source []byte) []byte {
+	parts := splitTopic(r.Source)
+	for i, p := range parts {
+		if string(p) == message.TopicGenericSymbol || (len(p) == 1 && p[0] == message.TopicWildcardSymbol) {
+			target := append(splitTopic(r.Target), splitTopic(source)[i:]...)
+			return bytes.Join(target, []byte{message.TopicSeparator})
+		}
+	}
+	return r.Target
+}
+
+// rollupTopic computes rollups of the source topic for finished time buckets and writes them to the target topic.
+func (db *DB) rollupTopic(r *_Rollup, source, target []byte, now int64) error {
+	bucketSize := int64(r.Bucket / time.Second)
+	upper := now - now%bucketSize
+	last, ok := r.last[string(source)]
+	if !ok {
+		var err error
+		if last, err = db.lastRollup(r, target); err != nil {
+			return err
+		}
+	}
+	if last >= upper {
+		r.last[string(source)] = last
+		return nil
+	}
+	q := NewQuery(source).WithContract(r.Contract).WithRange(time.Unix(last, 0), time.Unix(upper, 0))
+	buckets, err := db.aggregate(q, r.Bucket, r.Field)
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		fields := map[string]interface{}{"time": b.timeID, "count": b.count}
+		for _, f := range r.Funcs {
+			fields[aggNames[f]] = b.value(f)
+		}
+		payload, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		if err := db.PutEntry(NewEntry(target, payload).WithContract(r.Contract)); err != nil {
+			return err
+		}
+	}
+	r.last[string(source)] = upper
+	return nil
+}
+
+// lastRollup reads the last rollup from the target topic and returns the end time of its bucket.
+func (db *DB) lastRollup(r *_Rollup, target []byte) (int64, error) {
+	var last int64
+	q := NewQuery(target).WithContract(r.Contract).WithLimit(1)
+	err := db.get(context.Background(), q, func(_ _Query, _ message.ID, val []byte) {
+		if t, ok := decodeNumber(val, "time"); ok {
+			last = int64(t) + int64(r.Bucket/time.Second)
+		}
+	})
+	return last, err
+}
@@ -0,0 +1,546 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"io"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// _Segments represents a file split into segment files. Each segment file holds a fixed size range of file offsets,
+// the segment of an offset is resolved as offset / size so offsets stored in index and window blocks remain valid.
+type _Segments struct {
+	mu       sync.RWMutex
+	dir      string
+	fd       _FileDesc
+	suffix   string
+	size     int64         // size of the offset range of a segment.
+	duration time.Duration // time period to roll to the next segment, zero to roll by size only.
+	rollAt   time.Time     // time to roll the last segment.
+	files    map[int16]*os.File
+	last     int16
+	readOnly bool // segment files are opened for reads and are not created.
+
+	// scanned is free size of segments at the last lookup of messages keeping the topic.
+	scanned map[int16]int64
+}
+
+// _TopicSeqs holds seqs of the entries stored with the topic, that is the first entry of each topic.
+// Messages keeping the topic in a data segment are looked up by these seqs so the index is not scanned on removing the segment.
+type _TopicSeqs struct {
+	sync.Mutex
+	seqs map[uint64]struct{}
+}
+
+func newTopicSeqs() *_TopicSeqs {
+	return &_TopicSeqs{seqs: make(map[uint64]struct{})}
+}
+
+// add adds seq of the entry stored with the topic.
+func (t *_TopicSeqs) add(seq uint64) {
+	t.Lock()
+	defer t.Unlock()
+	t.seqs[seq] = struct{}{}
+}
+
+// list returns seqs of the entries stored with the topic.
+func (t *_TopicSeqs) list() []uint64 {
+	t.Lock()
+	defer t.Unlock()
+	seqs := make([]uint64, 0, len(t.seqs))
+	for seq := range t.seqs {
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+// newSegments opens segment files of the file type, the first segment is created if there is no segment file.
+func newSegments(dir string, fd _FileDesc, suffix string, size int64, dur time.Duration, readOnly bool) (*_Segments, error) {
+	s := &_Segments{dir: dir, fd: fd, suffix: suffix, size: size, duration: dur, readOnly: readOnly, scanned: make(map[int16]int64)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// name returns path of the segment file.
+func (s *_Segments) name(num int16) string {
+	fd := s.fd
+	fd.num = num
+	return filePath(s.dir, fd) + s.suffix
+}
+
+// load opens segment files found in the directory of the file type.
+func (s *_Segments) load() error {
+	s.files = make(map[int16]*os.File)
+	s.last = 0
+	entries, err := os.ReadDir(path.Dir(s.name(0)))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := strings.TrimPrefix(e.Name(), prefix)
+		i := strings.IndexFunc(name, func(r rune) bool { return r < '0' || r > '9' })
+		if i <= 0 {
+			continue
+		}
+		num, err := strconv.Atoi(name[:i])
+		if err != nil || num > math.MaxInt16 || path.Base(s.name(int16(num))) != e.Name() {
+			continue
+		}
+		if _, err := s.open(int16(num)); err != nil {
+			return err
+		}
+	}
+	f, err := s.open(s.last)
+	if err != nil {
+		return err
+	}
+	if s.duration > 0 {
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		s.rollAt = s.nextRoll(time.Now())
+		if stat.Size() > 0 {
+			s.rollAt = s.nextRoll(stat.ModTime())
+		}
+	}
+	return nil
+}
+
+// nextRoll returns the end of the time period of the time. Time periods are aligned to UTC.
+func (s *_Segments) nextRoll(t time.Time) time.Time {
+	return t.Truncate(s.duration).Add(s.duration)
+}
+
+// open opens or creates the segment file. The caller must hold the lock.
+func (s *_Segments) open(num int16) (*os.File, error) {
+	if f, ok := s.files[num]; ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(s.name(num), openFlag(s.readOnly), os.FileMode(0666))
+	if err != nil {
+		return nil, err
+	}
+	s.files[num] = f
+	if num > s.last {
+		s.last = num
+		if s.duration > 0 {
+			s.rollAt = s.nextRoll(time.Now())
+		}
+	}
+	return f, nil
+}
+
+// file returns the segment file, the segment file is created if it does not exist and create is set.
+func (s *_Segments) file(num int16, create bool) (*os.File, error) {
+	s.mu.RLock()
+	f, ok := s.files[num]
+	s.mu.RUnlock()
+	if ok || !create {
+		return f, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open(num)
+}
+
+// segment returns the segment number and the base offset of the segment of the offset.
+func (s *_Segments) segment(off int64) (int16, int64, error) {
+	num := off / s.size
+	if num > math.MaxInt16 {
+		return 0, 0, errSegmentLimit
+	}
+	return int16(num), num * s.size, nil
+}
+
+// nextOffset returns the offset to append n bytes at the offset. The offset is moved to the start of the next segment
+// if n bytes do not fit into the segment or if the segment is due to roll by the time period.
+func (s *_Segments) nextOffset(off, n int64) int64 {
+	_, base, err := s.segment(off)
+	if err != nil || off == base {
+		return off
+	}
+	if off+n > base+s.size {
+		return base + s.size
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.duration > 0 && !time.Now().Before(s.rollAt) {
+		return base + s.size
+	}
+	return off
+}
+
+func (s *_Segments) readAt(b []byte, off int64) (int, error) {
+	end := s.currSize()
+	n := 0
+	for n < len(b) {
+		if off >= end {
+			return n, io.EOF
+		}
+		num, base, err := s.segment(off)
+		if err != nil {
+			return n, err
+		}
+		chunk := b[n:]
+		limit := base + s.size
+		if end < limit {
+			limit = end
+		}
+		if int64(len(chunk)) > limit-off {
+			chunk = chunk[:limit-off]
+		}
+		f, _ := s.file(num, false)
+		if f == nil {
+			// messages of removed segments are deleted.
+			return n, errMsgIDDeleted
+		}
+		m, err := f.ReadAt(chunk, off-base)
+		if err != nil && err != io.EOF {
+			return n + m, err
+		}
+		// offsets beyond the end of a segment file rolled to the next segment are read as zeros.
+		for i := m; i < len(chunk); i++ {
+			chunk[i] = 0
+		}
+		n += len(chunk)
+		off += int64(len(chunk))
+	}
+	return n, nil
+}
+
+func (s *_Segments) writeAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		num, base, err := s.segment(off)
+		if err != nil {
+			return n, err
+		}
+		chunk := b[n:]
+		if int64(len(chunk)) > base+s.size-off {
+			chunk = chunk[:base+s.size-off]
+		}
+		f, err := s.file(num, true)
+		if err != nil {
+			return n, err
+		}
+		m, err := f.WriteAt(chunk, off-base)
+		n += m
+		off += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// truncate changes the size of the file, segments beyond the size are removed.
+func (s *_Segments) truncate(size int64) error {
+	num, base, err := s.segment(size)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n, f := range s.files {
+		if n <= num {
+			continue
+		}
+		delete(s.files, n)
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return err
+		}
+	}
+	f, err := s.open(num)
+	if err != nil {
+		return err
+	}
+	s.last = num
+	return f.Truncate(size - base)
+}
+
+// currSize returns the size of the file, that is the end offset of the last segment.
+func (s *_Segments) currSize() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stat, err := s.files[s.last].Stat()
+	if err != nil {
+		return 0
+	}
+	return int64(s.last)*s.size + stat.Size()
+}
+
+// sizes returns sizes of the segment files except the last segment.
+func (s *_Segments) sizes() (map[int16]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sizes := make(map[int16]int64, len(s.files))
+	for num, f := range s.files {
+		if num == s.last {
+			continue
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		sizes[num] = stat.Size()
+	}
+	return sizes, nil
+}
+
+// remove removes the segment file. The last segment is never removed.
+func (s *_Segments) remove(num int16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[num]
+	if !ok || num == s.last {
+		return nil
+	}
+	delete(s.files, num)
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// replace replaces segment files with the segment files of the new segments.
+func (s *_Segments) replace(ns *_Segments) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	for _, f := range ns.files {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	for _, f := range s.files {
+		f.Close()
+	}
+	var renameErr error
+	for num, f := range ns.files {
+		if err := os.Rename(f.Name(), s.name(num)); err != nil && renameErr == nil {
+			renameErr = err
+		}
+	}
+	for num, f := range s.files {
+		if _, ok := ns.files[num]; !ok {
+			os.Remove(f.Name())
+		}
+	}
+	ns.files = make(map[int16]*os.File)
+	// reopen segment files even if rename fails so the file remains usable.
+	if err := s.load(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+// nums returns the set of numbers of the segment files.
+func (s *_Segments) nums() map[int16]struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	nums := make(map[int16]struct{}, len(s.files))
+	for num := range s.files {
+		nums[num] = struct{}{}
+	}
+	return nums
+}
+
+// reload closes and reopens segment files, segments replaced or added by the writer of the DB are opened.
+func (s *_Segments) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.files {
+		f.Close()
+	}
+	return s.load()
+}
+
+// removeAll closes and removes all segment files.
+func (s *_Segments) removeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for num, f := range s.files {
+		delete(s.files, num)
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+func (s *_Segments) sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, f := range s.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *_Segments) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.files {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropSegments removes data segments if all messages of the segment are deleted or expired.
+// Deleted first entries of topics keep the topic, these are moved to the end of the data file before the segment is removed.
+// Index entries of messages in a removed segment are not updated, the messages are read as deleted.
+func (db *DB) dropSegments() error {
+	dataFile, err := db.fs.getFile(_FileDesc{fileType: typeData})
+	if err != nil {
+		return err
+	}
+	s := dataFile.segments
+	if s == nil {
+		return nil
+	}
+	db.internal.syncLockC <- struct{}{}
+	defer func() {
+		<-db.internal.syncLockC
+	}()
+	if db.internal.compactChanges != nil {
+		// segments are removed once the compaction swaps the data file.
+		return nil
+	}
+	sizes, err := s.sizes()
+	if err != nil {
+		return err
+	}
+	dropped := false
+	for num, size := range sizes {
+		base := int64(num) * s.size
+		if free := db.internal.freeList.freeSize(base, base+size); free < size {
+			// messages keeping the topic are looked up again only if messages are freed since the last lookup.
+			if scanned, ok := s.scanned[num]; ok && scanned == free {
+				continue
+			}
+			s.scanned[num] = free
+			ok, err := db.moveTopics(dataFile, base, base+size, size-free)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+		}
+		// readers are blocked while the segment file is removed.
+		db.internal.compactLock.Lock()
+		err := s.remove(num)
+		db.internal.compactLock.Unlock()
+		if err != nil {
+			return err
+		}
+		delete(s.scanned, num)
+		db.internal.freeList.dropBlocks(base, base+s.size)
+		dropped = true
+	}
+	if !dropped {
+		return nil
+	}
+	return db.internal.freeList.write()
+}
+
+// moveTopics moves messages of deleted entries keeping the topic from the offset range to the end of the data file.
+// Entries keeping the topic are looked up by the seqs of the entries stored with the topic, so the index is not scanned.
+// It returns false if size of the messages keeping the topic is less than the used size of the offset range, that is there
+// are messages of live entries in the offset range.
+func (db *DB) moveTopics(dataFile *_File, start, end, used int64) (bool, error) {
+	indexFile, err := db.fs.getFile(_FileDesc{fileType: typeIndex})
+	if err != nil {
+		return false, err
+	}
+	freeList := db.internal.freeList
+	blocks := make(map[int32]_IndexBlock)
+	kept := int64(0)
+	r := _BlockReader{indexFile: indexFile}
+	for _, seq := range db.internal.topicSeqs.list() {
+		bIdx := blockIndex(seq)
+		b, ok := blocks[bIdx]
+		if !ok {
+			r.offset = blockOffset(bIdx)
+			if b, err = r.readIndexBlock(); err != nil {
+				if err == io.EOF {
+					continue
+				}
+				return false, err
+			}
+		}
+		e, ok := b.find(seq)
+		if !ok || e.msgOffset < start || e.msgOffset >= end {
+			continue
+		}
+		// message of an expired entry is freed.
+		if freeList.freeSize(e.msgOffset, e.msgOffset+int64(e.mSize())) == int64(e.mSize()) {
+			continue
+		}
+		if !e.isDeleted() {
+			return false, nil
+		}
+		kept += int64(e.mSize())
+		blocks[bIdx] = b
+	}
+	if kept < used {
+		return false, nil
+	}
+	for bIdx, b := range blocks {
+		var moved []_IndexEntry
+		for i := 0; i < entriesPerIndexBlock; i++ {
+			e := b.entries[i]
+			if e.seq == 0 || e.topicSize == 0 || !e.isDeleted() || e.msgOffset < start || e.msgOffset >= end {
+				continue
+			}
+			if freeList.freeSize(e.msgOffset, e.msgOffset+int64(e.mSize())) == int64(e.mSize()) {
+				continue
+			}
+			msg, err := dataFile.slice(e.msgOffset, e.msgOffset+int64(e.mSize()))
+			if err != nil {
+				return false, err
+			}
+			off := dataFile.nextOffset(dataFile.currSize(), int64(len(msg)))
+			if err := dataFile.truncate(off); err != nil {
+				return false, err
+			}
+			if _, err := dataFile.write(msg); err != nil {
+				return false, err
+			}
+			moved = append(moved, e)
+			b.entries[i].msgOffset = off
+		}
+		if _, err := indexFile.WriteAt(b.marshalBinary(), blockOffset(bIdx)); err != nil {
+			return false, err
+		}
+		for _, e := range moved {
+			freeList.freeBlock(e.msgOffset, e.mSize())
+		}
+	}
+	return true, nil
+}
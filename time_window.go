@@ -17,18 +17,34 @@
 package unitdb
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/unit-io/unitdb/hash"
 )
 
+const (
+	// blockFlagTime is set in the flags byte of a window block if times of the entries are stored in the upper bits of the seqs.
+	// The time is stored relative to the base time of the block, zero if the time is unknown or out of range.
+	blockFlagTime = 1 << 1
+	winSeqBits    = 40
+	winSeqMask    = 1<<winSeqBits - 1
+	winTimeBias   = 1 << (63 - winSeqBits)
+)
+
 type (
 	_WinEntry struct {
 		sequence  uint64
 		expiresAt uint32
+
+		// timestamp is the time of the entry, it is zero if the time of a persisted entry is not stored.
+		timestamp int64
 	}
 	_WinBlock struct {
 		topicHash uint64
@@ -36,9 +52,14 @@ type (
 
 		// Next stores offset that links multiple winBlocks for a topic hash.
 		// Most recent offset is stored into the trie to iterate entries in reverse time order.
-		next       int64
+		next int64
+		// cutoffTime is the time of the most recent entry of the winBlock and the older winBlocks.
 		cutoffTime int64
 		entryIdx   uint16
+		// unordered is set if an entry older than the cutoff time is appended to the winBlock.
+		unordered bool
+		// baseTime is the time of the first entry of the winBlock, times of the entries are stored relative to the base time.
+		baseTime int64
 
 		// dirty used during timeWindow append and not persisted.
 		dirty bool
@@ -48,8 +69,8 @@ type (
 	}
 )
 
-func newWinEntry(seq uint64, expiresAt uint32) _WinEntry {
-	return _WinEntry{sequence: seq, expiresAt: expiresAt}
+func newWinEntry(seq uint64, expiresAt uint32, timestamp int64) _WinEntry {
+	return _WinEntry{sequence: seq, expiresAt: expiresAt, timestamp: timestamp}
 }
 
 func (e _WinEntry) seq() uint64 {
@@ -68,13 +89,54 @@ func (b _WinBlock) cutoff(cutoff int64) bool {
 	return b.cutoffTime != 0 && b.cutoffTime < cutoff
 }
 
+// setTime sets cutoff time of the winBlock on appending an entry with the time t.
+func (b *_WinBlock) setTime(t int64) {
+	if b.baseTime == 0 {
+		b.baseTime = t
+	}
+	switch {
+	case t == 0:
+	case t < b.cutoffTime:
+		b.unordered = true
+	default:
+		b.cutoffTime = t
+	}
+}
+
+// packTime packs the time t relative to the base time of the winBlock, it returns zero if the time cannot be packed.
+func (b _WinBlock) packTime(t int64) uint64 {
+	d := t - b.baseTime + winTimeBias
+	if t == 0 || b.baseTime == 0 || d <= 0 || d >= 1<<(64-winSeqBits) {
+		return 0
+	}
+	return uint64(d)
+}
+
+// unpackTime unpacks the time packed relative to the base time of the winBlock.
+func (b _WinBlock) unpackTime(v uint64) int64 {
+	if v == 0 {
+		return 0
+	}
+	return b.baseTime + int64(v) - winTimeBias
+}
+
 // marshalBinary serialized window block into binary data.
 func (b _WinBlock) marshalBinary() []byte {
 	buf := make([]byte, blockSize)
 	data := buf
+	timed := true
+	for i := 0; i < entriesPerWindowBlock; i++ {
+		if b.entries[i].sequence > winSeqMask {
+			timed = false
+		}
+	}
 	for i := 0; i < entriesPerWindowBlock; i++ {
 		e := b.entries[i]
-		binary.LittleEndian.PutUint64(buf[:8], e.sequence)
+		seq := e.sequence
+		if timed {
+			seq |= b.packTime(e.timestamp) << winSeqBits
+		}
+		binary.LittleEndian.PutUint64(buf[:8], seq)
 		binary.LittleEndian.PutUint32(buf[8:12], e.expiresAt)
 		buf = buf[12:]
 	}
@@ -82,14 +144,33 @@ func (b _WinBlock) marshalBinary() []byte {
 	binary.LittleEndian.PutUint64(buf[8:16], b.topicHash)
 	binary.LittleEndian.PutUint64(buf[16:24], uint64(b.next))
 	binary.LittleEndian.PutUint16(buf[24:26], b.entryIdx)
+	if b.unordered {
+		buf[26] = 1
+	}
+	if timed {
+		binary.LittleEndian.PutUint64(buf[27:35], uint64(b.baseTime))
+		data[blockSize-checksumSize-1] |= blockFlagTime
+	}
+	putBlockChecksum(data)
 	return data
 }
 
 // unmarshalBinary de-serialized window block from binary data.
 func (b *_WinBlock) unmarshalBinary(data []byte) error {
+	timed := data[blockSize-checksumSize-1]&blockFlagTime != 0
+	trailer := data[entriesPerWindowBlock*12:]
+	if timed {
+		b.baseTime = int64(binary.LittleEndian.Uint64(trailer[27:35]))
+	}
 	for i := 0; i < entriesPerWindowBlock; i++ {
 		_ = data[12] // bounds check hint to compiler; see golang.org/issue/14808.
-		b.entries[i].sequence = binary.LittleEndian.Uint64(data[:8])
+		seq := binary.LittleEndian.Uint64(data[:8])
+		b.entries[i].timestamp = 0
+		if timed {
+			b.entries[i].timestamp = b.unpackTime(seq >> winSeqBits)
+			seq &= winSeqMask
+		}
+		b.entries[i].sequence = seq
 		b.entries[i].expiresAt = binary.LittleEndian.Uint32(data[8:12])
 		data = data[12:]
 	}
@@ -97,6 +178,7 @@ func (b *_WinBlock) unmarshalBinary(data []byte) error {
 	b.topicHash = binary.LittleEndian.Uint64(data[8:16])
 	b.next = int64(binary.LittleEndian.Uint64(data[16:24]))
 	b.entryIdx = binary.LittleEndian.Uint16(data[24:26])
+	b.unordered = data[26] == 1
 	return nil
 }
 
@@ -159,7 +241,7 @@ func (w *_WindowBlocks) getWindowBlock(blockID uint64) *_TimeWindow {
 }
 
 func newTimeWindowBucket(opts *_TimeOptions) *_TimeWindowBucket {
-	l := &_TimeWindowBucket{}
+	l := &_TimeWindowBucket{opts: opts}
 	l.windowBlocks = newWindowBlocks()
 	l.expiryWindowBucket = newExpiryWindowBucket(opts.backgroundKeyExpiry, opts.expDurationType, opts.maxExpDurations)
 	return l
@@ -185,6 +267,34 @@ func (tw *_TimeWindowBucket) add(timeID int64, topicHash uint64, e _WinEntry) (o
 	}
 	return true
 }
+
+// move moves the window entry of the seq of the entry e to the time ID, the window entry is replaced with the entry e.
+func (tw *_TimeWindowBucket) move(timeID int64, topicHash uint64, e _WinEntry) {
+	// get windowBlock shard.
+	tw.RLock()
+	b := tw.windowBlocks.getWindowBlock(topicHash)
+	tw.RUnlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, wEntries := range b.entries {
+		if key.topicHash != topicHash {
+			continue
+		}
+		for i, we := range wEntries {
+			if we.seq() == e.seq() {
+				b.entries[key] = append(wEntries[:i:i], wEntries[i+1:]...)
+				break
+			}
+		}
+	}
+	key := _Key{
+		timeID:    timeID,
+		topicHash: topicHash,
+	}
+	b.entries[key] = append(b.entries[key], e)
+}
+
 func (tw *_TimeWindowBucket) release() func(timeID int64) error {
 	releasedKeys := make(map[int64][]_Key)
 	for i := 0; i < nShards; i++ {
@@ -217,7 +327,8 @@ func (tw *_TimeWindowBucket) release() func(timeID int64) error {
 }
 
 // ilookup lookups window entries from timeWindowBucket and not yet sync to DB.
-func (tw *_TimeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries _WindowEntries) {
+// Entries at or after the upper time limit are skipped.
+func (tw *_TimeWindowBucket) ilookup(topicHash uint64, upper int64, limit int) (winEntries _WindowEntries) {
 	winEntries = make([]_WinEntry, 0)
 	// get windowBlock shard.
 	b := tw.windowBlocks.getWindowBlock(topicHash)
@@ -238,6 +349,9 @@ func (tw *_TimeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries _W
 			}
 			for i := len(wEntries) - 1; i >= len(wEntries)-l; i-- {
 				we := wEntries[i]
+				if upper > 0 && we.timestamp >= upper {
+					continue
+				}
 				if we.isExpired() {
 					if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
 						expiryCount++
@@ -253,80 +367,220 @@ func (tw *_TimeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries _W
 	return winEntries
 }
 
-// lookup lookups window entries from window file.
-func (tw *_TimeWindowBucket) lookup(fs *_FileSet, topicHash uint64, off, cutoff int64, limit int) (winEntries _WindowEntries) {
-	winEntries = make([]_WinEntry, 0)
-	winEntries = tw.ilookup(topicHash, limit)
-	if len(winEntries) >= limit {
-		return winEntries
+// walkWindowBlocks reads window blocks from the offset following the links to the older window blocks until f returns true.
+func walkWindowBlocks(ctx context.Context, winFile *_File, off int64, f func(_WinBlock) (bool, error)) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r := _WindowReader{winFile: winFile, offset: off}
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		if stop, err := f(b); stop || err != nil {
+			return err
+		}
+		if b.next == 0 {
+			return nil
+		}
+		off = b.next
 	}
+}
+
+// find finds the window entry of the seq from window blocks of the topic from the offset.
+// Window blocks older than the time t of the entry are not read.
+func (tw *_TimeWindowBucket) find(ctx context.Context, fs *_FileSet, topicHash uint64, off int64, seq uint64, t int64) (_WinEntry, bool, error) {
 	winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow})
 	if err != nil {
-		return winEntries
-	}
-	next := func(blockOff int64, f func(_WinBlock) (bool, error)) error {
-		for {
-			r := _WindowReader{winFile: winFile, offset: blockOff}
-			b, err := r.readWindowBlock()
-			if err != nil {
-				return err
-			}
-			if stop, err := f(b); stop || err != nil {
-				return err
+		return _WinEntry{}, false, err
+	}
+	var winEntry _WinEntry
+	var found bool
+	err = walkWindowBlocks(ctx, winFile, off, func(b _WinBlock) (bool, error) {
+		if b.topicHash != topicHash || b.cutoff(t) {
+			return true, nil
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.seq() == seq {
+				winEntry, found = we, true
+				return true, nil
 			}
-			if b.next == 0 {
-				return nil
+		}
+		return false, nil
+	})
+	if err == io.EOF {
+		err = nil
+	}
+	return winEntry, found, err
+}
+
+// lookup lookups window entries from window file in reverse time order.
+// Window blocks are pruned using the cutoff time of the blocks, the cutoff is the lower and the upper is the upper time limit.
+// Entries put with an earlier timestamp are not in seq order, such entries are looked up by their time stored in the window blocks
+// and it returns false with timestamps set on the entries. The time of an entry not stored in its block is read using timeOf.
+// It returns the context error if the context is done while window blocks are read.
+func (tw *_TimeWindowBucket) lookup(ctx context.Context, fs *_FileSet, topicHash uint64, off, cutoff, upper int64, limit int, timeOf func(seq uint64) int64) (_WindowEntries, bool, error) {
+	memEntries := tw.ilookup(topicHash, upper, math.MaxInt32)
+	sort.Slice(memEntries, func(i, j int) bool {
+		return memEntries[i].sequence > memEntries[j].sequence
+	})
+	ordered := true
+	for i := 1; i < len(memEntries); i++ {
+		if memEntries[i].timestamp > memEntries[i-1].timestamp {
+			ordered = false
+		}
+	}
+	if ordered {
+		winEntries, ordered, err := tw.lookupSeq(ctx, fs, topicHash, off, cutoff, upper, limit, memEntries)
+		if err != nil || ordered {
+			return winEntries, ordered, err
+		}
+	}
+	winEntries, err := tw.lookupTime(ctx, fs, topicHash, off, cutoff, upper, limit, memEntries, timeOf)
+	return winEntries, false, err
+}
+
+// lookupSeq lookups window entries in reverse seq order. It returns false if entries are not in time order.
+func (tw *_TimeWindowBucket) lookupSeq(ctx context.Context, fs *_FileSet, topicHash uint64, off, cutoff, upper int64, limit int, memEntries _WindowEntries) (winEntries _WindowEntries, ordered bool, err error) {
+	winEntries = make([]_WinEntry, 0)
+	for _, we := range memEntries {
+		if len(winEntries) >= limit {
+			break
+		}
+		winEntries = append(winEntries, we)
+	}
+	winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return winEntries, true, nil
+	}
+	// Entries of a window block are newer than the cutoff time of the next (older) window block,
+	// so pending entries are added once the next window block is read.
+	// The sync duration is allowed as slack since cutoff time is set on window block during sync.
+	var pending _WindowEntries
+	add := func() bool {
+		for _, we := range pending {
+			if len(winEntries) >= limit {
+				return true
 			}
-			blockOff = b.next
+			winEntries = append(winEntries, we)
 		}
+		pending = pending[:0]
+		return len(winEntries) >= limit
 	}
-	expiryCount := 0
-	err = next(off, func(curb _WinBlock) (bool, error) {
+	ordered = true
+	head := true
+	err = walkWindowBlocks(ctx, winFile, off, func(curb _WinBlock) (bool, error) {
 		b := &curb
 		if b.topicHash != topicHash {
 			return true, nil
 		}
-		if len(winEntries) > limit-int(b.entryIdx) {
-			limit = limit - len(winEntries)
-			for i := len(b.entries[:b.entryIdx]) - 1; i >= len(b.entries[:b.entryIdx])-limit; i-- {
-				we := b.entries[i]
-				if we.isExpired() {
-					if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
-						expiryCount++
-						logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
-					}
-					// if id is expired it does not return an error but continue the iteration.
-					continue
-				}
-				winEntries = append(winEntries, we)
-			}
-			if len(winEntries) >= limit {
-				return true, nil
-			}
+		// entries not yet synced must be newer than the entries of the window blocks.
+		if head && len(memEntries) > 0 && memEntries[len(memEntries)-1].timestamp < b.cutoffTime {
+			ordered = false
+			return true, nil
+		}
+		head = false
+		if upper > 0 && b.cutoffTime > upper+int64(tw.opts.maxDuration.Seconds()) {
+			pending = pending[:0]
+		}
+		if stop := add(); stop {
+			return true, nil
+		}
+		if b.unordered {
+			ordered = false
+			return true, nil
 		}
 		for i := len(b.entries[:b.entryIdx]) - 1; i >= 0; i-- {
 			we := b.entries[i]
 			if we.isExpired() {
 				if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
-					expiryCount++
 					logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
 				}
 				// if id is expired it does not return an error but continue the iteration.
 				continue
 			}
-			winEntries = append(winEntries, we)
-
+			pending = append(pending, we)
 		}
 		if b.cutoff(cutoff) {
 			return true, nil
 		}
 		return false, nil
 	})
+	if err := ctx.Err(); err != nil {
+		return nil, true, err
+	}
+	if !ordered {
+		return nil, false, nil
+	}
+	add()
+
+	return winEntries, true, nil
+}
+
+// lookupTime lookups window entries in reverse time order, the time of a persisted entry is read using timeOf if it is not stored in its block.
+// Window blocks are read until the cutoff time of a window block is older than the entries found up to the limit.
+func (tw *_TimeWindowBucket) lookupTime(ctx context.Context, fs *_FileSet, topicHash uint64, off, cutoff, upper int64, limit int, memEntries _WindowEntries, timeOf func(seq uint64) int64) (winEntries _WindowEntries, err error) {
+	winEntries = make([]_WinEntry, 0)
+	inRange := func(t int64) bool {
+		return (cutoff == 0 || t >= cutoff) && (upper == 0 || t < upper)
+	}
+	// truncate keeps the most recent entries up to the limit.
+	truncate := func() {
+		sort.Slice(winEntries, func(i, j int) bool {
+			if winEntries[i].timestamp != winEntries[j].timestamp {
+				return winEntries[i].timestamp > winEntries[j].timestamp
+			}
+			return winEntries[i].sequence > winEntries[j].sequence
+		})
+		if len(winEntries) > limit {
+			winEntries = winEntries[:limit]
+		}
+	}
+	for _, we := range memEntries {
+		if inRange(we.timestamp) {
+			winEntries = append(winEntries, we)
+		}
+	}
+	truncate()
+	winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow})
 	if err != nil {
-		return winEntries
+		return winEntries, nil
+	}
+	err = walkWindowBlocks(ctx, winFile, off, func(b _WinBlock) (bool, error) {
+		if b.topicHash != topicHash {
+			return true, nil
+		}
+		if len(winEntries) >= limit && b.cutoffTime != 0 && b.cutoffTime < winEntries[limit-1].timestamp {
+			return true, nil
+		}
+		for i := int(b.entryIdx) - 1; i >= 0; i-- {
+			we := b.entries[i]
+			if we.seq() == 0 {
+				continue
+			}
+			if we.isExpired() {
+				if err := tw.expiryWindowBucket.addExpiry(we); err != nil {
+					logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
+				}
+				// if id is expired it does not return an error but continue the iteration.
+				continue
+			}
+			if we.timestamp == 0 {
+				we.timestamp = timeOf(we.seq())
+			}
+			if inRange(we.timestamp) {
+				winEntries = append(winEntries, we)
+			}
+		}
+		truncate()
+		return b.cutoff(cutoff), nil
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	return winEntries
+	return winEntries, nil
 }
 
 func (b _WinBlock) validation(topicHash uint64) error {
@@ -47,6 +47,9 @@ func (r *_WindowReader) readWindowBlock() (_WinBlock, error) {
 	if err != nil {
 		return _WinBlock{}, err
 	}
+	if !validBlockChecksum(buf) {
+		return _WinBlock{}, &ErrCorrupted{File: winDir, Offset: r.offset}
+	}
 	if err := r.winBlock.unmarshalBinary(buf); err != nil {
 		return _WinBlock{}, err
 	}
@@ -54,8 +57,16 @@ func (r *_WindowReader) readWindowBlock() (_WinBlock, error) {
 	return r.winBlock, nil
 }
 
-// blockIterator iterates all window blocks from disk.
+// blockIterator iterates all window blocks from disk and calls f for each chain of window blocks of a topic.
+// It calls f with the first seq of the oldest block and the offset of the most recent block of the chain.
 func (r *_WindowReader) blockIterator(f func(startSeq, topicHash uint64, off int64) (bool, error)) (err error) {
+	type _ChainBlock struct {
+		startSeq  uint64
+		topicHash uint64
+	}
+	blocks := make(map[int64]_ChainBlock)
+	prev := make(map[int64]int64) // map of offset of the block to offset of the block linking to it.
+	var tails []int64
 	windowIdx := int32(0)
 	nBlocks := r.windowIdx
 	for windowIdx <= nBlocks {
@@ -63,16 +74,35 @@ func (r *_WindowReader) blockIterator(f func(startSeq, topicHash uint64, off int
 		b, err := r.readWindowBlock()
 		if err != nil {
 			if err == io.EOF {
-				return nil
+				break
 			}
 			return err
 		}
 		windowIdx++
-		if b.entryIdx == 0 || b.next != 0 {
+		if b.topicHash == 0 {
+			continue
+		}
+		blocks[r.offset] = _ChainBlock{startSeq: b.entries[0].sequence, topicHash: b.topicHash}
+		if b.next != 0 {
+			prev[b.next] = r.offset
 			continue
 		}
-		// fmt.Println("timeWindow.blockIterator: topicHash, seq ", b.topicHash, b.entries[0].sequence)
-		if stop, err := f(b.entries[0].sequence, b.topicHash, r.offset); stop || err != nil {
+		if b.entryIdx != 0 {
+			tails = append(tails, r.offset)
+		}
+	}
+	for _, tail := range tails {
+		b := blocks[tail]
+		off := tail
+		for i := 0; i < len(blocks); i++ {
+			p, ok := prev[off]
+			if !ok || blocks[p].topicHash != b.topicHash {
+				break
+			}
+			off = p
+		}
+		// fmt.Println("timeWindow.blockIterator: topicHash, seq ", b.topicHash, b.startSeq)
+		if stop, err := f(b.startSeq, b.topicHash, off); stop || err != nil {
 			return err
 		}
 	}
@@ -17,8 +17,8 @@
 package unitdb
 
 import (
+	"bytes"
 	"sort"
-	"time"
 
 	"github.com/unit-io/bpool"
 )
@@ -35,20 +35,84 @@ type _WindowWriter struct {
 }
 
 func newWindowWriter(fs *_FileSet, buf *bpool.Buffer) (*_WindowWriter, error) {
-	w := &_WindowWriter{windowIdx: -1, winBlocks: make(map[int32]_WinBlock), winLeases: make(map[int32][]uint64), fs: fs, buffer: buf}
+	w := &_WindowWriter{winBlocks: make(map[int32]_WinBlock), winLeases: make(map[int32][]uint64), fs: fs, buffer: buf}
 	winFile, err := fs.getFile(_FileDesc{fileType: typeTimeWindow})
 	if err != nil {
 		return nil, err
 	}
 	w.winFile = winFile
 	w.offset = winFile.currSize()
-	if w.offset > 0 {
-		w.windowIdx = int32(w.offset / int64(blockSize))
+	// The first block is left empty so a window block never links to the offset zero.
+	if w.offset == 0 {
+		if _, err := winFile.write(_WinBlock{}.marshalBinary()); err != nil {
+			return nil, err
+		}
+		w.offset = int64(blockSize)
 	}
+	w.windowIdx = int32(w.offset/int64(blockSize)) - 1 // index of the last block.
 
 	return w, nil
 }
 
+// upgradeWindow leaves the first window block empty in a window file written before version 2. The first block is
+// moved to the end of the file and blocks linked to the offset zero, that is the blocks of the topic of the first
+// block with no next block, are linked to the moved block. The moved block is reused if the upgrade is run again.
+func upgradeWindow(winFile *_File) error {
+	size := winFile.currSize()
+	if size < int64(blockSize) {
+		return nil
+	}
+	buf, err := winFile.slice(0, int64(blockSize))
+	if err != nil {
+		return err
+	}
+	if bytes.Count(buf, []byte{0}) == len(buf) {
+		// the first block was left as a hole.
+		_, err := winFile.WriteAt(_WinBlock{}.marshalBinary(), 0)
+		return err
+	}
+	if !validBlockChecksum(buf) {
+		return &ErrCorrupted{File: winDir, Offset: 0}
+	}
+	var first _WinBlock
+	if err := first.unmarshalBinary(buf); err != nil {
+		return err
+	}
+	if first.topicHash == 0 {
+		return nil
+	}
+	off := size - size%int64(blockSize)
+	last, err := winFile.slice(off-int64(blockSize), off)
+	if err != nil {
+		return err
+	}
+	if off == int64(blockSize) || !bytes.Equal(last, buf) {
+		if _, err := winFile.WriteAt(buf, off); err != nil {
+			return err
+		}
+	} else {
+		off -= int64(blockSize)
+	}
+	r := _WindowReader{winFile: winFile}
+	for r.offset = int64(blockSize); r.offset < off; r.offset += int64(blockSize) {
+		b, err := r.readWindowBlock()
+		if err != nil {
+			return err
+		}
+		if b.topicHash != first.topicHash || b.next != 0 || b.entryIdx == 0 {
+			continue
+		}
+		b.next = off
+		if _, err := winFile.WriteAt(b.marshalBinary(), r.offset); err != nil {
+			return err
+		}
+	}
+	if _, err := winFile.WriteAt(_WinBlock{}.marshalBinary(), 0); err != nil {
+		return err
+	}
+	return winFile.Sync()
+}
+
 func (w *_WindowWriter) del(seq uint64, winIdx int32) error {
 	r := _WindowReader{winFile: w.winFile, offset: winBlockOffset(winIdx)}
 	b, err := r.readWindowBlock()
@@ -110,17 +174,16 @@ func (w *_WindowWriter) append(topicHash uint64, off int64, wEntries _WindowEntr
 		if b.entryIdx == entriesPerWindowBlock {
 			topicHash := b.topicHash
 			next := int64(blockSize * wIdx)
-			// set approximate cutoff on winBlock.
-			b.cutoffTime = time.Now().Unix()
 			w.winBlocks[wIdx] = b
 			w.windowIdx++
 			wIdx = w.windowIdx
-			b = _WinBlock{topicHash: topicHash, next: next}
+			b = _WinBlock{topicHash: topicHash, next: next, cutoffTime: b.cutoffTime}
 		}
 		if b.leased {
 			w.winLeases[wIdx] = append(w.winLeases[wIdx], we.sequence)
 		}
-		b.entries[b.entryIdx] = _WinEntry{sequence: we.sequence, expiresAt: we.expiresAt}
+		b.entries[b.entryIdx] = _WinEntry{sequence: we.sequence, expiresAt: we.expiresAt, timestamp: we.timestamp}
+		b.setTime(we.timestamp)
 		b.dirty = true
 		b.entryIdx++
 	}
@@ -0,0 +1,265 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// tombstoneSize is the size of the tombstone record (topic hash, seq, from and to time).
+	tombstoneSize = 32
+)
+
+type (
+	// _Tombstone deletes messages of the topic put at or before the seq in the time range [from, to).
+	// A zero from or to leaves that end of the range open.
+	_Tombstone struct {
+		topicHash uint64
+		seq       uint64
+		from, to  int64
+	}
+
+	// _Tombstones are range tombstones of the DB. Messages covered by a tombstone are not returned by queries
+	// and the tombstone is removed once its messages are deleted in the background.
+	_Tombstones struct {
+		sync.RWMutex
+		file   _FileSet
+		ranges map[uint64][]_Tombstone // map[topicHash]tombstones
+	}
+)
+
+func newTombstones(fs _FileSet) *_Tombstones {
+	return &_Tombstones{file: fs, ranges: make(map[uint64][]_Tombstone)}
+}
+
+// covers returns true if the message of the seq and the time t is deleted by the tombstone.
+func (t _Tombstone) covers(seq uint64, ts int64) bool {
+	return seq <= t.seq && ts >= t.from && (t.to == 0 || ts < t.to)
+}
+
+func (t _Tombstone) marshalBinary() []byte {
+	buf := make([]byte, tombstoneSize)
+	binary.LittleEndian.PutUint64(buf[:8], t.topicHash)
+	binary.LittleEndian.PutUint64(buf[8:16], t.seq)
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(t.from))
+	binary.LittleEndian.PutUint64(buf[24:32], uint64(t.to))
+	return buf
+}
+
+func (t *_Tombstone) unmarshalBinary(data []byte) {
+	t.topicHash = binary.LittleEndian.Uint64(data[:8])
+	t.seq = binary.LittleEndian.Uint64(data[8:16])
+	t.from = int64(binary.LittleEndian.Uint64(data[16:24]))
+	t.to = int64(binary.LittleEndian.Uint64(data[24:32]))
+}
+
+// add adds the tombstones and appends these to the tombstone file.
+func (ts *_Tombstones) add(tombstones ..._Tombstone) error {
+	ts.Lock()
+	defer ts.Unlock()
+	var buf []byte
+	for _, t := range tombstones {
+		ts.ranges[t.topicHash] = append(ts.ranges[t.topicHash], t)
+		buf = append(buf, t.marshalBinary()...)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if _, err := ts.file.write(buf); err != nil {
+		return err
+	}
+	return ts.file.Sync()
+}
+
+// deleted returns true if the message of the topic, the seq and the time t is covered by a tombstone.
+func (ts *_Tombstones) deleted(topicHash, seq uint64, t int64) bool {
+	ts.RLock()
+	defer ts.RUnlock()
+	for _, tomb := range ts.ranges[topicHash] {
+		if tomb.covers(seq, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the tombstones.
+func (ts *_Tombstones) list() []_Tombstone {
+	ts.RLock()
+	defer ts.RUnlock()
+	var tombstones []_Tombstone
+	for _, r := range ts.ranges {
+		tombstones = append(tombstones, r...)
+	}
+	return tombstones
+}
+
+// remove removes the tombstone and rewrites the tombstone file, pending tombstones are kept if the rewrite fails.
+func (ts *_Tombstones) remove(t _Tombstone) error {
+	ts.Lock()
+	defer ts.Unlock()
+	r := ts.ranges[t.topicHash]
+	for i := range r {
+		if r[i] == t {
+			r = append(r[:i:i], r[i+1:]...)
+			break
+		}
+	}
+	if len(r) == 0 {
+		delete(ts.ranges, t.topicHash)
+	} else {
+		ts.ranges[t.topicHash] = r
+	}
+	var buf []byte
+	for _, r := range ts.ranges {
+		for _, t := range r {
+			buf = append(buf, t.marshalBinary()...)
+		}
+	}
+	return ts.file.rewrite(buf)
+}
+
+// read reads the tombstone file, a partial record written before a crash is skipped.
+func (ts *_Tombstones) read() error {
+	ts.Lock()
+	defer ts.Unlock()
+	buf := make([]byte, ts.file.currSize())
+	if _, err := ts.file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	ts.ranges = make(map[uint64][]_Tombstone)
+	for ; len(buf) >= tombstoneSize; buf = buf[tombstoneSize:] {
+		var t _Tombstone
+		t.unmarshalBinary(buf)
+		ts.ranges[t.topicHash] = append(ts.ranges[t.topicHash], t)
+	}
+	return nil
+}
+
+// DeleteRange deletes messages of topics matching the topic put in the time range [from, to) before DeleteRange is called.
+// A zero from or to leaves that end of the range open. The topic may be a pattern as in DB.Topics,
+// for example "fleet.dev42..." deletes all messages of topics under "fleet.dev42".
+// The messages are not returned by queries once DeleteRange returns, the space is reclaimed in the background.
+func (db *DB) DeleteRange(topic []byte, contract uint32, from, to time.Time) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case db.opts.flags.immutable:
+		return errImmutable
+	case len(topic) == 0:
+		return errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return errTopicTooLarge
+	case !from.IsZero() && !to.IsZero() && !from.Before(to):
+		return errRangeInvalid
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	t := _Tombstone{seq: db.seq()}
+	if !from.IsZero() {
+		t.from = from.Unix()
+	}
+	if !to.IsZero() {
+		t.to = to.Unix()
+	}
+	parts := splitTopic(topic)
+	var tombstones []_Tombstone
+	for _, topic := range db.internal.trie.topics(contract) {
+		if topic.name == "" || !matchTopic(parts, splitTopic([]byte(topic.name))) {
+			continue
+		}
+		t.topicHash = topic.hash
+		tombstones = append(tombstones, t)
+	}
+	return db.internal.tombstones.add(tombstones...)
+}
+
+// purgeTombstones deletes messages covered by the tombstones and removes the tombstones once their messages are deleted.
+func (db *DB) purgeTombstones() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	for _, t := range db.internal.tombstones.list() {
+		dels, err := db.coveredEntries(t)
+		if err != nil {
+			return err
+		}
+		for len(dels) > 0 {
+			n := len(dels)
+			if n > maxRetentionDeletes {
+				n = maxRetentionDeletes
+			}
+			if err := db.deleteEntries(dels[:n]); err != nil {
+				return err
+			}
+			dels = dels[n:]
+		}
+		if err := db.internal.tombstones.remove(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coveredEntries walks messages of the topic of the tombstone and returns messages covered by the tombstone.
+func (db *DB) coveredEntries(t _Tombstone) ([]_Query, error) {
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	off, ok := db.internal.trie.getOffset(t.topicHash)
+	if !ok {
+		return nil, nil
+	}
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, err
+	}
+	it := &ItemIterator{db: db, query: &Query{}, winFile: winFile, lastSeq: math.MaxUint64}
+	it.addCursor(_Topic{hash: t.topicHash, offset: off}, 0)
+	var dels []_Query
+	for {
+		qe, ok, err := it.nextEntry()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if qe.seq > t.seq {
+			continue
+		}
+		id, err := db.readID(qe)
+		if err != nil {
+			if err == errMsgIDDeleted {
+				continue
+			}
+			return nil, err
+		}
+		if t.covers(qe.seq, id.Time()) {
+			dels = append(dels, qe)
+		}
+	}
+	return dels, nil
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+type (
+	// TopicCompaction keeps only the newest messages of each topic matching the topic pattern,
+	// it is used for state streams where only the latest values of a topic are read.
+	// Older messages are deleted by the syncer once newer messages of the topic are synced.
+	TopicCompaction struct {
+		Topic      []byte // The topic pattern as in DB.Topics, for example "devices.state...".
+		Contract   uint32 // The contract of the topics.
+		KeepLatest int    // The number of newest messages kept on each topic.
+	}
+
+	_TopicCompactions struct {
+		sync.Mutex
+		compactions []TopicCompaction
+		// synced is the number of entries of the topics synced since the topics are compacted.
+		synced map[uint64]int
+		// all is set to compact all matching topics, topics are not tracked until the first compaction.
+		all bool
+	}
+)
+
+func newTopicCompactions(compactions []TopicCompaction) (*_TopicCompactions, error) {
+	if len(compactions) == 0 {
+		return nil, nil
+	}
+	compactions = append([]TopicCompaction(nil), compactions...)
+	for i, c := range compactions {
+		if len(c.Topic) == 0 || c.KeepLatest < 1 {
+			return nil, errCompactionInvalid
+		}
+		if c.Contract == 0 {
+			compactions[i].Contract = message.MasterContract
+		}
+	}
+	return &_TopicCompactions{compactions: compactions, synced: make(map[uint64]int), all: true}, nil
+}
+
+// mark adds the topic with the number of entries synced to the topics to compact. It does nothing if topic compaction is not configured.
+func (tc *_TopicCompactions) mark(topicHash uint64, n int) {
+	if tc == nil {
+		return
+	}
+	tc.Lock()
+	defer tc.Unlock()
+	tc.synced[topicHash] += n
+}
+
+// take returns the topics synced since the last call.
+func (tc *_TopicCompactions) take() (synced map[uint64]int, all bool) {
+	tc.Lock()
+	defer tc.Unlock()
+	synced, all = tc.synced, tc.all
+	tc.synced = make(map[uint64]int)
+	tc.all = false
+	return synced, all
+}
+
+// compactTopics deletes messages superseded by the newest messages of the topics synced since the last compaction.
+func (db *DB) compactTopics() error {
+	tc := db.internal.topicCompactions
+	if tc == nil {
+		return nil
+	}
+	if err := db.ok(); err != nil {
+		return err
+	}
+	synced, all := tc.take()
+	if len(synced) == 0 && !all {
+		return nil
+	}
+	for _, c := range tc.compactions {
+		if err := db.compactTopic(c, synced, all); err != nil {
+			// all topics are compacted next time as messages superseded now may not be deleted.
+			tc.Lock()
+			tc.all = true
+			tc.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// compactTopic deletes messages of the matching topics superseded by the newest messages kept by the topic compaction.
+func (db *DB) compactTopic(c TopicCompaction, synced map[uint64]int, all bool) error {
+	dels, err := db.superseded(c, synced, all)
+	if err != nil {
+		return err
+	}
+	for len(dels) > 0 {
+		n := len(dels)
+		if n > maxRetentionDeletes {
+			n = maxRetentionDeletes
+		}
+		if err := db.deleteEntries(dels[:n]); err != nil {
+			return err
+		}
+		dels = dels[n:]
+	}
+	return nil
+}
+
+// superseded returns messages of the matching topics older than the newest messages kept by the topic compaction.
+// A topic has at most KeepLatest live messages and the first message of the topic kept after the last compaction,
+// so the walk of the topic stops once these and the messages synced or put since the last compaction are seen.
+// All messages of the topics are walked on the first compaction after the DB is opened.
+func (db *DB) superseded(c TopicCompaction, synced map[uint64]int, all bool) ([]_Query, error) {
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, err
+	}
+	parts := splitTopic(c.Topic)
+	var dels []_Query
+	for _, topic := range db.internal.trie.topics(c.Contract) {
+		n, ok := synced[topic.hash]
+		if !ok && !all {
+			continue
+		}
+		if topic.name == "" || !matchTopic(parts, splitTopic([]byte(topic.name))) {
+			continue
+		}
+		type live struct {
+			qe        _Query
+			timestamp int64
+		}
+		var entries []live
+		it := &ItemIterator{db: db, query: &Query{}, winFile: winFile, lastSeq: math.MaxUint64}
+		it.addCursor(topic, 0)
+		limit := 0
+		if !all {
+			// entries not yet synced are buffered by the cursor.
+			limit = c.KeepLatest + 1 + n + len(it.cursors[0].entries)
+		}
+		for limit == 0 || len(entries) < limit {
+			qe, ok, err := it.nextEntry()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			id, err := db.readID(qe)
+			if err != nil {
+				if err == errMsgIDDeleted {
+					continue
+				}
+				return nil, err
+			}
+			if db.internal.tombstones.deleted(topic.hash, qe.seq, id.Time()) {
+				continue
+			}
+			entries = append(entries, live{qe: qe, timestamp: id.Time()})
+		}
+		if len(entries) <= c.KeepLatest {
+			continue
+		}
+		// messages are kept in the order queries return them, newest time first.
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].timestamp != entries[j].timestamp {
+				return entries[i].timestamp > entries[j].timestamp
+			}
+			return entries[i].qe.seq > entries[j].qe.seq
+		})
+		for _, e := range entries[c.KeepLatest:] {
+			if me, ok := db.memEntry(e.qe.seq); ok && me.topicSize != 0 {
+				// the first message of the topic holds the topic until it is synced, it is deleted once it is synced.
+				continue
+			}
+			dels = append(dels, e.qe)
+		}
+	}
+	return dels, nil
+}
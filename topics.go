@@ -0,0 +1,145 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// TopicInfo represents a topic stored in the db with message count and first/last write times.
+type TopicInfo struct {
+	Topic      []byte    // The topic string.
+	Count      int       // The number of messages stored on the topic.
+	FirstWrite time.Time // The time the first message was stored on the topic.
+	LastWrite  time.Time // The time the last message was stored on the topic.
+}
+
+// Topics returns topics matching the pattern for the contract.
+// A '*' part of the pattern matches any single part of the topic and a trailing '...' matches any number of parts,
+// for example "fleet.eu..." matches all topics under "fleet.eu".
+// Topics stored without the topic string are not returned.
+// Topics reads message IDs of all messages of matching topics to count messages, it is not intended for frequent use.
+func (db *DB) Topics(pattern []byte, contract uint32) ([]TopicInfo, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(pattern) == 0:
+		return nil, errTopicEmpty
+	case len(pattern) > maxTopicLength:
+		return nil, errTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	winFile, err := db.fs.getFile(_FileDesc{fileType: typeTimeWindow})
+	if err != nil {
+		return nil, err
+	}
+	db.internal.compactLock.RLock()
+	defer db.internal.compactLock.RUnlock()
+	parts := splitTopic(pattern)
+	var infos []TopicInfo
+	for _, topic := range db.internal.trie.topics(contract) {
+		if topic.name == "" || !matchTopic(parts, splitTopic([]byte(topic.name))) {
+			continue
+		}
+		info, err := db.topicInfo(winFile, topic)
+		if err != nil {
+			return nil, err
+		}
+		if info.Count == 0 {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return bytes.Compare(infos[i].Topic, infos[j].Topic) < 0
+	})
+
+	return infos, nil
+}
+
+// topicInfo counts messages of the topic and reads first and last write times.
+func (db *DB) topicInfo(winFile *_File, topic _Topic) (TopicInfo, error) {
+	info := TopicInfo{Topic: []byte(topic.name)}
+	it := &ItemIterator{db: db, query: &Query{}, winFile: winFile, lastSeq: math.MaxUint64}
+	it.addCursor(topic, 0)
+	for {
+		qe, ok, err := it.nextEntry()
+		if err != nil {
+			return info, err
+		}
+		if !ok {
+			break
+		}
+		id, err := db.readID(qe)
+		if err != nil {
+			if err == errMsgIDDeleted {
+				continue
+			}
+			return info, err
+		}
+		if db.internal.tombstones.deleted(topic.hash, qe.seq, id.Time()) {
+			continue
+		}
+		// entries are read in reverse time order.
+		t := time.Unix(id.Time(), 0)
+		if info.Count == 0 {
+			info.LastWrite = t
+		}
+		info.FirstWrite = t
+		info.Count++
+	}
+
+	return info, nil
+}
+
+// splitTopic splits the topic into parts, a trailing '...' is kept as the last part.
+func splitTopic(topic []byte) [][]byte {
+	fn := func(c rune) bool { return c == message.TopicSeparator }
+	generic := []byte(message.TopicGenericSymbol)
+	if !bytes.HasSuffix(topic, generic) {
+		return bytes.FieldsFunc(topic, fn)
+	}
+	parts := bytes.FieldsFunc(bytes.TrimSuffix(topic, generic), fn)
+	return append(parts, generic)
+}
+
+// matchTopic matches the topic parts to the pattern parts.
+func matchTopic(pattern, topic [][]byte) bool {
+	for i, p := range pattern {
+		if bytes.Equal(p, []byte(message.TopicGenericSymbol)) && i == len(pattern)-1 {
+			return true
+		}
+		if i >= len(topic) {
+			return false
+		}
+		if len(p) == 1 && p[0] == message.TopicWildcardSymbol {
+			continue
+		}
+		if !bytes.Equal(p, topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
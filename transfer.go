@@ -0,0 +1,292 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// Formats of exported entries.
+const (
+	FormatJSONLines TransferFormat = "jsonl"
+	FormatCSV       TransferFormat = "csv"
+
+	// importBatchSize is the default number of entries written in a batch on import.
+	importBatchSize = 1000
+)
+
+var csvHeader = []string{"topic", "contract", "id", "timestamp", "expires_at", "payload"}
+
+type (
+	// TransferFormat is the format of exported entries, entries are exported one entry per line as JSON Lines or CSV.
+	TransferFormat string
+
+	// ExportSpec specifies entries to export.
+	ExportSpec struct {
+		Format TransferFormat // The format of exported entries, JSON Lines if it is not set.
+		Topic  []byte         // The topic pattern of the topics to export as used by Topics, all topics are exported if it is not set.
+		// The contract of the topics to export, master contract is used if it is not set.
+		Contract uint32
+		From     time.Time // Entries stored before from are not exported, a zero from leaves that end of the range open.
+		To       time.Time // Entries stored at or after to are not exported, a zero to leaves that end of the range open.
+		Raw      bool      // Payloads are exported as text instead of base64, use it only if payloads are valid UTF-8 text.
+	}
+
+	// ImportSpec specifies how entries are imported.
+	ImportSpec struct {
+		Format    TransferFormat // The format of imported entries, JSON Lines if it is not set.
+		Raw       bool           // Payloads are imported as text instead of base64.
+		BatchSize int            // The number of entries written in a batch, 1000 if it is not set.
+		// NewIDs allocates new message IDs to the entries instead of keeping exported IDs,
+		// set it to import entries to a DB that already stores entries with the seqs of the exported IDs.
+		// The entries keep the exported time.
+		NewIDs bool
+	}
+
+	// _Record is an exported entry.
+	_Record struct {
+		Topic     string    `json:"topic"`
+		Contract  uint32    `json:"contract"`
+		ID        string    `json:"id"`
+		Timestamp time.Time `json:"timestamp"`
+		ExpiresAt uint32    `json:"expires_at,omitempty"`
+		Payload   string    `json:"payload"`
+	}
+)
+
+// Export writes entries of topics matching the topic pattern to the writer one entry per line.
+// Entries keep the message ID, the contract, the time and the expiry of the messages so these are imported unchanged.
+// Topics stored without the topic string are not exported. It returns the number of exported entries.
+func (db *DB) Export(w io.Writer, spec ExportSpec) (int, error) {
+	enc, flush, err := newRecordEncoder(w, spec.Format)
+	if err != nil {
+		return 0, err
+	}
+	pattern := spec.Topic
+	if len(pattern) == 0 {
+		pattern = []byte(message.TopicGenericSymbol)
+	}
+	topics, err := db.Topics(pattern, spec.Contract)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, info := range topics {
+		it, err := db.Items(NewQuery(info.Topic).WithContract(spec.Contract).WithRange(spec.From, spec.To))
+		if err != nil {
+			return n, err
+		}
+		for it.Next() {
+			e := it.Entry()
+			r := _Record{
+				Topic:     string(info.Topic),
+				Contract:  e.Contract,
+				ID:        hex.EncodeToString(e.ID),
+				Timestamp: e.Timestamp.UTC(),
+				ExpiresAt: e.ExpiresAt,
+				Payload:   string(e.Payload),
+			}
+			if !spec.Raw {
+				r.Payload = base64.StdEncoding.EncodeToString(e.Payload)
+			}
+			if err := enc(r); err != nil {
+				it.Close()
+				return n, err
+			}
+			n++
+		}
+		err = it.Err()
+		it.Close()
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, flush()
+}
+
+// Import reads entries exported by Export from the reader and writes these to the DB in batches.
+// Message IDs of the entries are kept unless ImportSpec.NewIDs is set, the import fails if the seq of a kept ID is already used by the DB.
+// It returns the number of imported entries, entries of the batches written before an error are imported.
+func (db *DB) Import(r io.Reader, spec ImportSpec) (int, error) {
+	dec, err := newRecordDecoder(r, spec.Format)
+	if err != nil {
+		return 0, err
+	}
+	size := spec.BatchSize
+	if size <= 0 {
+		size = importBatchSize
+	}
+	n := 0
+	line := 0
+	for done := false; !done; {
+		count := 0
+		// seqs of kept IDs of the batch, these are not in the memdb until the batch is committed.
+		seqs := make(map[uint64]struct{})
+		err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+			for count < size {
+				rec, err := dec()
+				if err == io.EOF {
+					done = true
+					return nil
+				}
+				line++
+				if err != nil {
+					return fmt.Errorf("unitdb.Import: record %d: %v", line, err)
+				}
+				e, err := rec.entry(spec)
+				if err != nil {
+					return fmt.Errorf("unitdb.Import: record %d: %v", line, err)
+				}
+				if e.ID != nil {
+					seq := message.ID(e.ID).Sequence()
+					exists, err := db.seqExists(seq)
+					if err != nil {
+						return fmt.Errorf("unitdb.Import: record %d: %v", line, err)
+					}
+					if _, ok := seqs[seq]; ok || exists {
+						return fmt.Errorf("unitdb.Import: record %d: %v", line, errEntryExist)
+					}
+					seqs[seq] = struct{}{}
+				}
+				if err := b.PutEntry(e); err != nil {
+					return fmt.Errorf("unitdb.Import: record %d: %v", line, err)
+				}
+				count++
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		n += count
+	}
+	return n, nil
+}
+
+// entry returns the entry of the record.
+func (r _Record) entry(spec ImportSpec) (*Entry, error) {
+	if r.Topic == "" {
+		return nil, errTopicEmpty
+	}
+	payload := []byte(r.Payload)
+	if !spec.Raw {
+		var err error
+		if payload, err = base64.StdEncoding.DecodeString(r.Payload); err != nil {
+			return nil, err
+		}
+	}
+	e := NewEntry([]byte(r.Topic), payload).WithContract(r.Contract)
+	e.ExpiresAt = r.ExpiresAt
+	if r.ID != "" && !spec.NewIDs {
+		id, err := hex.DecodeString(r.ID)
+		if err != nil || len(id) != message.ID(id).Size() || message.ID(id).Sequence() == 0 {
+			return nil, errRecordInvalid
+		}
+		e.ID = id
+	} else if !r.Timestamp.IsZero() {
+		e.WithTimestamp(r.Timestamp)
+	}
+	return e, nil
+}
+
+// newRecordEncoder returns a function to write records in the format and a function to flush written records.
+func newRecordEncoder(w io.Writer, format TransferFormat) (func(_Record) error, func() error, error) {
+	switch format {
+	case "", FormatJSONLines:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		return func(r _Record) error { return enc.Encode(r) }, bw.Flush, nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return nil, nil, err
+		}
+		enc := func(r _Record) error {
+			return cw.Write([]string{
+				r.Topic,
+				strconv.FormatUint(uint64(r.Contract), 10),
+				r.ID,
+				r.Timestamp.Format(time.RFC3339),
+				strconv.FormatUint(uint64(r.ExpiresAt), 10),
+				r.Payload,
+			})
+		}
+		flush := func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+		return enc, flush, nil
+	default:
+		return nil, nil, errFormatInvalid
+	}
+}
+
+// newRecordDecoder returns a function to read records in the format, it returns io.EOF after the last record.
+func newRecordDecoder(r io.Reader, format TransferFormat) (func() (_Record, error), error) {
+	switch format {
+	case "", FormatJSONLines:
+		dec := json.NewDecoder(bufio.NewReader(r))
+		return func() (rec _Record, err error) {
+			err = dec.Decode(&rec)
+			return rec, err
+		}, nil
+	case FormatCSV:
+		cr := csv.NewReader(bufio.NewReader(r))
+		cr.FieldsPerRecord = len(csvHeader)
+		header := true
+		return func() (rec _Record, err error) {
+			fields, err := cr.Read()
+			if err == nil && header {
+				header = false
+				if fields[0] == csvHeader[0] {
+					fields, err = cr.Read()
+				}
+			}
+			if err != nil {
+				return rec, err
+			}
+			rec.Topic, rec.ID, rec.Payload = fields[0], fields[2], fields[5]
+			contract, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return rec, errRecordInvalid
+			}
+			expiresAt, err := strconv.ParseUint(fields[4], 10, 32)
+			if err != nil {
+				return rec, errRecordInvalid
+			}
+			if fields[3] != "" {
+				if rec.Timestamp, err = time.Parse(time.RFC3339, fields[3]); err != nil {
+					return rec, errRecordInvalid
+				}
+			}
+			rec.Contract, rec.ExpiresAt = uint32(contract), uint32(expiresAt)
+			return rec, nil
+		}, nil
+	default:
+		return nil, errFormatInvalid
+	}
+}
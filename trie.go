@@ -28,13 +28,14 @@ const (
 
 type _Topic struct {
 	hash   uint64
+	name   string // name is the topic string, it is empty for topics stored without the topic string.
 	offset int64
 }
 
 type _Topics []_Topic
 
-func newTopic(hash uint64, off int64) _Topic {
-	return _Topic{hash: hash, offset: off}
+func newTopic(hash uint64, name []byte, off int64) _Topic {
+	return _Topic{hash: hash, name: string(name), offset: off}
 }
 
 // addUnique adds topic to the set.
@@ -187,6 +188,52 @@ func (t *_Trie) ilookup(query []message.Part, depth, topicType uint8, tops *_Top
 	}
 }
 
+// topics returns all topics stored with the contract.
+func (t *_Trie) topics(contract uint32) (tops _Topics) {
+	t.RLock()
+	defer t.RUnlock()
+	if n, ok := t.topicTrie.root.children[_Part{hash: contract}]; ok {
+		t.itopics(n, &tops)
+	}
+	return
+}
+
+// allTopics returns all topics in the trie.
+func (t *_Trie) allTopics() (tops _Topics) {
+	t.RLock()
+	defer t.RUnlock()
+	t.itopics(t.topicTrie.root, &tops)
+	return
+}
+
+func (t *_Trie) itopics(currNode *_Node, tops *_Topics) {
+	*tops = append(*tops, currNode.topics...)
+	for _, n := range currNode.children {
+		t.itopics(n, tops)
+	}
+}
+
+// remove removes a topic from the trie, nodes left without topics are removed.
+func (t *_Trie) remove(topicHash uint64) (removed bool) {
+	t.Lock()
+	defer t.Unlock()
+	curr, ok := t.topicTrie.summary[topicHash]
+	if !ok {
+		return false
+	}
+	for i, topic := range curr.topics {
+		if topic.hash == topicHash {
+			curr.topics = append(curr.topics[:i], curr.topics[i+1:]...)
+			break
+		}
+	}
+	delete(t.topicTrie.summary, topicHash)
+	if len(curr.topics) == 0 && len(curr.children) == 0 {
+		curr.orphan()
+	}
+	return true
+}
+
 func (t *_Trie) getOffset(topicHash uint64) (off int64, ok bool) {
 	t.RLock()
 	defer t.RUnlock()
@@ -200,6 +247,19 @@ func (t *_Trie) getOffset(topicHash uint64) (off int64, ok bool) {
 	return off, ok
 }
 
+func (t *_Trie) getName(topicHash uint64) (name string, ok bool) {
+	t.RLock()
+	defer t.RUnlock()
+	if curr, ok := t.topicTrie.summary[topicHash]; ok {
+		for _, topic := range curr.topics {
+			if topic.hash == topicHash {
+				return topic.name, ok
+			}
+		}
+	}
+	return name, ok
+}
+
 func (t *_Trie) setOffset(topic _Topic) (ok bool) {
 	t.Lock()
 	defer t.Unlock()
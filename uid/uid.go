@@ -42,8 +42,12 @@ type LID uint64
 
 // NewApoch creates an appoch to generate unique id.
 func NewApoch() uint32 {
-	now := uint32(time.Now().Unix() - Offset)
-	return math.MaxUint32 - now
+	return Apoch(time.Now())
+}
+
+// Apoch creates an appoch from the time t to generate id.
+func Apoch(t time.Time) uint32 {
+	return math.MaxUint32 - uint32(t.Unix()-Offset)
 }
 
 // NewUnique return unique value to use generating unique id.
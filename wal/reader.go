@@ -19,6 +19,10 @@ package wal
 import (
 	"encoding/binary"
 	"errors"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/uid"
@@ -91,3 +95,41 @@ func (r *Reader) Next() ([]byte, bool, error) {
 	r.offset += int64(dataLen)
 	return data, true, nil
 }
+
+// ValidLog validates the header and the records of the log file, f is called to validate each record of the log.
+// It returns false if the log is not valid, an error is returned if the log file cannot be read.
+func ValidLog(name string, f func(record []byte) bool) (bool, error) {
+	timeID, err := strconv.ParseInt(strings.TrimSuffix(path.Base(name), logExt), 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	if len(data) < logHeaderSize {
+		return false, nil
+	}
+	info := _LogInfo{}
+	if err := info.UnmarshalBinary(data[:logHeaderSize]); err != nil {
+		return false, nil
+	}
+	if info.timeID != timeID || int64(info.size) != int64(len(data)-logHeaderSize) {
+		return false, nil
+	}
+	data = data[logHeaderSize:]
+	for i := uint32(0); i < info.count; i++ {
+		if len(data) < 4 {
+			return false, nil
+		}
+		dataLen := binary.LittleEndian.Uint32(data[:4])
+		if dataLen < 4 || int64(dataLen) > int64(len(data)) {
+			return false, nil
+		}
+		if !f(data[4:dataLen]) {
+			return false, nil
+		}
+		data = data[dataLen:]
+	}
+	return true, nil
+}
@@ -19,6 +19,7 @@ package wal
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -174,3 +175,52 @@ func TestSimple(t *testing.T) {
 	}
 
 }
+
+func TestValidLog(t *testing.T) {
+	wal, err := newTestWal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	var i uint16
+	var n uint16 = 100
+
+	logWriter, err := wal.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i = 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := <-logWriter.Append(val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := <-logWriter.SignalInitWrite(int64(n)); err != nil {
+		t.Fatal(err)
+	}
+
+	name := logPath(dbPath+"/"+logDir, int64(n))
+	count := 0
+	ok, err := ValidLog(name, func(record []byte) bool {
+		count++
+		return true
+	})
+	if !ok || err != nil || count != int(n) {
+		t.Fatalf("expected valid log of %d records; got %v, %d, %v", n, ok, count, err)
+	}
+
+	// a log is not valid if its size does not match the header.
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, data[:len(data)-1], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ValidLog(name, func(record []byte) bool { return true }); ok || err != nil {
+		t.Fatalf("expected truncated log to be invalid; got %v, %v", ok, err)
+	}
+}
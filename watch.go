@@ -0,0 +1,200 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// WatchOverflow is the policy applied if the buffer of a watcher is full.
+type WatchOverflow uint8
+
+const (
+	// WatchDropNewest drops new entries while the buffer of the watcher is full.
+	WatchDropNewest WatchOverflow = iota
+	// WatchDropOldest drops the oldest buffered entry to make room for the new entry.
+	WatchDropOldest
+	// WatchClose closes the channel of the watcher if the buffer is full, the watcher has to watch again.
+	WatchClose
+)
+
+type (
+	// _Watcher is a subscription to entries put to topics matching the topic pattern.
+	_Watcher struct {
+		id       uint64
+		overflow WatchOverflow
+
+		mu     sync.Mutex
+		c      chan Entry
+		closed bool
+	}
+
+	// _Watchers keeps topic patterns of watchers in a trie, topics of new entries are looked up in the trie to find the watchers.
+	_Watchers struct {
+		mu       sync.RWMutex
+		trie     *_Trie
+		watchers map[uint64]*_Watcher
+		nextID   uint64
+	}
+)
+
+func newWatchers() *_Watchers {
+	return &_Watchers{trie: newTrie(), watchers: make(map[uint64]*_Watcher)}
+}
+
+// Watch returns a channel to receive entries put to topics matching the topic pattern until the context is done or the DB is closed.
+// The topic pattern supports the '*' wildcard to match a topic part and the '...' suffix to match all remaining topic parts.
+// Each watcher has a bounded buffer, see WithWatchBuffer to set the buffer size and the policy applied if the buffer is full.
+func (db *DB) Watch(ctx context.Context, topic []byte, contract uint32) (<-chan Entry, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(topic) == 0:
+		return nil, errTopicEmpty
+	case len(topic) > maxTopicLength:
+		return nil, errTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return nil, err
+	}
+	t.AddContract(contract)
+	w := db.internal.watchers.add(t, db.opts.watchBufferSize, db.opts.watchOverflow)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-db.internal.closeC:
+		}
+		db.internal.watchers.remove(w)
+	}()
+	return w.c, nil
+}
+
+func (ws *_Watchers) add(t *message.Topic, size int, overflow WatchOverflow) *_Watcher {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.nextID++
+	w := &_Watcher{id: ws.nextID, overflow: overflow, c: make(chan Entry, size)}
+	ws.watchers[w.id] = w
+	ws.trie.add(newTopic(w.id, t.Topic, 0), t.Parts, t.Depth)
+	return w
+}
+
+func (ws *_Watchers) remove(w *_Watcher) {
+	ws.mu.Lock()
+	delete(ws.watchers, w.id)
+	ws.trie.remove(w.id)
+	ws.mu.Unlock()
+	w.close()
+}
+
+func (ws *_Watchers) len() int {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	return len(ws.watchers)
+}
+
+// notify sends the entry to watchers of topic patterns matching the topic of the entry.
+func (ws *_Watchers) notify(t *message.Topic, e Entry) {
+	ws.mu.RLock()
+	var watchers []*_Watcher
+	for _, topic := range ws.trie.lookup(t.Parts, t.Depth, t.TopicType) {
+		if w, ok := ws.watchers[topic.hash]; ok {
+			watchers = append(watchers, w)
+		}
+	}
+	ws.mu.RUnlock()
+	for _, w := range watchers {
+		if !w.send(e) {
+			ws.remove(w)
+		}
+	}
+}
+
+// send sends the entry to the watcher applying the overflow policy if the buffer is full.
+// It returns false if the watcher is to be closed.
+func (w *_Watcher) send(e Entry) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return true
+	}
+	for {
+		select {
+		case w.c <- e:
+			return true
+		default:
+		}
+		switch w.overflow {
+		case WatchDropNewest:
+			return true
+		case WatchClose:
+			return false
+		}
+		// drop the oldest entry and retry.
+		select {
+		case <-w.c:
+		default:
+		}
+	}
+}
+
+func (w *_Watcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	close(w.c)
+}
+
+// watchEntry returns the entry sent to watchers, the topic and payload are copied as the entry is reset after put.
+func (db *DB) watchEntry(e *Entry) Entry {
+	prefix := message.ID(e.entry.cache[entrySize : entrySize+idSize-1])
+	id := message.NewID(e.entry.seq)
+	copy(id, prefix)
+	return Entry{
+		ID:        id,
+		Topic:     append([]byte(nil), e.Topic...),
+		Payload:   append([]byte(nil), e.Payload...),
+		ExpiresAt: e.entry.expiresAt,
+		Contract:  prefix.Contract(),
+		Timestamp: time.Unix(prefix.Time(), 0),
+	}
+}
+
+// notify sends entries to watchers of the topics of the entries.
+func (db *DB) notify(entries []Entry) {
+	for _, e := range entries {
+		t, _, err := db.parseTopic(e.Contract, e.Topic)
+		if err != nil {
+			continue
+		}
+		t.AddContract(e.Contract)
+		e.Topic = t.Topic
+		db.internal.watchers.notify(t, e)
+	}
+}